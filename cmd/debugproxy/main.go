@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/proxy"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// a forward proxy for developer machines, point HTTP_PROXY and
+// HTTPS_PROXY at it to see the requests a program makes
+
+func main() {
+	port := flag.Int("port", 8888, "port to listen on")
+	allow := flag.String("allow", "", "comma-separated destinations to allow, all when empty")
+	deny := flag.String("deny", "", "comma-separated destinations to refuse")
+	user := flag.String("user", "", "username required in Proxy-Authorization")
+	pass := flag.String("pass", "", "password required in Proxy-Authorization")
+	flag.Parse()
+
+	p := proxy.NewForward()
+	p.Allow = list(*allow)
+	p.Deny = list(*deny)
+	p.Username = *user
+	p.Password = *pass
+
+	s, err := server.Serve(*port, logRequests(p.Handle), server.WithTunneling())
+	if err != nil {
+		fatal("Error starting proxy", err)
+	}
+	defer func() {
+		if err := s.Close(); err != nil {
+			fatal("Error closing proxy", err)
+		}
+	}()
+	slog.Info("Proxy started", "port", s.Port)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	slog.Info("Proxy gracefully stopped")
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+func logRequests(next server.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		// the server's request logger carries the address, method and target
+		w.Logger.Info("Proxying request")
+		next(w, r)
+	}
+}
+
+func list(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -1,67 +1,164 @@
 package main
 
 import (
-	"log"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 
+	"github.com/k4rldoherty/http-from-tcp/internal/accesslog"
+	"github.com/k4rldoherty/http-from-tcp/internal/compress"
+	"github.com/k4rldoherty/http-from-tcp/internal/conditional"
 	"github.com/k4rldoherty/http-from-tcp/internal/handlers"
+	"github.com/k4rldoherty/http-from-tcp/internal/metrics"
 	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/requestid"
 	"github.com/k4rldoherty/http-from-tcp/internal/response"
 	"github.com/k4rldoherty/http-from-tcp/internal/server"
+	"github.com/k4rldoherty/http-from-tcp/internal/tracing"
 )
 
 const port = 42069
 
+// registry holds the server's metrics, served at /metrics
+var registry = metrics.NewRegistry()
+
 func main() {
-	server, err := server.Serve(port, handler)
+	logPath := flag.String("access-log", "", "file to write the access log to, stdout when empty")
+	logFormat := flag.String("log-format", "combined", "access log format: common, combined or json")
+	logMaxSize := flag.Int64("log-max-size", accesslog.DefaultMaxSize>>20, "size in MB at which the access log file is rotated")
+	logLevel := flag.String("log-level", "info", "server log level: debug, info, warn or error")
+	logJSON := flag.Bool("log-json", false, "write the server log as JSON")
+	traceExporter := flag.String("trace-exporter", "none", "where spans are exported: none, stdout or otlp")
+	otlpAddr := flag.String("otlp-addr", "localhost:4318", "host:port of the OTLP/HTTP collector")
+	serviceName := flag.String("service-name", "httpserver", "service name spans are reported under")
+	idFormat := flag.String("request-id-format", "uuid", "format of request IDs: uuid or ulid")
+	trustIDs := flag.Bool("trust-request-id", false, "keep the X-Request-Id clients send, only behind a proxy that sets it")
+	flag.Parse()
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fatal("Invalid log level", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var logHandler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if *logJSON {
+		logHandler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	// the server and the packages it uses log to the default logger
+	slog.SetDefault(slog.New(logHandler))
+
+	format, err := accesslog.ParseFormat(*logFormat)
+	if err != nil {
+		fatal("Invalid access log format", err)
+	}
+	var out io.Writer = os.Stdout
+	if *logPath != "" {
+		f := accesslog.NewRotatingFile(*logPath)
+		f.MaxSize = *logMaxSize << 20
+		defer func() {
+			if err := f.Close(); err != nil {
+				slog.Error("Error closing access log", "err", err)
+			}
+		}()
+		out = f
+	}
+	access := accesslog.New(out)
+	access.Format = format
+
+	serverMetrics := metrics.NewServer(registry)
+	serverMetrics.Route = route
+	middleware := []server.Middleware{serverMetrics.Middleware, access.Middleware, conditional.Middleware, compress.New().Middleware}
+
+	var exporter tracing.Exporter
+	switch *traceExporter {
+	case "none":
+	case "stdout":
+		exporter = tracing.NewJSONExporter(os.Stdout)
+	case "otlp":
+		exporter = tracing.NewOTLPExporter(*otlpAddr, *serviceName)
+	default:
+		fatal("Invalid trace exporter", fmt.Errorf("unknown exporter %q", *traceExporter))
+	}
+	if exporter != nil {
+		tracer := tracing.NewTracer(exporter)
+		tracer.Route = route
+		defer tracer.Close()
+		middleware = append([]server.Middleware{tracer.Middleware}, middleware...)
+	}
+
+	idf, err := requestid.ParseFormat(*idFormat)
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		fatal("Invalid request ID format", err)
+	}
+	serverOpts := []server.Option{server.WithObserver(serverMetrics), server.WithRequestIDFormat(idf)}
+	if *trustIDs {
+		serverOpts = append(serverOpts, server.WithTrustedRequestIDs())
+	}
+
+	server, err := server.Serve(port, server.Chain(handler, middleware...), serverOpts...)
+	if err != nil {
+		fatal("Error starting server", err)
 	}
 	defer func() {
 		err := server.Close()
 		if err != nil {
-			log.Fatalf("Error closing server: %v", err)
+			fatal("Error closing server", err)
 		}
 	}()
-	log.Println("Server started on port", port)
+	slog.Info("Server started", "port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
-	log.Println("Server gracefully stopped")
+	slog.Info("Server gracefully stopped")
 }
 
-func handler(w *response.Writer, r *request.Request) {
-	url := r.RequestLine.Target
-	if url == "/yourproblem" {
-		log.Println("handling /yourproblem call")
-		handlers.HandleYourProblem(w, r)
-		return
-	}
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
 
-	if url == "/myproblem" {
-		log.Println("handling /myproblem call")
-		handlers.HandleMyProblem(w, r)
-		return
-	}
+// routes are the paths handler serves, in the order they are tried. A
+// prefix route matches every path starting with its path.
+var routes = []struct {
+	name   string
+	path   string
+	prefix bool
+	handle server.Handler
+}{
+	{name: "metrics", path: "/metrics", handle: registry.Handler},
+	{name: "yourproblem", path: "/yourproblem", handle: handlers.HandleYourProblem},
+	{name: "myproblem", path: "/myproblem", handle: handlers.HandleMyProblem},
+	{name: "httpbin", path: "/httpbin", prefix: true, handle: handlers.HandleHTTPBin},
+	{name: "video", path: "/video", prefix: true, handle: handlers.HandleVideo},
+}
 
-	if strings.HasPrefix(url, "/httpbin") {
-		log.Println("handling /httpbin call")
-		handlers.HandleHTTPBin(w, r)
-		log.Println("handled /httpbin call")
-		return
-	}
+// byName holds the handler of each route, and of "other" for requests
+// matching none of them
+var byName = map[string]server.Handler{"other": handlers.HandleOther}
 
-	if strings.HasPrefix(url, "/video") {
-		log.Println("handling /video call")
-		handlers.HandleVideo(w, r)
-		log.Println("handled /video call")
-		return
+func init() {
+	for _, rt := range routes {
+		byName[rt.name] = rt.handle
 	}
+}
+
+func handler(w *response.Writer, r *request.Request) {
+	byName[route(r)](w, r)
+}
 
-	log.Println("handling other call")
-	handlers.HandleOther(w, r)
+// route names the route of r, for handler and for metrics and tracing
+func route(r *request.Request) string {
+	url := r.RequestLine.Target
+	for _, rt := range routes {
+		if url == rt.path || rt.prefix && strings.HasPrefix(url, rt.path) {
+			return rt.name
+		}
+	}
+	return "other"
 }
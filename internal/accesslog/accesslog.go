@@ -0,0 +1,233 @@
+// Package accesslog - to log each request and the response it got
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/requestid"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+type Format int
+
+const (
+	// Common is the Apache Common Log Format
+	Common Format = iota
+	// Combined is the Common format followed by the Referer and
+	// User-Agent, the default of most web servers
+	Combined
+	// JSON writes each entry as a JSON object on a line of its own,
+	// with every field of Entry
+	JSON
+)
+
+// ParseFormat returns the Format named "common", "combined" or "json".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "common":
+		return Common, nil
+	case "combined":
+		return Combined, nil
+	case "json":
+		return JSON, nil
+	default:
+		return 0, fmt.Errorf("unknown log format %q", name)
+	}
+}
+
+// commonTime is the timestamp layout of the Common and Combined formats
+const commonTime = "02/Jan/2006:15:04:05 -0700"
+
+// Entry is what is logged about a request.
+type Entry struct {
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	Target     string
+	Protocol   string
+	// Status is 0 if no response was written, e.g. for a hijacked
+	// connection
+	Status    int
+	Bytes     int64
+	Duration  time.Duration
+	Referer   string
+	UserAgent string
+	// RequestID is the X-Request-Id of the response, or the ID the server
+	// gave the request if the response didn't set one. A client's own
+	// X-Request-Id is only used if the server trusted it.
+	RequestID string
+}
+
+type Logger struct {
+	// Out is where entries are written, one line each. Writes are
+	// serialized, so it needn't be safe for concurrent use.
+	Out    io.Writer
+	Format Format
+	// ErrorLog is where entries that couldn't be written are reported,
+	// slog.Default() if nil
+	ErrorLog *slog.Logger
+
+	mu sync.Mutex
+}
+
+// New makes a Logger writing the Combined format to out.
+func New(out io.Writer) *Logger {
+	return &Logger{Out: out, Format: Combined, ErrorLog: slog.Default()}
+}
+
+// Middleware logs each request once the response to it is finished, so
+// the count of bytes sent is complete.
+func (l *Logger) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		start := time.Now()
+		// headers later hooks add are in the map by the time it's read
+		var sent headers.Headers
+		w.OnWriteHeaders(func(w *response.Writer, h headers.Headers) {
+			sent = h
+		})
+		w.OnFinish(func(w *response.Writer, err error) {
+			e := Entry{
+				Time:       start,
+				RemoteAddr: r.RemoteAddr,
+				Method:     r.RequestLine.Method,
+				Target:     r.RequestLine.Target,
+				Protocol:   "HTTP/" + r.RequestLine.HTTPVersion,
+				Bytes:      w.BytesWritten(),
+				Duration:   time.Since(start),
+				Referer:    r.Headers.Get("referer"),
+				UserAgent:  r.Headers.Get("user-agent"),
+				RequestID:  requestid.FromContext(r.Context()),
+			}
+			if w.State != response.WritingStatusLine {
+				e.Status = int(w.StatusCode)
+			}
+			if id := sent.Get("X-Request-Id"); id != "" {
+				e.RequestID = id
+			}
+			l.Log(e)
+		})
+		next(w, r)
+	}
+}
+
+// Log writes e to Out.
+func (l *Logger) Log(e Entry) {
+	line, err := l.format(e)
+	if err != nil {
+		l.errorLog().Error("error formatting access log entry", "err", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.Out.Write(line); err != nil {
+		l.errorLog().Error("error writing access log entry", "err", err)
+	}
+}
+
+func (l *Logger) errorLog() *slog.Logger {
+	if l.ErrorLog == nil {
+		return slog.Default()
+	}
+	return l.ErrorLog
+}
+
+func (l *Logger) format(e Entry) ([]byte, error) {
+	switch l.Format {
+	case Common:
+		return append(common(e), '\n'), nil
+	case Combined:
+		line := fmt.Appendf(common(e), ` "%s" "%s"`, escape(e.Referer), escape(e.UserAgent))
+		return append(line, '\n'), nil
+	case JSON:
+		line, err := json.Marshal(jsonEntry{
+			Time:       e.Time.Format(time.RFC3339Nano),
+			RemoteAddr: e.RemoteAddr,
+			Method:     e.Method,
+			Target:     e.Target,
+			Protocol:   e.Protocol,
+			Status:     e.Status,
+			Bytes:      e.Bytes,
+			DurationMS: float64(e.Duration.Microseconds()) / 1000,
+			Referer:    e.Referer,
+			UserAgent:  e.UserAgent,
+			RequestID:  e.RequestID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return append(line, '\n'), nil
+	default:
+		return nil, fmt.Errorf("unknown format %d", l.Format)
+	}
+}
+
+type jsonEntry struct {
+	Time       string  `json:"time"`
+	RemoteAddr string  `json:"remote_addr"`
+	Method     string  `json:"method"`
+	Target     string  `json:"target"`
+	Protocol   string  `json:"protocol"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	RequestID  string  `json:"request_id,omitempty"`
+}
+
+// common formats e as `host - - [time] "request line" status bytes`,
+// with "-" for anything unknown.
+func common(e Entry) []byte {
+	host := e.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	status, bytes := "-", "-"
+	if e.Status != 0 {
+		status = fmt.Sprint(e.Status)
+	}
+	if e.Bytes > 0 {
+		bytes = fmt.Sprint(e.Bytes)
+	}
+	return fmt.Appendf(nil, `%s - - [%s] "%s %s %s" %s %s`,
+		dash(host), e.Time.Format(commonTime),
+		escape(e.Method), escape(e.Target), escape(e.Protocol), status, bytes)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escape makes s safe to put between quotes in a log line, the way Apache
+// does, so a client can't forge entries with quotes or newlines.
+func escape(s string) string {
+	if s == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,169 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/requestid"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/servertest"
+)
+
+var entry = Entry{
+	Time:       time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60)),
+	RemoteAddr: "127.0.0.1:51234",
+	Method:     "GET",
+	Target:     "/apache_pb.gif",
+	Protocol:   "HTTP/1.0",
+	Status:     200,
+	Bytes:      2326,
+	Duration:   1500 * time.Microsecond,
+	Referer:    "http://www.example.com/start.html",
+	UserAgent:  "Mozilla/4.08 [en] (Win98; I ;Nav)",
+	RequestID:  "abc123",
+}
+
+func TestFormats(t *testing.T) {
+	tests := map[Format]string{
+		Common:   `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326` + "\n",
+		Combined: `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"` + "\n",
+		JSON: `{"time":"2000-10-10T13:55:36-07:00","remote_addr":"127.0.0.1:51234","method":"GET",` +
+			`"target":"/apache_pb.gif","protocol":"HTTP/1.0","status":200,"bytes":2326,"duration_ms":1.5,` +
+			`"referer":"http://www.example.com/start.html","user_agent":"Mozilla/4.08 [en] (Win98; I ;Nav)","request_id":"abc123"}` + "\n",
+	}
+	for format, want := range tests {
+		var out bytes.Buffer
+		l := New(&out)
+		l.Format = format
+		l.Log(entry)
+		assert.Equal(t, want, out.String())
+	}
+}
+
+func TestUnknownValues(t *testing.T) {
+	var out bytes.Buffer
+	New(&out).Log(Entry{Time: entry.Time, Method: "GET", Target: "/", Protocol: "HTTP/1.1"})
+	assert.Equal(t, `- - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" - - "-" "-"`+"\n", out.String())
+}
+
+func TestEscaping(t *testing.T) {
+	var out bytes.Buffer
+	e := entry
+	e.Target = "/\"forged\" 200 1\n127.0.0.1"
+	e.UserAgent = `back\slash`
+	New(&out).Log(e)
+	assert.Contains(t, out.String(), `"GET /\"forged\" 200 1\x0a127.0.0.1 HTTP/1.0"`)
+	assert.Contains(t, out.String(), `"back\\slash"`)
+	assert.Equal(t, 1, strings.Count(out.String(), "\n"))
+}
+
+func TestMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	l := New(&out)
+	l.Format = JSON
+	handler := l.Middleware(func(w *response.Writer, r *request.Request) {
+		_ = w.WriteStatusLine(response.StatusCode(201))
+		w.OnWriteHeaders(func(w *response.Writer, h headers.Headers) {
+			h.Set("X-Request-Id", "from-response")
+		})
+		_ = w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"})
+		_ = w.WriteChunkedBody([]byte("hello "))
+		_ = w.WriteChunkedBody([]byte("world"))
+		// left for the server to finish
+	})
+
+	r := servertest.NewRequest("POST /items?id=1 HTTP/1.1\r\nHost: x\r\nReferer: http://x/\r\n" +
+		"User-Agent: test\r\nX-Request-Id: from-request\r\nContent-Length: 0\r\n\r\n")
+	rec := servertest.NewRecorder(r)
+	handler(rec.Writer, r)
+	res, err := rec.Result()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(res.Body))
+
+	var got jsonEntry
+	require.NoError(t, json.Unmarshal(out.Bytes(), &got))
+	assert.Equal(t, "192.0.2.1:1234", got.RemoteAddr)
+	assert.Equal(t, "POST", got.Method)
+	assert.Equal(t, "/items?id=1", got.Target)
+	assert.Equal(t, "HTTP/1.1", got.Protocol)
+	assert.Equal(t, 201, got.Status)
+	assert.Equal(t, int64(11), got.Bytes)
+	assert.Equal(t, "http://x/", got.Referer)
+	assert.Equal(t, "test", got.UserAgent)
+	assert.Equal(t, "from-response", got.RequestID)
+	assert.GreaterOrEqual(t, got.DurationMS, 0.0)
+}
+
+func TestMiddlewareHEAD(t *testing.T) {
+	var out bytes.Buffer
+	handler := New(&out).Middleware(func(w *response.Writer, r *request.Request) {
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(5))
+		_, _ = w.WriteBody([]byte("hello"))
+	})
+	r := servertest.NewRequest("HEAD / HTTP/1.1\r\nHost: x\r\n\r\n")
+	rec := servertest.NewRecorder(r)
+	handler(rec.Writer, r)
+	_, err := rec.Result()
+	require.NoError(t, err)
+	// nothing of the body was sent
+	assert.Contains(t, out.String(), `"HEAD / HTTP/1.1" 200 - `)
+}
+
+func TestMiddlewareRequestIDFromContext(t *testing.T) {
+	var out bytes.Buffer
+	l := New(&out)
+	l.Format = JSON
+	// nothing is written, so no response header carries the ID
+	handler := l.Middleware(func(w *response.Writer, r *request.Request) {})
+	r := servertest.NewRequest("GET / HTTP/1.1\r\nHost: x\r\nX-Request-Id: forged\r\n\r\n")
+	r.SetContext(requestid.NewContext(r.Context(), "from-server"))
+	rec := servertest.NewRecorder(r)
+	handler(rec.Writer, r)
+	require.NoError(t, rec.Writer.Finish())
+
+	var got jsonEntry
+	require.NoError(t, json.Unmarshal(out.Bytes(), &got))
+	assert.Equal(t, "from-server", got.RequestID)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f := NewRotatingFile(path)
+	f.MaxSize = 10
+	f.MaxBackups = 2
+	defer func() { _ = f.Close() }()
+
+	for _, line := range []string{"1111\n", "2222\n", "3333\n", "4444\n", "5555\n", "6666\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	read := func(name string) string {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		return string(b)
+	}
+	assert.Equal(t, "5555\n6666\n", read(path))
+	assert.Equal(t, "3333\n4444\n", read(path+".1"))
+	assert.Equal(t, "1111\n2222\n", read(path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	// an existing file is appended to, and counts towards the limit
+	require.NoError(t, f.Close())
+	f = NewRotatingFile(path)
+	f.MaxSize = 10
+	_, err := f.Write([]byte("7777\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "7777\n", read(path))
+	assert.Equal(t, "5555\n6666\n", read(path+".1"))
+}
@@ -0,0 +1,348 @@
+package adapter
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/client"
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/requestid"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+func start(t *testing.T, handler server.Handler) string {
+	t.Helper()
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s.Listener.Addr().String()
+}
+
+func TestFromHTTPRequest(t *testing.T) {
+	seen := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	addr := start(t, FromHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen <- r
+		bodies <- string(body)
+		w.Header().Set("X-Method", r.Method)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, "hello")
+	})))
+
+	req := request.New("POST", "/items?color=red", strings.NewReader("payload"))
+	req.Headers.Set("host", "example.com")
+	req.Headers.Set("x-token", "abc")
+	req.Headers.Set("content-length", "7")
+	res, err := client.Do(addr, req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	r := <-seen
+	assert.Equal(t, "POST", r.Method)
+	assert.Equal(t, "/items", r.URL.Path)
+	assert.Equal(t, "red", r.URL.Query().Get("color"))
+	assert.Equal(t, "/items?color=red", r.RequestURI)
+	assert.Equal(t, "example.com", r.Host)
+	assert.Empty(t, r.Header.Get("Host"))
+	assert.Equal(t, "abc", r.Header.Get("X-Token"))
+	assert.Equal(t, int64(7), r.ContentLength)
+	assert.Equal(t, 1, r.ProtoMajor)
+	assert.Equal(t, 1, r.ProtoMinor)
+	assert.NotEmpty(t, r.RemoteAddr)
+	assert.Equal(t, "payload", <-bodies)
+
+	assert.Equal(t, 201, res.StatusCode)
+	assert.Equal(t, "POST", res.Headers.Get("x-method"))
+	assert.Equal(t, "text/plain; charset=utf-8", res.Headers.Get("content-type"))
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestFromHTTPChunkedRequestTrailers(t *testing.T) {
+	trailers := make(chan http.Header, 1)
+	addr := start(t, FromHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		trailers <- r.Trailer
+	})))
+
+	req := request.New("POST", "/", strings.NewReader("some data"))
+	req.Headers.Set("transfer-encoding", "chunked")
+	req.Headers.Set("trailer", "x-checksum")
+	req.Trailers.Set("x-checksum", "1234")
+	res, err := client.Do(addr, req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	assert.Equal(t, "1234", (<-trailers).Get("X-Checksum"))
+}
+
+func TestFromHTTPStreamingWithTrailers(t *testing.T) {
+	release := make(chan struct{})
+	addr := start(t, FromHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Total")
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "first ")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "second")
+		w.Header().Set("X-Total", "2")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "yes")
+	})))
+
+	res, err := client.Do(addr, request.New("GET", "/", nil))
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	assert.Equal(t, "chunked", res.Headers.Get("transfer-encoding"))
+
+	// the first part arrives before the handler goes on
+	first := make([]byte, len("first "))
+	_, err = io.ReadFull(res.Body, first)
+	require.NoError(t, err)
+	assert.Equal(t, "first ", string(first))
+	close(release)
+
+	rest, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(rest))
+	assert.Equal(t, "2", res.Trailers.Get("x-total"))
+	assert.Equal(t, "yes", res.Trailers.Get("x-late"))
+}
+
+func TestFromHTTPEmptyResponses(t *testing.T) {
+	addr := start(t, FromHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/none" {
+			w.WriteHeader(http.StatusNoContent)
+			_, err := io.WriteString(w, "ignored")
+			assert.ErrorIs(t, err, http.ErrBodyNotAllowed)
+		}
+	})))
+
+	c := client.New()
+	defer c.CloseIdleConnections()
+	res, err := c.Do(addr, request.New("GET", "/", nil))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "0", res.Headers.Get("content-length"))
+	assert.Empty(t, res.Headers.Get("connection"))
+
+	res, err = c.Do(addr, request.New("GET", "/none", nil))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, 204, res.StatusCode)
+}
+
+func TestFromHTTPHijack(t *testing.T) {
+	addr := start(t, FromHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		line, _ := brw.ReadString('\n')
+		_, _ = fmt.Fprintf(brw, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\necho %s", line)
+		_ = brw.Flush()
+	})))
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\nping\n")
+	require.NoError(t, err)
+
+	res, err := response.ResponseFromReader(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "echo ping\n", string(res.Body))
+}
+
+func TestToHTTP(t *testing.T) {
+	ts := httptest.NewServer(ToHTTP(func(w *response.Writer, r *request.Request) {
+		body, err := io.ReadAll(r.BodyReader())
+		require.NoError(t, err)
+		_ = w.WriteStatusLine(response.StatusCode(202))
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Length")
+		h.Set("X-Target", r.RequestLine.Target)
+		h.Set("X-Host", r.Headers.Get("host"))
+		h.Set("X-Token", r.Headers.Get("x-token"))
+		_ = w.WriteHeaders(h)
+		_ = w.WriteChunkedBody([]byte("got "))
+		_ = w.WriteChunkedBody(body)
+		_ = w.WriteChunkedBodyDone()
+		_ = w.WriteTrailer(headers.Headers{"X-Length": fmt.Sprint(len(body))})
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("PUT", ts.URL+"/things?id=3", strings.NewReader("a body"))
+	require.NoError(t, err)
+	req.Header.Set("X-Token", "abc")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, 202, res.StatusCode)
+	assert.Equal(t, "/things?id=3", res.Header.Get("X-Target"))
+	assert.Equal(t, strings.TrimPrefix(ts.URL, "http://"), res.Header.Get("X-Host"))
+	assert.Equal(t, "abc", res.Header.Get("X-Token"))
+	assert.Equal(t, "got a body", string(body))
+	assert.Equal(t, "6", res.Trailer.Get("X-Length"))
+	assert.False(t, res.Close)
+}
+
+func TestToHTTPFlush(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(ToHTTP(func(w *response.Writer, r *request.Request) {
+		_ = w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "10")
+		_ = w.WriteHeaders(h)
+		_, _ = w.Write([]byte("early"))
+		_ = w.Flush()
+		<-release
+		_, _ = w.Write([]byte(" late"))
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	assert.Equal(t, int64(10), res.ContentLength)
+
+	first := make([]byte, 5)
+	_, err = io.ReadFull(res.Body, first)
+	require.NoError(t, err)
+	assert.Equal(t, "early", string(first))
+	close(release)
+	rest, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, " late", string(rest))
+}
+
+func TestToHTTPRequestTrailers(t *testing.T) {
+	trailers := make(chan headers.Headers, 1)
+	ts := httptest.NewServer(ToHTTP(func(w *response.Writer, r *request.Request) {
+		_, _ = io.Copy(io.Discard, r.BodyReader())
+		trailers <- r.Trailers
+		server.WriteError(w, &server.HandlerError{Code: 200, Message: "OK"}, "")
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("POST", ts.URL, io.NopCloser(strings.NewReader("streamed")))
+	require.NoError(t, err)
+	req.Trailer = http.Header{"X-Sum": {"42"}}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	assert.Equal(t, "42", (<-trailers).Get("x-sum"))
+}
+
+// differential runs the same net/http handler under net/http and under
+// this server, returning both responses.
+func differential(t *testing.T, h http.Handler, method, target string, body string) (std, ours *http.Response) {
+	t.Helper()
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	addr := start(t, FromHTTP(h))
+
+	do := func(base string) *http.Response {
+		req, err := http.NewRequest(method, base+target, strings.NewReader(body))
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	return do(ts.URL), do("http://" + addr)
+}
+
+func TestContextPropagated(t *testing.T) {
+	// the server puts the request ID on the context net/http handlers get
+	addr := start(t, FromHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, requestid.FromContext(r.Context()))
+	})))
+	res, err := client.Do(addr, request.New("GET", "/", nil))
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.NotEmpty(t, body)
+	assert.Equal(t, res.Headers.Get("x-request-id"), string(body))
+
+	// and the context of an *http.Request reaches the handler
+	h := ToHTTP(func(w *response.Writer, r *request.Request) {
+		id := requestid.FromContext(r.Context())
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(len(id)))
+		_, _ = w.WriteBody([]byte(id))
+	})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	h.ServeHTTP(rec, req.WithContext(requestid.NewContext(req.Context(), "from-net-http")))
+	assert.Equal(t, "from-net-http", rec.Body.String())
+}
+
+func TestDifferential(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /hello/{name}", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "hello %s", r.PathValue("name"))
+	})
+	mux.HandleFunc("POST /echo", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = io.Copy(w, r.Body)
+	})
+	mux.HandleFunc("GET /html", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "<!DOCTYPE html><p>hi</p>")
+	})
+	mux.HandleFunc("GET /moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/hello/there", http.StatusFound)
+	})
+	mux.Handle("GET /static/", http.StripPrefix("/static", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader("static content"))
+	})))
+
+	cases := []struct {
+		name, method, target, body string
+	}{
+		{"path value", "GET", "/hello/world", ""},
+		{"echo", "POST", "/echo", "echoed back"},
+		{"sniffed", "GET", "/html", ""},
+		{"redirect", "GET", "/moved", ""},
+		{"not found", "GET", "/missing", ""},
+		{"wrong method", "DELETE", "/echo", ""},
+		{"serve content", "GET", "/static/file.txt", ""},
+		{"head", "HEAD", "/static/file.txt", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			std, ours := differential(t, mux, c.method, c.target, c.body)
+			defer func() { _ = std.Body.Close() }()
+			defer func() { _ = ours.Body.Close() }()
+			stdBody, err := io.ReadAll(std.Body)
+			require.NoError(t, err)
+			ourBody, err := io.ReadAll(ours.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, std.StatusCode, ours.StatusCode)
+			assert.Equal(t, string(stdBody), string(ourBody))
+			for _, k := range []string{"Content-Type", "Location", "Allow", "Accept-Ranges"} {
+				assert.Equal(t, std.Header.Get(k), ours.Header.Get(k), k)
+			}
+		})
+	}
+}
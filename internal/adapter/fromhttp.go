@@ -0,0 +1,305 @@
+// Package adapter - to run net/http handlers on this server and server
+// handlers under net/http
+package adapter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// FromHTTP makes h a server.Handler, so routers and middleware written for
+// net/http can be served with server.Serve. The response writer h is given
+// supports http.Flusher and http.Hijacker. A response without a
+// Content-Length is sent chunked, as net/http does for long bodies.
+// Header values h sets more than once are joined with commas, the way this
+// server stores them, so several Set-Cookie headers don't survive.
+func FromHTTP(h http.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		req, err := httpRequest(r)
+		if err != nil {
+			w.Logger.Info("invalid request target", "err", err)
+			server.WriteError(w, &server.HandlerError{
+				Code:    400,
+				Message: "Bad Request",
+			}, "Could not parse the request target")
+			return
+		}
+		rw := &responseWriter{w: w, header: http.Header{}}
+		h.ServeHTTP(rw, req)
+		if err := rw.finish(); err != nil {
+			w.Logger.Warn("error finishing response", "err", err)
+		}
+	}
+}
+
+// httpRequest makes the *http.Request net/http would have read for r.
+func httpRequest(r *request.Request) (*http.Request, error) {
+	target := r.RequestLine.Target
+	var u *url.URL
+	if r.RequestLine.Method == "CONNECT" && !strings.HasPrefix(target, "/") {
+		u = &url.URL{Host: target}
+	} else {
+		var err error
+		if u, err = url.ParseRequestURI(target); err != nil {
+			return nil, err
+		}
+	}
+	proto := "HTTP/" + r.RequestLine.HTTPVersion
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		return nil, fmt.Errorf("invalid version %s", proto)
+	}
+
+	header := make(http.Header, len(r.Headers))
+	for k, v := range r.Headers {
+		header[http.CanonicalHeaderKey(k)] = []string{v}
+	}
+	// the context carries what the server and middleware put on it,
+	// e.g. the request ID and trace span
+	req := (&http.Request{
+		Method:     r.RequestLine.Method,
+		URL:        u,
+		Proto:      proto,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Header:     header,
+		Host:       u.Host,
+		RemoteAddr: r.RemoteAddr,
+		RequestURI: target,
+		Close:      !r.KeepAlive(),
+		Body:       http.NoBody,
+	}).WithContext(r.Context())
+	// like net/http, the Host header is only kept in Host
+	if req.Host == "" {
+		req.Host = header.Get("Host")
+	}
+	header.Del("Host")
+
+	switch {
+	case r.Headers.HasToken("transfer-encoding", "chunked"):
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		header.Del("Transfer-Encoding")
+		for _, name := range strings.Split(header.Get("Trailer"), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if req.Trailer == nil {
+					req.Trailer = http.Header{}
+				}
+				req.Trailer[http.CanonicalHeaderKey(name)] = nil
+			}
+		}
+		header.Del("Trailer")
+	case header.Get("Content-Length") != "":
+		n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content length: %s", header.Get("Content-Length"))
+		}
+		req.ContentLength = n
+	}
+	if req.ContentLength != 0 {
+		req.Body = &requestBody{src: r.BodyReader(), r: r, req: req}
+	}
+	return req, nil
+}
+
+// requestBody reads the body of a request, filling in the trailers of the
+// *http.Request once it has all been read.
+type requestBody struct {
+	src io.Reader
+	r   *request.Request
+	req *http.Request
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.src.Read(p)
+	if errors.Is(err, io.EOF) && len(b.r.Trailers) > 0 {
+		if b.req.Trailer == nil {
+			b.req.Trailer = http.Header{}
+		}
+		for k, v := range b.r.Trailers {
+			b.req.Trailer[http.CanonicalHeaderKey(k)] = []string{v}
+		}
+	}
+	return n, err
+}
+
+func (b *requestBody) Close() error {
+	return nil
+}
+
+// responseWriter is the http.ResponseWriter a net/http handler writes to.
+// Like net/http it holds the head back until the first write, so the
+// Content-Type can be sniffed from the body and an empty response can be
+// given a Content-Length.
+type responseWriter struct {
+	w      *response.Writer
+	header http.Header
+	// status and sent are the status code and headers passed to
+	// WriteHeader, later changes to the header map only add trailers
+	status int
+	sent   http.Header
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if rw.status != 0 {
+		rw.w.Logger.Warn("superfluous WriteHeader call", "code", code)
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		if err := rw.writeInterim(code); err != nil {
+			rw.w.Logger.Warn("error writing interim response", "code", code, "err", err)
+		}
+		return
+	}
+	rw.status = code
+	rw.sent = rw.header.Clone()
+}
+
+// writeInterim sends a 1xx response, e.g. 103 Early Hints, ahead of the
+// final one. HTTP/1.0 clients don't understand them.
+func (rw *responseWriter) writeInterim(code int) error {
+	if rw.w.HTTPVersion == "1.0" || rw.w.State != response.WritingStatusLine {
+		return nil
+	}
+	head := fmt.Appendf(nil, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	for k, vs := range rw.header {
+		for _, v := range vs {
+			head = fmt.Appendf(head, "%s: %s\r\n", k, v)
+		}
+	}
+	if _, err := rw.w.Write(append(head, "\r\n"...)); err != nil {
+		return err
+	}
+	return rw.w.Flush()
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.w.State == response.WritingStatusLine {
+		if err := rw.writeHead(b, false); err != nil {
+			return 0, err
+		}
+	}
+	if !bodyAllowed(rw.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	return rw.w.Write(b)
+}
+
+// writeHead writes the status line and headers. first is the start of
+// the body, done says the handler has returned and there is no more.
+func (rw *responseWriter) writeHead(first []byte, done bool) error {
+	h := headers.NewHeaders()
+	for k, vs := range rw.sent {
+		if !strings.HasPrefix(k, http.TrailerPrefix) {
+			h.Set(k, strings.Join(vs, ", "))
+		}
+	}
+	bodyless := !bodyAllowed(rw.status) || rw.w.SuppressBody
+	if !bodyless && len(first) > 0 && h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(first))
+	}
+	if !bodyless && h.Get("Content-Length") == "" {
+		if done {
+			h.Set("Content-Length", "0")
+		} else {
+			h.Set("Transfer-Encoding", "chunked")
+		}
+	}
+	if err := rw.w.WriteStatusLine(response.StatusCode(rw.status)); err != nil {
+		return err
+	}
+	return rw.w.WriteHeaders(h)
+}
+
+// Flush implements http.Flusher.
+func (rw *responseWriter) Flush() {
+	if err := rw.FlushError(); err != nil {
+		rw.w.Logger.Warn("error flushing response", "err", err)
+	}
+}
+
+// FlushError is the Flush http.ResponseController uses, which reports
+// errors.
+func (rw *responseWriter) FlushError() error {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.w.State == response.WritingStatusLine {
+		if err := rw.writeHead(nil, false); err != nil {
+			return err
+		}
+	}
+	return rw.w.Flush()
+}
+
+// Hijack implements http.Hijacker.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, br, err := rw.w.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, bufio.NewReadWriter(br, bufio.NewWriter(conn)), nil
+}
+
+// finish ends the response once the handler has returned, with the
+// trailers it set.
+func (rw *responseWriter) finish() error {
+	if rw.w.Hijacked() {
+		return nil
+	}
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.w.State == response.WritingStatusLine {
+		return rw.writeHead(nil, true)
+	}
+	if rw.w.State != response.WritingBody {
+		return nil
+	}
+	if err := rw.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	return rw.w.WriteTrailer(rw.trailers())
+}
+
+// trailers collects the trailers declared in the Trailer header before
+// WriteHeader, and those set afterwards with http.TrailerPrefix.
+func (rw *responseWriter) trailers() headers.Headers {
+	t := headers.NewHeaders()
+	for _, name := range strings.Split(rw.sent.Get("Trailer"), ",") {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if vs := rw.header[name]; name != "" && len(vs) > 0 {
+			t.Set(name, strings.Join(vs, ", "))
+		}
+	}
+	for k, vs := range rw.header {
+		if name, ok := strings.CutPrefix(k, http.TrailerPrefix); ok && len(vs) > 0 {
+			t.Set(name, strings.Join(vs, ", "))
+		}
+	}
+	return t
+}
+
+// bodyAllowed reports whether a response with status may have a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
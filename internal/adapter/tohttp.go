@@ -0,0 +1,193 @@
+package adapter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// relayBufferSize is the size of the buffer response bodies are copied
+// through on their way to net/http
+const relayBufferSize = 32 * 1024
+
+// ToHTTP makes h an http.Handler, so it can run under net/http, e.g. with
+// httptest.NewServer. What h writes to its response.Writer is parsed as it
+// is written and replayed on the http.ResponseWriter, streaming the body
+// and passing on flushes. net/http decides whether the connection stays
+// open, so the Connection header h sets is dropped.
+func ToHTTP(h server.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		pr, pw := io.Pipe()
+		w := response.NewWriter(&pipeWriter{pw}, &headers.Headers{})
+		// the response is always framed between h and the relay,
+		// net/http frames it again for the client
+		w.HTTPVersion = "1.1"
+		w.KeepAlive = true
+		w.SuppressBody = req.Method == "HEAD"
+		w.FlushChunks = true
+		w.Hijacker = func() (net.Conn, *bufio.Reader, error) {
+			conn, brw, err := http.NewResponseController(rw).Hijack()
+			if err != nil {
+				return nil, nil, err
+			}
+			return conn, brw.Reader, nil
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := relay(rw, req.Method, &flushReader{r: pr, rw: rw}); err != nil {
+				w.Logger.Warn("error relaying response", "err", err)
+			}
+			// a handler still writing gets an error instead of blocking
+			_ = pr.Close()
+		}()
+		defer func() {
+			// a handler that panicked leaves the response cut short
+			_ = pw.CloseWithError(io.ErrUnexpectedEOF)
+			<-done
+		}()
+
+		h(w, serverRequest(req))
+		if err := w.Finish(); err != nil {
+			w.Logger.Warn("error finishing response", "err", err)
+		}
+		_ = pw.Close()
+	})
+}
+
+// serverRequest makes the request.Request the server would have read
+// for req.
+func serverRequest(req *http.Request) *request.Request {
+	target := req.RequestURI
+	if target == "" {
+		target = req.URL.RequestURI()
+	}
+	var body io.Reader = http.NoBody
+	if req.Body != nil {
+		body = req.Body
+	}
+	trailers := headers.NewHeaders()
+	r := request.New(req.Method, target, &trailerBody{src: body, req: req, trailers: trailers})
+	r.Trailers = trailers
+	r.RequestLine.HTTPVersion = fmt.Sprintf("%d.%d", req.ProtoMajor, req.ProtoMinor)
+	r.RemoteAddr = req.RemoteAddr
+	r.SetContext(req.Context())
+	for k, vs := range req.Header {
+		r.Headers.Set(strings.ToLower(k), strings.Join(vs, ", "))
+	}
+	if req.Host != "" {
+		r.Headers.Set("host", req.Host)
+	}
+	switch {
+	case req.ContentLength > 0:
+		r.Headers.Set("content-length", strconv.FormatInt(req.ContentLength, 10))
+	case req.ContentLength == -1 && len(req.TransferEncoding) > 0:
+		r.Headers.Set("transfer-encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+	return r
+}
+
+// trailerBody reads the body of an *http.Request, filling in the trailers
+// of the request.Request once it has all been read.
+type trailerBody struct {
+	src      io.Reader
+	req      *http.Request
+	trailers headers.Headers
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.src.Read(p)
+	if errors.Is(err, io.EOF) {
+		for k, vs := range b.req.Trailer {
+			if len(vs) > 0 {
+				b.trailers.Set(strings.ToLower(k), strings.Join(vs, ", "))
+			}
+		}
+	}
+	return n, err
+}
+
+// pipeWriter is the destination of the response.Writer. A flush is passed
+// through the pipe as an empty write, which the relay answers by flushing
+// the http.ResponseWriter.
+type pipeWriter struct {
+	*io.PipeWriter
+}
+
+func (p *pipeWriter) Flush() error {
+	_, err := p.Write(nil)
+	return err
+}
+
+// flushReader flushes the http.ResponseWriter when it reads one of the
+// empty writes pipeWriter.Flush sends. Everything written before it has
+// been relayed by then.
+type flushReader struct {
+	r  io.Reader
+	rw http.ResponseWriter
+}
+
+func (f *flushReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n == 0 && err == nil {
+		if ferr := http.NewResponseController(f.rw).Flush(); ferr != nil && !errors.Is(ferr, http.ErrNotSupported) {
+			return 0, ferr
+		}
+	}
+	return n, err
+}
+
+// relay parses the response read from src and writes it to rw.
+func relay(rw http.ResponseWriter, method string, src io.Reader) error {
+	res, err := response.NewReader(src).ReadResponseHead(method)
+	// nothing was written, or the connection was hijacked
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for k, v := range res.Headers {
+		switch http.CanonicalHeaderKey(k) {
+		case "Connection", "Keep-Alive", "Transfer-Encoding":
+		default:
+			rw.Header().Set(k, v)
+		}
+	}
+	rw.WriteHeader(int(res.StatusLine.StatusCode))
+
+	body := res.BodyReader()
+	buf := make([]byte, relayBufferSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := rw.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for k, v := range res.Trailers {
+		if !res.Headers.HasToken("Trailer", k) {
+			k = http.TrailerPrefix + k
+		}
+		rw.Header().Set(k, v)
+	}
+	return nil
+}
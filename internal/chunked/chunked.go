@@ -0,0 +1,204 @@
+// Package chunked - to decode bodies sent with the chunked transfer coding
+package chunked
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+)
+
+const CRLF = "\r\n"
+
+// maxSizeLineLength bounds how much of a chunk size line, including any
+// chunk extensions, is buffered while waiting for its CRLF.
+const maxSizeLineLength = 4096
+
+type DecoderState int
+
+const (
+	ReadingSize DecoderState = iota
+	ReadingData
+	ReadingDataEnd
+	ReadingTrailers
+	Done
+)
+
+type Decoder struct {
+	State    DecoderState
+	Trailers headers.Headers
+	// remaining is the number of bytes left in the current chunk
+	remaining int64
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{
+		State:    ReadingSize,
+		Trailers: headers.NewHeaders(),
+	}
+}
+
+// Parse decodes a single step of a chunked body from data. It returns the
+// number of bytes consumed and, when a chunk's data was read, that data as
+// a slice of data. A return of 0 consumed bytes means more input is needed.
+func (d *Decoder) Parse(data []byte) (n int, chunk []byte, err error) {
+	switch d.State {
+	case ReadingSize:
+		lineEnd := bytes.Index(data, []byte(CRLF))
+		if lineEnd == -1 {
+			if len(data) > maxSizeLineLength {
+				return 0, nil, errors.New("chunk size line too long")
+			}
+			return 0, nil, nil
+		}
+		size, err := parseSize(data[:lineEnd])
+		if err != nil {
+			return 0, nil, err
+		}
+		d.remaining = size
+		if size == 0 {
+			d.State = ReadingTrailers
+		} else {
+			d.State = ReadingData
+		}
+		return lineEnd + 2, nil, nil
+	case ReadingData:
+		if len(data) == 0 {
+			return 0, nil, nil
+		}
+		n := int(min(int64(len(data)), d.remaining))
+		d.remaining -= int64(n)
+		if d.remaining == 0 {
+			d.State = ReadingDataEnd
+		}
+		return n, data[:n], nil
+	case ReadingDataEnd:
+		if len(data) < 2 {
+			return 0, nil, nil
+		}
+		if !bytes.HasPrefix(data, []byte(CRLF)) {
+			return 0, nil, errors.New("missing CRLF after chunk data")
+		}
+		d.State = ReadingSize
+		return 2, nil, nil
+	case ReadingTrailers:
+		n, done, err := d.Trailers.Parse(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		if done {
+			d.State = Done
+		}
+		return n, nil, nil
+	case Done:
+		return 0, nil, errors.New("parse function called in Done state")
+	default:
+		return 0, nil, errors.New("unknown state")
+	}
+}
+
+// parseSize reads the hex chunk size from a size line. Chunk extensions
+// after a semicolon are checked but otherwise ignored.
+func parseSize(line []byte) (int64, error) {
+	if i := bytes.IndexByte(line, ';'); i != -1 {
+		if !validExtensions(line[i:]) {
+			return 0, fmt.Errorf("invalid chunk extension: %q", line[i:])
+		}
+		line = line[:i]
+	}
+	line = bytes.TrimRight(line, " \t")
+	// at most 15 hex digits so the size always fits in an int64
+	if len(line) == 0 || len(line) > 15 {
+		return 0, fmt.Errorf("invalid chunk size: %q", line)
+	}
+	for _, c := range line {
+		if !isHexDigit(c) {
+			return 0, fmt.Errorf("invalid chunk size: %q", line)
+		}
+	}
+	return strconv.ParseInt(string(line), 16, 64)
+}
+
+// validExtensions reports whether ext is a list of chunk extensions, each
+// a ";" and a token name with an optional token or quoted-string value
+// (RFC 9112 section 7.1.1). Control characters, a bare CR or LF among
+// them, are never allowed: a peer that stops the line at one of them would
+// frame the body differently.
+func validExtensions(ext []byte) bool {
+	for len(ext) > 0 {
+		if ext[0] != ';' {
+			return false
+		}
+		ext = trimBWS(ext[1:])
+		var name []byte
+		name, ext = cutToken(ext)
+		if len(name) == 0 {
+			return false
+		}
+		ext = trimBWS(ext)
+		if len(ext) == 0 || ext[0] != '=' {
+			continue
+		}
+		ext = trimBWS(ext[1:])
+		var ok bool
+		if len(ext) > 0 && ext[0] == '"' {
+			ext, ok = cutQuoted(ext)
+		} else {
+			name, ext = cutToken(ext)
+			ok = len(name) > 0
+		}
+		if !ok {
+			return false
+		}
+		ext = trimBWS(ext)
+	}
+	return true
+}
+
+func trimBWS(b []byte) []byte {
+	return bytes.TrimLeft(b, " \t")
+}
+
+// cutToken splits b after the token it starts with.
+func cutToken(b []byte) (token, rest []byte) {
+	i := 0
+	for i < len(b) && isTokenChar(b[i]) {
+		i++
+	}
+	return b[:i], b[i:]
+}
+
+// cutQuoted returns what follows the quoted-string b starts with.
+func cutQuoted(b []byte) ([]byte, bool) {
+	for i := 1; i < len(b); i++ {
+		switch c := b[i]; {
+		case c == '"':
+			return b[i+1:], true
+		case c == '\\':
+			i++
+			if i == len(b) || !isQuotedChar(b[i]) {
+				return nil, false
+			}
+		case !isQuotedChar(c):
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func isTokenChar(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+		bytes.IndexByte([]byte("!#$%&'*+-.^_`|~"), c) != -1
+}
+
+// isQuotedChar reports whether c may appear in a quoted-string: a tab,
+// a space, a visible character or obs-text, but no other control.
+func isQuotedChar(c byte) bool {
+	return c == '\t' || (c >= ' ' && c != 0x7f)
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
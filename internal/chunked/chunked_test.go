@@ -0,0 +1,97 @@
+package chunked
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+)
+
+// decode feeds data to a decoder step by step, like the request parser does
+func decode(t *testing.T, data string) (*Decoder, string, error) {
+	t.Helper()
+	d := NewDecoder()
+	body := []byte{}
+	b := []byte(data)
+	for d.State != Done {
+		n, chunk, err := d.Parse(b)
+		if err != nil {
+			return d, "", err
+		}
+		if n == 0 {
+			break
+		}
+		body = append(body, chunk...)
+		b = b[n:]
+	}
+	return d, string(body), nil
+}
+
+func TestDecodeChunks(t *testing.T) {
+	d, body, err := decode(t, "5\r\nhello\r\n6;ext=1\r\n world\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, Done, d.State)
+	assert.Equal(t, "hello world", body)
+}
+
+func TestDecodeTrailers(t *testing.T) {
+	d, body, err := decode(t, "3\r\nabc\r\n0\r\nX-Checksum: 42\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, Done, d.State)
+	assert.Equal(t, "abc", body)
+	assert.Equal(t, "42", d.Trailers.Get("x-checksum"))
+}
+
+func TestDecodeIncomplete(t *testing.T) {
+	d, body, err := decode(t, "5\r\nhel")
+	require.NoError(t, err)
+	assert.Equal(t, ReadingData, d.State)
+	assert.Equal(t, "hel", body)
+}
+
+func TestDecodeInvalidSize(t *testing.T) {
+	_, _, err := decode(t, "+5\r\nhello\r\n0\r\n\r\n")
+	require.Error(t, err)
+	_, _, err = decode(t, "fffffffffffffffff\r\n")
+	require.Error(t, err)
+}
+
+func TestDecodeExtensions(t *testing.T) {
+	for _, ext := range []string{";a", "; a = b", `;a="quoted \" value";b`, ";a=1 ;b=\"\t\x80\""} {
+		_, body, err := decode(t, "3"+ext+"\r\nabc\r\n0\r\n\r\n")
+		require.NoError(t, err, ext)
+		assert.Equal(t, "abc", body)
+	}
+	for _, ext := range []string{";", ";a\nb", ";a\rb", ";a=\x01", ";a=\"\x00\"", ";a=\"open", ";a b", ";=b", ";a=b c"} {
+		_, _, err := decode(t, "3"+ext+"\r\nabc\r\n0\r\n\r\n")
+		assert.Error(t, err, "%q", ext)
+	}
+}
+
+func TestDecodeMissingCRLFAfterData(t *testing.T) {
+	_, _, err := decode(t, "3\r\nabcd\r\n0\r\n\r\n")
+	require.Error(t, err)
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	cw := NewWriter(buf)
+	_, err := cw.Write([]byte("hello "))
+	require.NoError(t, err)
+	n, err := cw.Write(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	_, err = cw.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, cw.End(headers.Headers{"X-Sum": "1"}))
+	assert.Equal(t, "6\r\nhello \r\n5\r\nworld\r\n0\r\nX-Sum: 1\r\n\r\n", buf.String())
+
+	d, body, err := decode(t, buf.String())
+	require.NoError(t, err)
+	assert.Equal(t, Done, d.State)
+	assert.Equal(t, "hello world", body)
+	assert.Equal(t, "1", d.Trailers.Get("x-sum"))
+}
@@ -0,0 +1,78 @@
+package chunked
+
+import (
+	"bytes"
+	"maps"
+	"testing"
+)
+
+// decodeAll runs a Decoder over data, returning the body and how many bytes
+// of data it used.
+func decodeAll(t *testing.T, d *Decoder, data []byte) ([]byte, int, error) {
+	var body []byte
+	used := 0
+	for d.State != Done {
+		n, chunk, err := d.Parse(data[used:])
+		if err != nil {
+			return nil, used, err
+		}
+		if n < 0 || n > len(data)-used || len(chunk) > n {
+			t.Fatalf("consumed %d of %d bytes for a %d byte chunk", n, len(data)-used, len(chunk))
+		}
+		if n == 0 {
+			break
+		}
+		body = append(body, chunk...)
+		used += n
+	}
+	return body, used, nil
+}
+
+func FuzzDecoder(f *testing.F) {
+	for _, seed := range []string{
+		"5\r\nhello\r\n0\r\n\r\n",
+		"4\r\nWiki\r\n5\r\npedia\r\nE\r\n in\r\n\r\nchunks.\r\n0\r\n\r\n",
+		"3;name=value;other\r\nabc\r\n0\r\nX-Sum: 1\r\n\r\n",
+		"5 \t;ext\r\nhello\r\n0\r\n\r\n",
+		"FFFFFFFFFFFFFFF\r\nabc",
+		"10000000000000000\r\nabc\r\n0\r\n\r\n",
+		"-1\r\nabc\r\n0\r\n\r\n",
+		"0x5\r\nhello\r\n0\r\n\r\n",
+		"5\r\nhello\n0\r\n\r\n",
+		"5\r\nhelloXX0\r\n\r\n",
+		"5\r\nhel\x00o\r\n0\r\n\r\n",
+		"0\r\nX: a\nY: b\r\n\r\n",
+		"3;a\nb\r\nabc\r\n0\r\n\r\n",
+		"3;a=\"x\\\"y\";b=\x01\r\nabc\r\n0\r\n\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d := NewDecoder()
+		body, used, err := decodeAll(t, d, data)
+		if err != nil || d.State != Done {
+			return
+		}
+		if len(body) > used {
+			t.Fatalf("decoded %d bytes from %d", len(body), used)
+		}
+
+		// encoding what was decoded gives back the same body and trailers
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.End(d.Trailers); err != nil {
+			t.Fatal(err)
+		}
+		again := NewDecoder()
+		got, _, err := decodeAll(t, again, buf.Bytes())
+		if err != nil {
+			t.Fatalf("decoding %q: %v", buf.Bytes(), err)
+		}
+		if !bytes.Equal(got, body) || !maps.Equal(again.Trailers, d.Trailers) {
+			t.Fatalf("round trip gave %q %v, want %q %v", got, again.Trailers, body, d.Trailers)
+		}
+	})
+}
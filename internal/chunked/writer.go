@@ -0,0 +1,47 @@
+package chunked
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+)
+
+// Writer encodes what is written to it as chunks of a chunked body.
+type Writer struct {
+	dst io.Writer
+}
+
+func NewWriter(dst io.Writer) *Writer {
+	return &Writer{dst: dst}
+}
+
+// Write sends b as a single chunk.
+func (cw *Writer) Write(b []byte) (int, error) {
+	// an empty chunk would end the body
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(cw.dst, "%X\r\n", len(b)); err != nil {
+		return 0, err
+	}
+	n, err := cw.dst.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if _, err := io.WriteString(cw.dst, CRLF); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// End writes the last chunk and the trailers, ending the body.
+func (cw *Writer) End(trailers headers.Headers) error {
+	head := []byte("0\r\n")
+	for k, v := range trailers {
+		head = fmt.Appendf(head, "%s: %s\r\n", k, v)
+	}
+	head = append(head, CRLF...)
+	_, err := cw.dst.Write(head)
+	return err
+}
@@ -0,0 +1,354 @@
+// Package client - to send requests to other HTTP/1.1 servers
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+)
+
+const (
+	DefaultIdleTimeout    = 90 * time.Second
+	DefaultMaxIdlePerHost = 8
+	DefaultDialTimeout    = 30 * time.Second
+	// DefaultResponseHeaderTimeout is how long a server has to start
+	// its response once the request is sent
+	DefaultResponseHeaderTimeout = 30 * time.Second
+)
+
+type Response struct {
+	HTTPVersion string
+	StatusCode  int
+	Reason      string
+	Headers     headers.Headers
+	// Trailers holds the trailer fields of a chunked body,
+	// they are filled in once Body has been read to the end
+	Trailers headers.Headers
+	// Body streams the body from the connection, it must be closed. The
+	// connection is reused for another request once the body has been
+	// read to the end.
+	Body io.ReadCloser
+}
+
+func newResponse(parsed *response.Response) *Response {
+	return &Response{
+		HTTPVersion: parsed.StatusLine.HTTPVersion,
+		StatusCode:  int(parsed.StatusLine.StatusCode),
+		Reason:      parsed.StatusLine.Reason,
+		Headers:     parsed.Headers,
+		Trailers:    parsed.Trailers,
+	}
+}
+
+// Client sends requests over kept-alive connections, pooled by the
+// address they go to.
+type Client struct {
+	// IdleTimeout is how long a connection is kept for reuse
+	// after its last response
+	IdleTimeout time.Duration
+	// MaxIdlePerHost caps how many unused connections are kept
+	// to each address
+	MaxIdlePerHost int
+	DialTimeout    time.Duration
+	// ResponseHeaderTimeout caps the wait for the head of a response
+	// after the request is written, so a stalled server can't hold the
+	// caller for ever. Zero waits as long as it takes.
+	ResponseHeaderTimeout time.Duration
+	// TLSConfig, when set, makes every connection the client opens a TLS
+	// one, e.g. for an https upstream
+	TLSConfig *tls.Config
+	// Logger is where connection errors are logged, slog.Default() if nil
+	Logger *slog.Logger
+
+	mu   sync.Mutex
+	idle map[string][]*conn
+}
+
+// conn is a connection to an upstream with the reader its responses are
+// parsed from.
+type conn struct {
+	net.Conn
+	addr string
+	rd   *response.Reader
+	// evict closes the connection once it has been idle too long
+	evict *time.Timer
+}
+
+func New() *Client {
+	return &Client{
+		IdleTimeout:           DefaultIdleTimeout,
+		MaxIdlePerHost:        DefaultMaxIdlePerHost,
+		DialTimeout:           DefaultDialTimeout,
+		ResponseHeaderTimeout: DefaultResponseHeaderTimeout,
+		Logger:                slog.Default(),
+		idle:                  map[string][]*conn{},
+	}
+}
+
+// NewTLS makes a Client that talks TLS with cfg, or with servers verified
+// against the system's roots if cfg is nil.
+func NewTLS(cfg *tls.Config) *Client {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	c := New()
+	c.TLSConfig = cfg
+	return c
+}
+
+// DefaultClient is the Client used by Do.
+var DefaultClient = New()
+
+// Do sends req with the DefaultClient.
+func Do(addr string, req *request.Request) (*Response, error) {
+	return DefaultClient.Do(addr, req)
+}
+
+// Do sends req to the server at addr, a host:port, and reads the head of
+// the response. The body is left on the connection to be read from Body.
+// A kept-alive connection the server closed while it sat idle is replaced
+// with a new one, if the request can be sent again.
+func (c *Client) Do(addr string, req *request.Request) (*Response, error) {
+	if req.Headers.Get("host") == "" {
+		req.Headers.Set("host", addr)
+	}
+	replayable := emptyBody(req)
+	for {
+		pc, reused, err := c.getConn(addr)
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.roundTrip(pc, req)
+		if err == nil {
+			return res, nil
+		}
+		c.closeConn(pc)
+		if reused && replayable && stale(err) {
+			continue
+		}
+		return nil, err
+	}
+}
+
+func (c *Client) roundTrip(pc *conn, req *request.Request) (*Response, error) {
+	if err := req.Write(pc); err != nil {
+		return nil, err
+	}
+	if c.ResponseHeaderTimeout > 0 {
+		if err := pc.SetReadDeadline(time.Now().Add(c.ResponseHeaderTimeout)); err != nil {
+			return nil, err
+		}
+	}
+	parsed, err := pc.rd.ReadResponseHead(req.RequestLine.Method)
+	if err != nil {
+		return nil, err
+	}
+	// the body may take as long as it takes
+	if c.ResponseHeaderTimeout > 0 {
+		if err := pc.SetReadDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+	res := newResponse(parsed)
+	res.Body = &bodyReader{
+		r:        parsed.BodyReader(),
+		parsed:   parsed,
+		client:   c,
+		pc:       pc,
+		reusable: parsed.KeepAlive() && !req.Headers.HasToken("connection", "close"),
+	}
+	return res, nil
+}
+
+// emptyBody reports whether req has no body, so it can be sent again
+// without having to keep a copy of it.
+func emptyBody(req *request.Request) bool {
+	if req.Headers.HasToken("transfer-encoding", "chunked") {
+		return false
+	}
+	l, ok := req.BodyReader().(interface{ Len() int })
+	return ok && l.Len() == 0
+}
+
+// stale reports whether err is how a kept-alive connection the server
+// already closed fails, before any of the response arrived.
+func stale(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// getConn returns an idle connection to addr, or dials a new one.
+func (c *Client) getConn(addr string) (*conn, bool, error) {
+	c.mu.Lock()
+	for len(c.idle[addr]) > 0 {
+		conns := c.idle[addr]
+		pc := conns[len(conns)-1]
+		c.idle[addr] = conns[:len(conns)-1]
+		// a connection whose eviction already fired is being closed
+		if pc.evict.Stop() {
+			c.mu.Unlock()
+			return pc, true, nil
+		}
+	}
+	c.mu.Unlock()
+
+	nc, err := c.dial(addr)
+	if err != nil {
+		return nil, false, err
+	}
+	return &conn{Conn: nc, addr: addr, rd: response.NewReader(nc)}, false, nil
+}
+
+// dial connects to addr, over TLS if the client has a TLSConfig. The
+// handshake counts towards the DialTimeout.
+func (c *Client) dial(addr string) (net.Conn, error) {
+	if c.TLSConfig == nil {
+		return net.DialTimeout("tcp", addr, c.DialTimeout)
+	}
+	cfg := c.TLSConfig
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: c.DialTimeout}, "tcp", addr, cfg)
+}
+
+// putConn keeps pc for the next request to its address, or closes it if
+// there are enough idle connections already.
+func (c *Client) putConn(pc *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle == nil {
+		c.idle = map[string][]*conn{}
+	}
+	// bytes past the end of the response mean the server and client
+	// disagree on where it ended
+	if c.MaxIdlePerHost <= 0 || len(c.idle[pc.addr]) >= c.MaxIdlePerHost || pc.rd.Buffered() > 0 {
+		c.closeConn(pc)
+		return
+	}
+	c.idle[pc.addr] = append(c.idle[pc.addr], pc)
+	pc.evict = time.AfterFunc(c.IdleTimeout, func() {
+		c.removeIdle(pc)
+	})
+}
+
+func (c *Client) removeIdle(pc *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := c.idle[pc.addr]
+	for i, idle := range conns {
+		if idle == pc {
+			c.idle[pc.addr] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(c.idle[pc.addr]) == 0 {
+		delete(c.idle, pc.addr)
+	}
+	c.closeConn(pc)
+}
+
+// CloseIdleConnections closes every connection kept for reuse.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, conns := range c.idle {
+		for _, pc := range conns {
+			if pc.evict.Stop() {
+				c.closeConn(pc)
+			}
+		}
+		delete(c.idle, addr)
+	}
+}
+
+// idleCount is the number of connections kept for reuse to addr.
+func (c *Client) idleCount(addr string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.idle[addr])
+}
+
+// bodyReader hands the connection back to the client
+// once the body has been read to the end.
+type bodyReader struct {
+	r        io.Reader
+	parsed   *response.Response
+	client   *Client
+	pc       *conn
+	reusable bool
+
+	mu   sync.Mutex
+	done bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.release(b.reusable)
+	} else if err != nil {
+		b.release(false)
+	}
+	return n, err
+}
+
+// Close gives up on the rest of the body. The connection is only kept if
+// there was nothing left of it.
+func (b *bodyReader) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.done {
+		b.release(b.reusable && b.drained())
+	}
+	return nil
+}
+
+func (b *bodyReader) release(reuse bool) {
+	b.done = true
+	if reuse {
+		b.client.putConn(b.pc)
+		return
+	}
+	b.client.closeConn(b.pc)
+}
+
+// drained reports whether there is nothing left of the body to read,
+// without blocking on the connection.
+func (b *bodyReader) drained() bool {
+	if r, ok := b.r.(*bytes.Reader); ok {
+		return r.Len() == 0
+	}
+	return b.parsed.State == response.ParsingDone && len(b.parsed.Body) == 0
+}
+
+func (c *Client) closeConn(conn net.Conn) {
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		c.logger().Warn("error closing connection", "err", err)
+	}
+}
+
+func (c *Client) logger() *slog.Logger {
+	if c.Logger == nil {
+		return slog.Default()
+	}
+	return c.Logger
+}
@@ -0,0 +1,237 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// cannedServer answers a single request with raw, then closes the connection
+func cannedServer(t *testing.T, raw string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		_, _ = io.WriteString(conn, raw)
+	}()
+	return l.Addr().String()
+}
+
+func get(t *testing.T, addr, method string) (*Response, string) {
+	t.Helper()
+	res, err := Do(addr, request.New(method, "/", nil))
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func TestContentLengthBody(t *testing.T) {
+	addr := cannedServer(t, "HTTP/1.1 201 Created\r\nContent-Length: 5\r\nX-Test: yes\r\n\r\nhello")
+	res, body := get(t, addr, "GET")
+	assert.Equal(t, "1.1", res.HTTPVersion)
+	assert.Equal(t, 201, res.StatusCode)
+	assert.Equal(t, "Created", res.Reason)
+	assert.Equal(t, "yes", res.Headers.Get("X-Test"))
+	assert.Equal(t, "hello", body)
+}
+
+func TestChunkedBodyWithTrailers(t *testing.T) {
+	addr := cannedServer(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"6\r\nhello \r\n5\r\nworld\r\n0\r\nX-Sum: 11\r\n\r\n")
+	res, body := get(t, addr, "GET")
+	assert.Equal(t, "hello world", body)
+	assert.Equal(t, "11", res.Trailers.Get("x-sum"))
+}
+
+func TestCloseDelimitedBody(t *testing.T) {
+	addr := cannedServer(t, "HTTP/1.0 200 OK\r\n\r\nuntil the end")
+	res, body := get(t, addr, "GET")
+	assert.Equal(t, "1.0", res.HTTPVersion)
+	assert.Equal(t, "until the end", body)
+}
+
+func TestInterimResponsesSkipped(t *testing.T) {
+	addr := cannedServer(t, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	res, body := get(t, addr, "GET")
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "", res.Headers.Get("link"))
+	assert.Equal(t, "ok", body)
+}
+
+func TestHeadResponseHasNoBody(t *testing.T) {
+	addr := cannedServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n")
+	res, body := get(t, addr, "HEAD")
+	assert.Equal(t, "100", res.Headers.Get("content-length"))
+	assert.Equal(t, "", body)
+}
+
+func TestTruncatedBody(t *testing.T) {
+	addr := cannedServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort")
+	res, err := Do(addr, request.New("GET", "/", nil))
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	_, err = io.ReadAll(res.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestInvalidStatusLine(t *testing.T) {
+	addr := cannedServer(t, "HTTP/2 200 OK\r\n\r\n")
+	_, err := Do(addr, request.New("GET", "/", nil))
+	require.Error(t, err)
+}
+
+// startServer runs a server that answers every request with the client's
+// address, so tests can tell which connection a request came in on
+func startServer(t *testing.T, opts ...server.Option) string {
+	t.Helper()
+	s, err := server.Serve(0, func(w *response.Writer, r *request.Request) {
+		_ = w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Content-Length", strconv.Itoa(len(r.RemoteAddr)))
+		if r.Headers.Get("x-close") != "" {
+			h.Set("Connection", "close")
+		}
+		_ = w.WriteHeaders(h)
+		_, _ = w.WriteBody([]byte(r.RemoteAddr))
+	}, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s.Listener.Addr().String()
+}
+
+func fetch(t *testing.T, c *Client, addr string, req *request.Request) string {
+	t.Helper()
+	res, err := c.Do(addr, req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	return string(body)
+}
+
+func TestReusesConnections(t *testing.T) {
+	addr := startServer(t)
+	c := New()
+	first := fetch(t, c, addr, request.New("GET", "/", nil))
+	assert.Equal(t, 1, c.idleCount(addr))
+	second := fetch(t, c, addr, request.New("POST", "/", strings.NewReader("body")))
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, c.idleCount(addr))
+
+	c.CloseIdleConnections()
+	assert.Equal(t, 0, c.idleCount(addr))
+	assert.NotEqual(t, first, fetch(t, c, addr, request.New("GET", "/", nil)))
+}
+
+func TestConnectionCloseNotReused(t *testing.T) {
+	addr := startServer(t)
+	c := New()
+	req := request.New("GET", "/", nil)
+	req.Headers.Set("x-close", "1")
+	fetch(t, c, addr, req)
+	assert.Equal(t, 0, c.idleCount(addr))
+
+	req = request.New("GET", "/", nil)
+	req.Headers.Set("connection", "close")
+	fetch(t, c, addr, req)
+	assert.Equal(t, 0, c.idleCount(addr))
+}
+
+func TestUnreadBodyNotReused(t *testing.T) {
+	addr := startServer(t)
+	c := New()
+	res, err := c.Do(addr, request.New("GET", "/", nil))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, 0, c.idleCount(addr))
+}
+
+func TestIdleEviction(t *testing.T) {
+	addr := startServer(t)
+	c := New()
+	c.IdleTimeout = 20 * time.Millisecond
+	fetch(t, c, addr, request.New("GET", "/", nil))
+	assert.Equal(t, 1, c.idleCount(addr))
+	assert.Eventually(t, func() bool { return c.idleCount(addr) == 0 }, time.Second, 5*time.Millisecond)
+}
+
+func TestStaleConnectionRetried(t *testing.T) {
+	// the server drops idle connections long before the client would
+	addr := startServer(t, server.WithIdleTimeout(10*time.Millisecond))
+	c := New()
+	first := fetch(t, c, addr, request.New("GET", "/", nil))
+	time.Sleep(50 * time.Millisecond)
+	second := fetch(t, c, addr, request.New("GET", "/", nil))
+	assert.NotEqual(t, first, second)
+}
+
+func TestTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "over tls")
+	}))
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	addr := ts.Listener.Addr().String()
+
+	c := NewTLS(&tls.Config{RootCAs: roots})
+	assert.Equal(t, "over tls", fetch(t, c, addr, request.New("GET", "/", nil)))
+	assert.Equal(t, 1, c.idleCount(addr))
+
+	// the server's certificate is checked
+	_, err := NewTLS(nil).Do(addr, request.New("GET", "/", nil))
+	require.Error(t, err)
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	// the server reads the request and never answers
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	c := New()
+	c.ResponseHeaderTimeout = 20 * time.Millisecond
+	_, err = c.Do(l.Addr().String(), request.New("GET", "/", nil))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,186 @@
+// Package compress - to compress response bodies for clients that accept it
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// DefaultMinSize is the smallest body worth compressing, below it the
+// encoding overhead outweighs the savings.
+const DefaultMinSize = 1024
+
+// DefaultTypes are the content types compressed unless told otherwise.
+var DefaultTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+type Compressor struct {
+	// MinSize is the smallest Content-Length that is compressed. Bodies
+	// without a Content-Length are streamed, so they are always compressed.
+	MinSize int64
+	// Level is passed to the gzip and zlib writers
+	Level int
+	// Types lists the compressible content types,
+	// "text/*" matches every text subtype
+	Types []string
+}
+
+func New() *Compressor {
+	return &Compressor{
+		MinSize: DefaultMinSize,
+		Level:   gzip.DefaultCompression,
+		Types:   DefaultTypes,
+	}
+}
+
+// Middleware compresses the responses of next with gzip or deflate,
+// whichever the client prefers in its Accept-Encoding.
+func (c *Compressor) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		coding := Negotiate(r.Headers.Get("accept-encoding"))
+		w.OnWriteHeaders(func(w *response.Writer, h headers.Headers) {
+			c.prepare(w, h, coding)
+		})
+		next(w, r)
+	}
+}
+
+// prepare switches a response over to a compressed, chunked body if it is
+// worth compressing and the client accepts coding.
+func (c *Compressor) prepare(w *response.Writer, h headers.Headers, coding string) {
+	if w.StatusCode < 200 || w.StatusCode == 204 || w.StatusCode == 304 {
+		return
+	}
+	if !c.compressible(h.Get("Content-Type")) {
+		return
+	}
+	// the body depends on the request's Accept-Encoding
+	// whether or not this one gets compressed
+	if !h.HasToken("Vary", "accept-encoding") {
+		if vary := h.Get("Vary"); vary != "" {
+			h.Set("Vary", vary+", Accept-Encoding")
+		} else {
+			h.Set("Vary", "Accept-Encoding")
+		}
+	}
+	if coding == "" ||
+		h.Get("Content-Encoding") != "" ||
+		h.Get("Content-Range") != "" ||
+		h.HasToken("Cache-Control", "no-transform") {
+		return
+	}
+	if cl, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && cl < c.MinSize {
+		return
+	}
+
+	h.Delete("Content-Length")
+	h.Set("Content-Encoding", coding)
+	h.Set("Transfer-Encoding", "chunked")
+	// the compressed bytes differ from the ones the tag was made for
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.EncodeBody(func(dst io.Writer) response.BodyEncoder {
+		return c.newEncoder(w.Logger, dst, coding)
+	})
+}
+
+func (c *Compressor) newEncoder(logger *slog.Logger, dst io.Writer, coding string) response.BodyEncoder {
+	switch coding {
+	case "gzip":
+		enc, err := gzip.NewWriterLevel(dst, c.Level)
+		if err != nil {
+			logger.Warn("invalid compression level, using the default", "level", c.Level, "err", err)
+			return gzip.NewWriter(dst)
+		}
+		return enc
+	default:
+		// the deflate content coding is the zlib format,
+		// not a raw deflate stream
+		enc, err := zlib.NewWriterLevel(dst, c.Level)
+		if err != nil {
+			logger.Warn("invalid compression level, using the default", "level", c.Level, "err", err)
+			return zlib.NewWriter(dst)
+		}
+		return enc
+	}
+}
+
+func (c *Compressor) compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	for _, t := range c.Types {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate picks "gzip" or "deflate" from an Accept-Encoding header by
+// q-value, preferring gzip on a tie. It returns "" when the client accepts
+// neither, in which case the body is sent as it is.
+func Negotiate(acceptEncoding string) string {
+	q := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		weight := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if !ok || strings.TrimSpace(k) != "q" {
+				continue
+			}
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || f < 0 || f > 1 {
+				f = 0
+			}
+			weight = f
+		}
+		if coding == "*" {
+			wildcard = weight
+			continue
+		}
+		q[coding] = weight
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		weight, ok := q[coding]
+		if !ok {
+			weight = max(wildcard, 0)
+		}
+		if weight > bestQ {
+			best, bestQ = coding, weight
+		}
+	}
+	return best
+}
@@ -0,0 +1,150 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/chunked"
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := map[string]string{
+		"":                            "",
+		"gzip":                        "gzip",
+		"deflate":                     "deflate",
+		"gzip, deflate, br":           "gzip",
+		"deflate;q=1.0, gzip;q=0.5":   "deflate",
+		"gzip;q=0, deflate;q=0.1":     "deflate",
+		"*":                           "gzip",
+		"*;q=0.5, gzip;q=0":           "deflate",
+		"identity":                    "",
+		"br":                          "",
+		"x-gzip":                      "gzip",
+		"gzip;q=invalid, deflate":     "deflate",
+		" GZIP ; q=0.8 , deflate;q=1": "deflate",
+	}
+	for header, want := range tests {
+		assert.Equal(t, want, Negotiate(header), header)
+	}
+}
+
+// run serves a request through the middleware, returning the raw
+// response head and the de-chunked body
+func run(t *testing.T, handler func(*response.Writer, *request.Request), acceptEncoding string) (string, []byte) {
+	t.Helper()
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+	if acceptEncoding != "" {
+		raw += "Accept-Encoding: " + acceptEncoding + "\r\n"
+	}
+	r, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf, &headers.Headers{})
+	New().Middleware(handler)(w, r)
+	require.NoError(t, w.Finish())
+
+	head, body, ok := strings.Cut(buf.String(), "\r\n\r\n")
+	require.True(t, ok)
+	if !strings.Contains(head, "Transfer-Encoding: chunked") {
+		return head, []byte(body)
+	}
+	d := chunked.NewDecoder()
+	decoded := []byte{}
+	data := []byte(body)
+	for d.State != chunked.Done {
+		n, chunk, err := d.Parse(data)
+		require.NoError(t, err)
+		require.NotZero(t, n)
+		decoded = append(decoded, chunk...)
+		data = data[n:]
+	}
+	return head, decoded
+}
+
+func textHandler(body string, contentType string) func(*response.Writer, *request.Request) {
+	return func(w *response.Writer, r *request.Request) {
+		_ = w.WriteStatusLine(response.OK)
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("Content-Type", contentType)
+		h.Set("ETag", `"v1"`)
+		_ = w.WriteHeaders(h)
+		_, _ = w.WriteBody([]byte(body))
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	body := strings.Repeat("hello world ", 200)
+	head, compressed := run(t, textHandler(body, "text/plain"), "gzip, deflate")
+	assert.Contains(t, head, "Content-Encoding: gzip")
+	assert.Contains(t, head, "Vary: Accept-Encoding")
+	assert.Contains(t, head, `ETag: W/"v1"`)
+	assert.NotContains(t, head, "Content-Length")
+	assert.Less(t, len(compressed), len(body))
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(plain))
+}
+
+func TestDeflateResponse(t *testing.T) {
+	body := strings.Repeat("{\"hello\":\"world\"}", 100)
+	head, compressed := run(t, textHandler(body, "application/json; charset=utf-8"), "deflate")
+	assert.Contains(t, head, "Content-Encoding: deflate")
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(plain))
+}
+
+func TestSkipsSmallAndIncompressible(t *testing.T) {
+	head, body := run(t, textHandler("tiny", "text/plain"), "gzip")
+	assert.NotContains(t, head, "Content-Encoding")
+	assert.Contains(t, head, "Vary: Accept-Encoding")
+	assert.Equal(t, "tiny", string(body))
+
+	video := strings.Repeat("x", 4096)
+	head, body = run(t, textHandler(video, "video/mp4"), "gzip")
+	assert.NotContains(t, head, "Content-Encoding")
+	assert.NotContains(t, head, "Vary")
+	assert.Equal(t, video, string(body))
+
+	head, _ = run(t, textHandler(video, "text/plain"), "")
+	assert.NotContains(t, head, "Content-Encoding")
+}
+
+func TestStreamingFlushesEachChunk(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"))
+	require.NoError(t, err)
+	w := response.NewWriter(buf, &headers.Headers{})
+	New().Middleware(func(w *response.Writer, r *request.Request) {
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(headers.Headers{
+			"Content-Type":      "application/json",
+			"Transfer-Encoding": "chunked",
+			"Trailer":           "X-Content-Length",
+		})
+		_ = w.WriteChunkedBody([]byte(`{"n":1}`))
+		// the first chunk has to be on the wire before the handler goes on
+		_, afterHead, _ := strings.Cut(buf.String(), "\r\n\r\n")
+		assert.NotEmpty(t, afterHead)
+		_ = w.WriteChunkedBody([]byte(`{"n":2}`))
+		_ = w.WriteChunkedBodyDone()
+		_ = w.WriteTrailer(headers.Headers{"X-Content-Length": "14"})
+	})(w, r)
+	assert.True(t, w.Complete())
+	assert.True(t, strings.HasSuffix(buf.String(), "0\r\nX-Content-Length: 14\r\n\r\n"))
+}
@@ -0,0 +1,236 @@
+// Package conditional - to answer conditional requests from a response's
+// validators, the ETag and Last-Modified headers (RFC 9110 section 13)
+package conditional
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// Validators describe the current representation of a resource.
+// Either may be left empty.
+type Validators struct {
+	// ETag is a quoted entity tag, prefixed with W/ when it is weak
+	ETag         string
+	LastModified time.Time
+}
+
+func StrongETag(opaque string) string {
+	return `"` + opaque + `"`
+}
+
+func WeakETag(opaque string) string {
+	return `W/"` + opaque + `"`
+}
+
+// HashETag makes a strong entity tag from the SHA-256 of body.
+func HashETag(body []byte) string {
+	hash := sha256.Sum256(body)
+	return StrongETag(fmt.Sprintf("%x", hash[:]))
+}
+
+// SetHeaders adds the ETag and Last-Modified headers for v to h.
+func (v Validators) SetHeaders(h headers.Headers) {
+	if v.ETag != "" {
+		h.Set("ETag", v.ETag)
+	}
+	if !v.LastModified.IsZero() {
+		h.Set("Last-Modified", v.LastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Evaluate checks the preconditions of r against v in the order RFC 9110
+// section 13.2.2 gives. It returns response.OK if the request should go
+// ahead, response.NotModified or response.PreconditionFailed if not.
+func Evaluate(r *request.Request, v Validators) response.StatusCode {
+	modified := v.LastModified.UTC().Truncate(time.Second)
+
+	if im := r.Headers.Get("if-match"); im != "" {
+		if !matches(im, v.ETag, true) {
+			return response.PreconditionFailed
+		}
+	} else if ius, err := http.ParseTime(r.Headers.Get("if-unmodified-since")); err == nil && !v.LastModified.IsZero() {
+		if modified.After(ius) {
+			return response.PreconditionFailed
+		}
+	}
+
+	safe := r.RequestLine.Method == "GET" || r.RequestLine.Method == "HEAD"
+	if inm := r.Headers.Get("if-none-match"); inm != "" {
+		if matches(inm, v.ETag, false) {
+			if safe {
+				return response.NotModified
+			}
+			return response.PreconditionFailed
+		}
+	} else if ims, err := http.ParseTime(r.Headers.Get("if-modified-since")); err == nil && safe && !v.LastModified.IsZero() {
+		if !modified.After(ims) {
+			return response.NotModified
+		}
+	}
+	return response.OK
+}
+
+// RangeApplies evaluates If-Range: a Range request is only served as one
+// if the client's partial copy is still of the current representation.
+func RangeApplies(r *request.Request, v Validators) bool {
+	ir := r.Headers.Get("if-range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return matches(ir, v.ETag, true)
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil || v.LastModified.IsZero() {
+		return false
+	}
+	return v.LastModified.UTC().Truncate(time.Second).Equal(t)
+}
+
+// matches reports whether etag is in a comma-separated list of entity
+// tags, or the list is "*". The weak comparison ignores W/ prefixes, the
+// strong one never matches a weak tag.
+func matches(list, etag string, strong bool) bool {
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" {
+			return true
+		}
+		if etag == "" {
+			continue
+		}
+		if strong && (strings.HasPrefix(t, "W/") || strings.HasPrefix(etag, "W/")) {
+			continue
+		}
+		if strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Check evaluates the preconditions of r against v. If they fail it writes
+// the 304 or 412 response and returns false, and the handler should stop
+// without producing a body, or changing anything for an unsafe method.
+func Check(w *response.Writer, r *request.Request, v Validators) bool {
+	status := Evaluate(r, v)
+	if status == response.OK {
+		return true
+	}
+	h := headers.NewHeaders()
+	v.SetHeaders(h)
+	writeFailure(w, status, h)
+	return false
+}
+
+// ServeBody writes body with a strong ETag hashed from it, answering
+// conditional requests for it. It suits handlers that build the whole
+// body in memory anyway.
+func ServeBody(w *response.Writer, r *request.Request, status response.StatusCode, h headers.Headers, body []byte) {
+	v := Validators{ETag: HashETag(body)}
+	if !Check(w, r, v) {
+		return
+	}
+	v.SetHeaders(h)
+	h.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	if err := w.WriteStatusLine(status); err != nil {
+		w.Logger.Warn("error writing status line", "err", err)
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		w.Logger.Warn("error writing headers", "err", err)
+		return
+	}
+	if _, err := w.WriteBody(body); err != nil {
+		w.Logger.Warn("error writing body", "err", err)
+	}
+}
+
+// Lookup finds the validators of the resource r is for, before a handler
+// runs. It reports false when they can't be known up front.
+type Lookup func(r *request.Request) (Validators, bool)
+
+// Middleware evaluates preconditions against the ETag and Last-Modified a
+// handler puts in its headers. When they fail, the 304 or 412 goes out in
+// place of the handler's response and its body is discarded. The handler
+// still runs, so handlers that change state must call Check first, or be
+// wrapped with WithValidators instead. An If-Range can't be evaluated
+// before the handler runs, so the Range of a request with one is dropped
+// and the full representation is served.
+func Middleware(next server.Handler) server.Handler {
+	return WithValidators(nil)(next)
+}
+
+// WithValidators is Middleware for handlers whose validators lookup can
+// find up front. The preconditions and If-Range are then evaluated before
+// the handler is called, and it doesn't run at all on a 304 or 412.
+// Requests lookup can't answer are treated as Middleware does.
+func WithValidators(lookup Lookup) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, r *request.Request) {
+			if lookup != nil {
+				if v, ok := lookup(r); ok {
+					if !Check(w, r, v) {
+						return
+					}
+					if !RangeApplies(r, v) {
+						r.Headers.Delete("Range")
+					}
+					next(w, r)
+					return
+				}
+			}
+			if r.Headers.Get("if-range") != "" {
+				r.Headers.Delete("Range")
+			}
+			w.OnWriteHeaders(func(w *response.Writer, h headers.Headers) {
+				if w.StatusCode < 200 || w.StatusCode >= 300 {
+					return
+				}
+				v := Validators{ETag: h.Get("ETag")}
+				if lm, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+					v.LastModified = lm
+				}
+				status := Evaluate(r, v)
+				if status == response.OK {
+					return
+				}
+				w.StatusCode = status
+				dropBodyHeaders(h, status)
+				w.SuppressBody = true
+			})
+			next(w, r)
+		}
+	}
+}
+
+func writeFailure(w *response.Writer, status response.StatusCode, h headers.Headers) {
+	dropBodyHeaders(h, status)
+	if err := w.WriteStatusLine(status); err != nil {
+		w.Logger.Warn("error writing status line", "err", err)
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		w.Logger.Warn("error writing headers", "err", err)
+	}
+}
+
+// dropBodyHeaders removes the headers describing a body that won't be
+// sent. A 412 gets an explicit empty body, a 304 never has one.
+func dropBodyHeaders(h headers.Headers, status response.StatusCode) {
+	for _, k := range []string{"Content-Length", "Transfer-Encoding", "Trailer", "Content-Encoding", "Content-Range", "Content-Type"} {
+		h.Delete(k)
+	}
+	if status == response.PreconditionFailed {
+		h.Set("Content-Length", "0")
+	}
+}
@@ -0,0 +1,213 @@
+package conditional
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/compress"
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+var modTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func newRequest(t *testing.T, method string, hdrs ...string) *request.Request {
+	t.Helper()
+	raw := method + " / HTTP/1.1\r\nHost: localhost\r\n"
+	for _, h := range hdrs {
+		raw += h + "\r\n"
+	}
+	r, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	return r
+}
+
+func TestEvaluate(t *testing.T) {
+	v := Validators{ETag: `"v2"`, LastModified: modTime}
+	before := modTime.Add(-time.Hour).Format(http.TimeFormat)
+	after := modTime.Add(time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		method string
+		hdrs   []string
+		want   response.StatusCode
+	}{
+		{"no preconditions", "GET", nil, response.OK},
+		{"if-match hit", "PUT", []string{`If-Match: "v1", "v2"`}, response.OK},
+		{"if-match miss", "PUT", []string{`If-Match: "v1"`}, response.PreconditionFailed},
+		{"if-match weak", "PUT", []string{`If-Match: W/"v2"`}, response.PreconditionFailed},
+		{"if-match star", "PUT", []string{`If-Match: *`}, response.OK},
+		{"if-unmodified-since passes", "PUT", []string{"If-Unmodified-Since: " + after}, response.OK},
+		{"if-unmodified-since fails", "PUT", []string{"If-Unmodified-Since: " + before}, response.PreconditionFailed},
+		{"if-match wins over if-unmodified-since", "PUT", []string{`If-Match: "v2"`, "If-Unmodified-Since: " + before}, response.OK},
+		{"if-none-match hit", "GET", []string{`If-None-Match: W/"v2"`}, response.NotModified},
+		{"if-none-match hit head", "HEAD", []string{`If-None-Match: "v2"`}, response.NotModified},
+		{"if-none-match miss", "GET", []string{`If-None-Match: "v1"`}, response.OK},
+		{"if-none-match unsafe", "DELETE", []string{`If-None-Match: *`}, response.PreconditionFailed},
+		{"if-modified-since not modified", "GET", []string{"If-Modified-Since: " + after}, response.NotModified},
+		{"if-modified-since modified", "GET", []string{"If-Modified-Since: " + before}, response.OK},
+		{"if-modified-since ignored for post", "POST", []string{"If-Modified-Since: " + after}, response.OK},
+		{"if-none-match wins over if-modified-since", "GET", []string{`If-None-Match: "v1"`, "If-Modified-Since: " + after}, response.OK},
+		{"if-match checked before if-none-match", "GET", []string{`If-Match: "v1"`, `If-None-Match: "v2"`}, response.PreconditionFailed},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, Evaluate(newRequest(t, tc.method, tc.hdrs...), v))
+		})
+	}
+}
+
+func TestRangeApplies(t *testing.T) {
+	v := Validators{ETag: `"v2"`, LastModified: modTime}
+	assert.True(t, RangeApplies(newRequest(t, "GET"), v))
+	assert.True(t, RangeApplies(newRequest(t, "GET", `If-Range: "v2"`), v))
+	assert.False(t, RangeApplies(newRequest(t, "GET", `If-Range: "v1"`), v))
+	assert.True(t, RangeApplies(newRequest(t, "GET", "If-Range: "+modTime.Format(http.TimeFormat)), v))
+	assert.False(t, RangeApplies(newRequest(t, "GET", "If-Range: "+modTime.Add(-time.Hour).Format(http.TimeFormat)), v))
+
+	weak := Validators{ETag: `W/"v2"`}
+	assert.False(t, RangeApplies(newRequest(t, "GET", `If-Range: W/"v2"`), weak))
+}
+
+func serve(t *testing.T, handler server.Handler, r *request.Request) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf, &headers.Headers{})
+	handler(w, r)
+	require.NoError(t, w.Finish())
+	assert.True(t, w.Complete())
+	return buf.String()
+}
+
+func TestMiddleware(t *testing.T) {
+	body := strings.Repeat("hello world ", 200)
+	handler := func(w *response.Writer, r *request.Request) {
+		require.NoError(t, w.WriteStatusLine(response.OK))
+		h := response.GetDefaultHeaders(len(body))
+		Validators{ETag: `"abc"`, LastModified: modTime}.SetHeaders(h)
+		require.NoError(t, w.WriteHeaders(h))
+		_, err := w.WriteBody([]byte(body))
+		require.NoError(t, err)
+	}
+
+	t.Run("not modified", func(t *testing.T) {
+		out := serve(t, Middleware(handler), newRequest(t, "GET", `If-None-Match: "abc"`))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+		assert.Contains(t, out, "ETag: \"abc\"\r\n")
+		assert.NotContains(t, out, "Content-Length")
+		assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+	})
+
+	t.Run("precondition failed", func(t *testing.T) {
+		out := serve(t, Middleware(handler), newRequest(t, "GET", `If-Match: "other"`))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 412 Precondition Failed\r\n"))
+		assert.Contains(t, out, "Content-Length: 0\r\n")
+		assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+	})
+
+	t.Run("passes through", func(t *testing.T) {
+		out := serve(t, Middleware(handler), newRequest(t, "GET", `If-None-Match: "other"`))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+		assert.True(t, strings.HasSuffix(out, body))
+	})
+
+	t.Run("under compression", func(t *testing.T) {
+		// the compressor weakens the tag, which still matches weakly
+		h := server.Chain(handler, compress.New().Middleware, Middleware)
+		out := serve(t, h, newRequest(t, "GET", "Accept-Encoding: gzip", `If-None-Match: W/"abc"`))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+		assert.NotContains(t, out, "Transfer-Encoding")
+		assert.NotContains(t, out, "Content-Encoding")
+		assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+	})
+}
+
+func TestMiddlewareIfRange(t *testing.T) {
+	var gotRange string
+	handler := func(w *response.Writer, r *request.Request) {
+		gotRange = r.Headers.Get("range")
+		require.NoError(t, w.WriteStatusLine(response.OK))
+		h := response.GetDefaultHeaders(0)
+		Validators{ETag: `"abc"`}.SetHeaders(h)
+		require.NoError(t, w.WriteHeaders(h))
+	}
+
+	serve(t, Middleware(handler), newRequest(t, "GET", "Range: bytes=0-1", `If-Range: "abc"`))
+	assert.Empty(t, gotRange)
+	serve(t, Middleware(handler), newRequest(t, "GET", "Range: bytes=0-1"))
+	assert.Equal(t, "bytes=0-1", gotRange)
+}
+
+func TestWithValidators(t *testing.T) {
+	calls := 0
+	handler := func(w *response.Writer, r *request.Request) {
+		calls++
+		require.NoError(t, w.WriteStatusLine(response.OK))
+		h := response.GetDefaultHeaders(0)
+		h.Set("X-Range", r.Headers.Get("range"))
+		require.NoError(t, w.WriteHeaders(h))
+	}
+	known := func(r *request.Request) (Validators, bool) {
+		return Validators{ETag: `"abc"`, LastModified: modTime}, r.RequestLine.Method != "POST"
+	}
+	h := WithValidators(known)(handler)
+
+	tests := []struct {
+		name   string
+		method string
+		hdrs   []string
+		status string
+		calls  int
+		rng    string
+	}{
+		{"not modified", "GET", []string{`If-None-Match: "abc"`}, "304", 0, ""},
+		{"precondition failed", "PUT", []string{`If-Match: "other"`}, "412", 0, ""},
+		{"passes through", "GET", []string{`If-None-Match: "other"`}, "200", 1, ""},
+		{"fresh if-range", "GET", []string{"Range: bytes=0-1", `If-Range: "abc"`}, "200", 1, "bytes=0-1"},
+		{"stale if-range", "GET", []string{"Range: bytes=0-1", `If-Range: "old"`}, "200", 1, ""},
+		{"unknown validators", "POST", []string{"Range: bytes=0-1", `If-Range: "abc"`}, "200", 1, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			calls = 0
+			out := serve(t, h, newRequest(t, tc.method, tc.hdrs...))
+			assert.True(t, strings.HasPrefix(out, "HTTP/1.1 "+tc.status+" "), out)
+			assert.Equal(t, tc.calls, calls)
+			if tc.calls > 0 {
+				assert.Contains(t, out, "X-Range: "+tc.rng+"\r\n")
+			}
+		})
+	}
+}
+
+func TestServeBody(t *testing.T) {
+	body := []byte("some content")
+	etag := HashETag(body)
+	assert.Equal(t, `"`+"290f493c44f5d63d06b374d0a5abd292fae38b92cab2fae5efefe1b0e9347f56"+`"`, etag)
+
+	handler := func(w *response.Writer, r *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/plain")
+		ServeBody(w, r, response.OK, h, body)
+	}
+
+	out := serve(t, handler, newRequest(t, "GET"))
+	assert.Contains(t, out, "ETag: "+etag+"\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nsome content"))
+
+	out = serve(t, handler, newRequest(t, "GET", "If-None-Match: "+etag))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	out = serve(t, handler, newRequest(t, "PUT", `If-Match: "stale"`))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 412 Precondition Failed\r\n"))
+}
@@ -0,0 +1,360 @@
+// Package fileserver - to serve files from a directory over HTTP
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/conditional"
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+const indexFile = "index.html"
+
+// sniffLen is how much of a file is read to guess its type
+// when the extension doesn't give one away
+const sniffLen = 512
+
+type FileServer struct {
+	// Root is the directory files are served from.
+	// Nothing outside of it can be reached, including through symlinks.
+	Root string
+	// Prefix is stripped from the request target before it is
+	// looked up under Root, e.g. "/static"
+	Prefix string
+	// ListDirectories serves an HTML listing for directories
+	// that don't have an index.html
+	ListDirectories bool
+}
+
+func New(root string) *FileServer {
+	return &FileServer{Root: root}
+}
+
+// Handle is a server.Handler serving the file the request target names.
+func (fsrv *FileServer) Handle(w *response.Writer, r *request.Request) {
+	if !allowedMethod(w, r) {
+		return
+	}
+	name, ok := fsrv.resolve(r.RequestLine.Target)
+	if !ok {
+		notFound(w)
+		return
+	}
+	root, err := os.OpenRoot(fsrv.Root)
+	if err != nil {
+		w.Logger.Error("error opening root", "root", fsrv.Root, "err", err)
+		serverError(w)
+		return
+	}
+	defer func() {
+		if err := root.Close(); err != nil {
+			w.Logger.Warn("error closing root", "err", err)
+		}
+	}()
+
+	f, err := root.Open(name)
+	if err != nil {
+		openError(w, err)
+		return
+	}
+	defer closeFile(w.Logger, f)
+	info, err := f.Stat()
+	if err != nil {
+		w.Logger.Error("error reading file info", "err", err)
+		serverError(w)
+		return
+	}
+	if !info.IsDir() {
+		serveContent(w, r, f, info)
+		return
+	}
+
+	// directories are only served at paths ending in a slash,
+	// so relative links in their index and listing resolve. The
+	// location is cleaned to one leading slash, a target like
+	// //evil.example/dir would otherwise redirect to another host
+	targetPath, _, _ := strings.Cut(r.RequestLine.Target, "?")
+	if !strings.HasSuffix(targetPath, "/") {
+		redirect(w, path.Clean("/"+targetPath)+"/")
+		return
+	}
+	index, err := root.Open(path.Join(name, indexFile))
+	if err == nil {
+		defer closeFile(w.Logger, index)
+		if indexInfo, err := index.Stat(); err == nil && !indexInfo.IsDir() {
+			serveContent(w, r, index, indexInfo)
+			return
+		}
+	}
+	if !fsrv.ListDirectories {
+		server.WriteError(w, &server.HandlerError{
+			Code:    int(response.Forbidden),
+			Message: "Forbidden",
+		}, "Directory listing is not allowed")
+		return
+	}
+	listDirectory(w, f, name)
+}
+
+// ServeFile serves a single named file, answering conditional and
+// range requests for it.
+func ServeFile(w *response.Writer, r *request.Request, name string) {
+	if !allowedMethod(w, r) {
+		return
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		openError(w, err)
+		return
+	}
+	defer closeFile(w.Logger, f)
+	info, err := f.Stat()
+	if err != nil {
+		w.Logger.Error("error reading file info", "err", err)
+		serverError(w)
+		return
+	}
+	if info.IsDir() {
+		notFound(w)
+		return
+	}
+	serveContent(w, r, f, info)
+}
+
+// resolve turns a request target into a slash-separated path relative to
+// the root, reporting false if it doesn't fall under Prefix.
+func (fsrv *FileServer) resolve(target string) (string, bool) {
+	p, _, _ := strings.Cut(target, "?")
+	p, err := url.PathUnescape(p)
+	if err != nil || strings.ContainsRune(p, 0) {
+		return "", false
+	}
+	if fsrv.Prefix != "" {
+		prefix := strings.TrimSuffix(fsrv.Prefix, "/")
+		if p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			return "", false
+		}
+		p = strings.TrimPrefix(p, prefix)
+	}
+	// cleaning a rooted path drops any ".." that would climb above it
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return ".", true
+	}
+	return strings.TrimPrefix(p, "/"), true
+}
+
+// serveContent writes f as the response, evaluating the conditional
+// and range headers of the request against it.
+func serveContent(w *response.Writer, r *request.Request, f *os.File, info fs.FileInfo) {
+	v := conditional.Validators{
+		ETag:         fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size()),
+		LastModified: info.ModTime(),
+	}
+	if !conditional.Check(w, r, v) {
+		return
+	}
+	hdrs := headers.NewHeaders()
+	v.SetHeaders(hdrs)
+	hdrs.Set("Accept-Ranges", "bytes")
+
+	contentType, err := detectContentType(f, info.Name())
+	if err != nil {
+		w.Logger.Error("error detecting content type", "err", err)
+		serverError(w)
+		return
+	}
+	size := info.Size()
+	ranges, err := parseRange(r.Headers.Get("range"), size)
+	if !conditional.RangeApplies(r, v) {
+		// the client's copy is stale, so it gets the whole file
+		ranges, err = nil, nil
+	}
+	if errors.Is(err, errUnsatisfiable) {
+		hdrs.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		hdrs.Set("Content-Length", "0")
+		if err := w.WriteStatusLine(response.RangeNotSatisfiable); err != nil {
+			w.Logger.Warn("error writing status line", "err", err)
+			return
+		}
+		if err := w.WriteHeaders(hdrs); err != nil {
+			w.Logger.Warn("error writing headers", "err", err)
+		}
+		return
+	}
+	if err != nil {
+		// a Range header we can't make sense of is ignored
+		ranges = nil
+	}
+
+	switch len(ranges) {
+	case 0:
+		hdrs.Set("Content-Type", contentType)
+		hdrs.Set("Content-Length", fmt.Sprintf("%d", size))
+		writeSection(w, response.OK, hdrs, f, 0, size)
+	case 1:
+		ra := ranges[0]
+		hdrs.Set("Content-Type", contentType)
+		hdrs.Set("Content-Range", ra.contentRange(size))
+		hdrs.Set("Content-Length", fmt.Sprintf("%d", ra.length))
+		writeSection(w, response.PartialContent, hdrs, f, ra.start, ra.length)
+	default:
+		writeMultipart(w, hdrs, f, ranges, contentType, size)
+	}
+}
+
+func writeSection(w *response.Writer, s response.StatusCode, hdrs headers.Headers, f *os.File, start, length int64) {
+	if err := w.WriteStatusLine(s); err != nil {
+		w.Logger.Warn("error writing status line", "err", err)
+		return
+	}
+	if err := w.WriteHeaders(hdrs); err != nil {
+		w.Logger.Warn("error writing headers", "err", err)
+		return
+	}
+	if w.SuppressBody {
+		return
+	}
+	if err := copySection(w, f, start, length); err != nil {
+		w.Logger.Warn("error writing body", "err", err)
+	}
+}
+
+// copySection copies part of f to the response. The file itself, limited
+// to the section, is what gets copied so the writer can hand it to the
+// kernel instead of reading it through a buffer.
+func copySection(w *response.Writer, f *os.File, start, length int64) error {
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, io.LimitReader(f, length))
+	return err
+}
+
+// detectContentType goes by the file extension first and falls back to
+// sniffing the start of the file.
+func detectContentType(f *os.File, name string) (string, error) {
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		return ct, nil
+	}
+	buf := make([]byte, sniffLen)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+func listDirectory(w *response.Writer, dir *os.File, name string) {
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		w.Logger.Error("error reading directory", "err", err)
+		serverError(w)
+		return
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	title := html.EscapeString("/" + strings.TrimPrefix(name, "."))
+	var b strings.Builder
+	fmt.Fprintf(&b, "<html><head><title>Index of %s</title></head><body><h1>Index of %s</h1><ul>", title, title)
+	if name != "." {
+		b.WriteString(`<li><a href="../">../</a></li>`)
+	}
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() {
+			n += "/"
+		}
+		fmt.Fprintf(&b, `<li><a href="%s">%s</a></li>`, html.EscapeString((&url.URL{Path: n}).EscapedPath()), html.EscapeString(n))
+	}
+	b.WriteString("</ul></body></html>")
+
+	body := []byte(b.String())
+	if err := w.WriteStatusLine(response.OK); err != nil {
+		w.Logger.Warn("error writing status line", "err", err)
+		return
+	}
+	hdrs := response.GetDefaultHeaders(len(body))
+	hdrs.Set("Content-Type", "text/html; charset=utf-8")
+	if err := w.WriteHeaders(hdrs); err != nil {
+		w.Logger.Warn("error writing headers", "err", err)
+		return
+	}
+	if _, err := w.WriteBody(body); err != nil {
+		w.Logger.Warn("error writing body", "err", err)
+	}
+}
+
+func allowedMethod(w *response.Writer, r *request.Request) bool {
+	if r.RequestLine.Method == "GET" || r.RequestLine.Method == "HEAD" {
+		return true
+	}
+	if w.Headers == nil {
+		w.Headers = &headers.Headers{}
+	}
+	w.Headers.Set("Allow", "GET, HEAD")
+	server.WriteError(w, &server.HandlerError{
+		Code:    int(response.MethodNotAllowed),
+		Message: "Method Not Allowed",
+	}, "Only GET and HEAD are supported")
+	return false
+}
+
+func redirect(w *response.Writer, location string) {
+	if err := w.WriteStatusLine(response.MovedPermanently); err != nil {
+		w.Logger.Warn("error writing status line", "err", err)
+		return
+	}
+	hdrs := response.GetDefaultHeaders(0)
+	hdrs.Set("Location", location)
+	if err := w.WriteHeaders(hdrs); err != nil {
+		w.Logger.Warn("error writing headers", "err", err)
+	}
+}
+
+// openError answers 404 for any file that can't be opened. That includes
+// names os.Root refuses because they would escape it, which shouldn't be
+// told apart from files that don't exist.
+func openError(w *response.Writer, err error) {
+	if !errors.Is(err, fs.ErrNotExist) {
+		w.Logger.Error("error opening file", "err", err)
+	}
+	notFound(w)
+}
+
+func notFound(w *response.Writer) {
+	server.WriteError(w, &server.HandlerError{
+		Code:    int(response.NotFound),
+		Message: "Not Found",
+	}, "The requested file does not exist")
+}
+
+func serverError(w *response.Writer) {
+	server.WriteError(w, &server.HandlerError{
+		Code:    int(response.ServerError),
+		Message: "Server error",
+	}, "Could not read the requested file")
+}
+
+func closeFile(logger *slog.Logger, f *os.File) {
+	if err := f.Close(); err != nil {
+		logger.Warn("error closing file", "err", err)
+	}
+}
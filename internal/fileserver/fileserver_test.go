@@ -0,0 +1,207 @@
+package fileserver
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+)
+
+func newRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello, world"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "noext"), []byte("<html><body>hi</body></html>"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "site"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "site", "index.html"), []byte("<h1>index</h1>"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "files"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "files", "a<b>.txt"), []byte("a"), 0o644))
+	return root
+}
+
+// serve runs the file server for a raw request and returns the raw response
+func serve(t *testing.T, fsrv *FileServer, raw string) string {
+	t.Helper()
+	r, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf, &headers.Headers{})
+	w.SuppressBody = r.RequestLine.Method == "HEAD"
+	fsrv.Handle(w, r)
+	return buf.String()
+}
+
+func get(target string, extra ...string) string {
+	return "GET " + target + " HTTP/1.1\r\nHost: localhost\r\n" + strings.Join(extra, "") + "\r\n"
+}
+
+func TestServeFile(t *testing.T) {
+	res := serve(t, New(newRoot(t)), get("/hello.txt"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, res, "Content-Type: text/plain; charset=utf-8\r\n")
+	assert.Contains(t, res, "Content-Length: 12\r\n")
+	assert.Contains(t, res, "ETag: \"")
+	assert.Contains(t, res, "Last-Modified: ")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nhello, world"))
+}
+
+func TestSniffContentType(t *testing.T) {
+	res := serve(t, New(newRoot(t)), get("/noext"))
+	assert.Contains(t, res, "Content-Type: text/html; charset=utf-8\r\n")
+}
+
+func TestPathTraversal(t *testing.T) {
+	root := newRoot(t)
+	require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(root), "secret"), []byte("secret"), 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(filepath.Dir(root), "secret"), filepath.Join(root, "link")))
+	fsrv := New(root)
+	for _, target := range []string{"/../secret", "/%2e%2e/secret", "/files/../../secret", "/link"} {
+		res := serve(t, fsrv, get(target))
+		assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), target)
+		assert.NotContains(t, res, "secret\r\n", target)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	fsrv := New(newRoot(t))
+	fsrv.Prefix = "/static"
+	assert.True(t, strings.HasPrefix(serve(t, fsrv, get("/static/hello.txt")), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasPrefix(serve(t, fsrv, get("/hello.txt")), "HTTP/1.1 404 Not Found\r\n"))
+}
+
+func TestNotModified(t *testing.T) {
+	fsrv := New(newRoot(t))
+	res := serve(t, fsrv, get("/hello.txt"))
+	_, etag, _ := strings.Cut(res, "ETag: ")
+	etag, _, _ = strings.Cut(etag, "\r\n")
+
+	res = serve(t, fsrv, get("/hello.txt", "If-None-Match: W/"+etag+"\r\n"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.NotContains(t, res, "hello, world")
+
+	res = serve(t, fsrv, get("/hello.txt", "If-Modified-Since: Fri, 01 Jan 2100 00:00:00 GMT\r\n"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 304 Not Modified\r\n"))
+
+	res = serve(t, fsrv, get("/hello.txt", "If-Modified-Since: Thu, 01 Jan 1970 00:00:00 GMT\r\n"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"))
+}
+
+func TestSingleRange(t *testing.T) {
+	fsrv := New(newRoot(t))
+	res := serve(t, fsrv, get("/hello.txt", "Range: bytes=7-\r\n"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, res, "Content-Range: bytes 7-11/12\r\n")
+	assert.Contains(t, res, "Content-Length: 5\r\n")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nworld"))
+
+	res = serve(t, fsrv, get("/hello.txt", "Range: bytes=-5\r\n"))
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nworld"))
+}
+
+// fileDest records what the body was copied from,
+// standing in for a *net.TCPConn
+type fileDest struct {
+	bytes.Buffer
+	srcs []io.Reader
+}
+
+func (d *fileDest) ReadFrom(r io.Reader) (int64, error) {
+	d.srcs = append(d.srcs, r)
+	return d.Buffer.ReadFrom(r)
+}
+
+func TestRangeHandsFileToDestination(t *testing.T) {
+	r, err := request.RequestFromReader(strings.NewReader(get("/hello.txt", "Range: bytes=7-\r\n")))
+	require.NoError(t, err)
+	dest := &fileDest{}
+	New(newRoot(t)).Handle(response.NewWriter(dest, &headers.Headers{}), r)
+
+	// sendfile only looks through one *io.LimitedReader for the file
+	require.Len(t, dest.srcs, 1)
+	lr, ok := dest.srcs[0].(*io.LimitedReader)
+	require.True(t, ok)
+	assert.IsType(t, &os.File{}, lr.R)
+	assert.True(t, strings.HasSuffix(dest.String(), "\r\n\r\nworld"))
+}
+
+func TestMultiRange(t *testing.T) {
+	res := serve(t, New(newRoot(t)), get("/hello.txt", "Range: bytes=0-4, 7-11\r\n"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, res, "Content-Type: multipart/byteranges; boundary=")
+	assert.Contains(t, res, "Content-Range: bytes 0-4/12\r\n\r\nhello\r\n")
+	assert.Contains(t, res, "Content-Range: bytes 7-11/12\r\n\r\nworld\r\n")
+
+	head, body, _ := strings.Cut(res, "\r\n\r\n")
+	assert.Contains(t, head+"\r\n", "Content-Length: "+strconv.Itoa(len(body))+"\r\n")
+}
+
+func TestUnsatisfiableRange(t *testing.T) {
+	res := serve(t, New(newRoot(t)), get("/hello.txt", "Range: bytes=50-60\r\n"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 416 Range Not Satisfiable\r\n"))
+	assert.Contains(t, res, "Content-Range: bytes */12\r\n")
+
+	// an empty file has no bytes to satisfy any range with
+	root := newRoot(t)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "empty"), nil, 0o644))
+	for _, ranges := range []string{"-5", "0-", "0-0"} {
+		res = serve(t, New(root), get("/empty", "Range: bytes="+ranges+"\r\n"))
+		assert.True(t, strings.HasPrefix(res, "HTTP/1.1 416 Range Not Satisfiable\r\n"), ranges)
+		assert.Contains(t, res, "Content-Range: bytes */0\r\n", ranges)
+	}
+}
+
+func TestStaleIfRange(t *testing.T) {
+	res := serve(t, New(newRoot(t)), get("/hello.txt", "Range: bytes=0-4\r\n", "If-Range: \"stale\"\r\n"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(res, "hello, world"))
+}
+
+func TestDirectories(t *testing.T) {
+	fsrv := New(newRoot(t))
+	res := serve(t, fsrv, get("/site"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 301 Moved Permanently\r\n"))
+	assert.Contains(t, res, "Location: /site/\r\n")
+
+	// not a protocol-relative redirect to the host "site"
+	res = serve(t, fsrv, get("//site"))
+	assert.Contains(t, res, "Location: /site/\r\n")
+
+	res = serve(t, fsrv, get("/site/"))
+	assert.True(t, strings.HasSuffix(res, "<h1>index</h1>"))
+
+	res = serve(t, fsrv, get("/files/"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 403 Forbidden\r\n"))
+
+	fsrv.ListDirectories = true
+	res = serve(t, fsrv, get("/files/"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, res, `<a href="a%3Cb%3E.txt">a&lt;b&gt;.txt</a>`)
+	assert.Contains(t, res, `<a href="../">`)
+}
+
+func TestHeadAndMethods(t *testing.T) {
+	fsrv := New(newRoot(t))
+	res := serve(t, fsrv, "HEAD /hello.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, res, "Content-Length: 12\r\n")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\n"))
+
+	res = serve(t, fsrv, "DELETE /hello.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, res, "Allow: GET, HEAD\r\n")
+
+	r, err := request.RequestFromReader(strings.NewReader("DELETE /hello.txt HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	fsrv.Handle(response.NewWriter(buf, nil), r)
+	assert.Contains(t, buf.String(), "Allow: GET, HEAD\r\n")
+}
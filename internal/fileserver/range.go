@@ -0,0 +1,147 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+)
+
+// maxRanges caps how many ranges one request may ask for,
+// more than that and the whole file is sent instead
+const maxRanges = 32
+
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+type httpRange struct {
+	start, length int64
+}
+
+func (ra httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", ra.start, ra.start+ra.length-1, size)
+}
+
+// parseRange parses a Range header such as "bytes=0-99,200-,-50" against a
+// file of the given size. It returns no ranges if the header is empty, and
+// errUnsatisfiable if none of the ranges overlap the file.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok {
+		return nil, fmt.Errorf("unsupported range unit: %s", s)
+	}
+	parts := strings.Split(spec, ",")
+	if len(parts) > maxRanges {
+		return nil, fmt.Errorf("too many ranges: %d", len(parts))
+	}
+	ranges := []httpRange{}
+	var total int64
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid range: %s", part)
+		}
+		var ra httpRange
+		if first == "" {
+			// a suffix range, the last n bytes
+			n, err := parseRangeInt(last)
+			if err != nil {
+				return nil, err
+			}
+			// clamped first, so nothing of an empty file is a range either
+			n = min(n, size)
+			if n == 0 {
+				continue
+			}
+			ra = httpRange{start: size - n, length: n}
+		} else {
+			start, err := parseRangeInt(first)
+			if err != nil {
+				return nil, err
+			}
+			end := size - 1
+			if last != "" {
+				end, err = parseRangeInt(last)
+				if err != nil {
+					return nil, err
+				}
+				if end < start {
+					return nil, fmt.Errorf("invalid range: %s", part)
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			ra = httpRange{start: start, length: end - start + 1}
+		}
+		total += ra.length
+		ranges = append(ranges, ra)
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	// asking for more than the file in pieces isn't worth serving
+	if total > size {
+		return nil, errors.New("ranges overlap")
+	}
+	return ranges, nil
+}
+
+func parseRangeInt(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid range position: %q", s)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// writeMultipart sends several ranges as a multipart/byteranges body.
+// Each part's headers are worked out first so the Content-Length is exact.
+func writeMultipart(w *response.Writer, hdrs headers.Headers, f *os.File, ranges []httpRange, contentType string, size int64) {
+	boundary := rand.Text()
+	partHeaders := make([]string, len(ranges))
+	var length int64
+	for i, ra := range ranges {
+		partHeaders[i] = fmt.Sprintf("\r\n--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", boundary, contentType, ra.contentRange(size))
+		length += int64(len(partHeaders[i])) + ra.length
+	}
+	closing := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	length += int64(len(closing))
+
+	hdrs.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	hdrs.Set("Content-Length", fmt.Sprintf("%d", length))
+	if err := w.WriteStatusLine(response.PartialContent); err != nil {
+		w.Logger.Warn("error writing status line", "err", err)
+		return
+	}
+	if err := w.WriteHeaders(hdrs); err != nil {
+		w.Logger.Warn("error writing headers", "err", err)
+		return
+	}
+	if w.SuppressBody {
+		return
+	}
+	for i, ra := range ranges {
+		if _, err := io.WriteString(w, partHeaders[i]); err != nil {
+			w.Logger.Warn("error writing body", "err", err)
+			return
+		}
+		if err := copySection(w, f, ra.start, ra.length); err != nil {
+			w.Logger.Warn("error writing body", "err", err)
+			return
+		}
+	}
+	if _, err := io.WriteString(w, closing); err != nil {
+		w.Logger.Warn("error writing body", "err", err)
+	}
+}
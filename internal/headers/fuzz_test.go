@@ -0,0 +1,52 @@
+package headers
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzHeadersParse(f *testing.F) {
+	for _, seed := range []string{
+		"Host: localhost:42069\r\n\r\n",
+		"Host: a\r\nHost: b\r\nContent-Length: 5\r\n\r\n",
+		"       Host: localhost:42069       \r\n\r\n",
+		"Host : a\r\n\r\n",
+		"H©st: a\r\n\r\n",
+		"X-Folded: one\r\n two\r\n\r\n",
+		"X: a\nTransfer-Encoding: chunked\r\n\r\n",
+		"X: a\rb\r\n\r\n",
+		"X: a\x00b\r\n\r\n",
+		"NoColon\r\n\r\n",
+		": empty name\r\n\r\n",
+		"X: \r\n\r\n",
+		"X: split\r",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := NewHeaders()
+		for rest := data; len(rest) > 0; {
+			n, done, err := h.Parse(rest)
+			if err != nil {
+				return
+			}
+			if n < 0 || n > len(rest) {
+				t.Fatalf("consumed %d of %d bytes", n, len(rest))
+			}
+			if done || n == 0 {
+				break
+			}
+			rest = rest[n:]
+		}
+		for k, v := range h {
+			if !isValidKey(k) || k != strings.ToLower(k) {
+				t.Fatalf("invalid name %q", k)
+			}
+			// a value that still holds one of these could be
+			// written out as more than one field
+			if strings.ContainsAny(v, "\r\n\x00") {
+				t.Fatalf("invalid value %q", v)
+			}
+		}
+	})
+}
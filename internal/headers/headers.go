@@ -3,6 +3,7 @@ package headers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"strings"
 	"unicode"
@@ -10,6 +11,14 @@ import (
 
 const CRLF = "\r\n"
 
+// MaxHeadSize caps the start line and header fields of a message, so a
+// peer can't make a reader buffer them without bound
+const MaxHeadSize = 64 << 10
+
+// ErrHeadTooLarge is returned by readers for a message whose start line
+// and headers are longer than MaxHeadSize.
+var ErrHeadTooLarge = errors.New("message head too large")
+
 type Headers map[string]string
 
 func NewHeaders() Headers {
@@ -24,15 +33,39 @@ func (h Headers) Add(key, value string) {
 	h[key] = value
 }
 
+// Get returns the value stored under key. Request headers are stored
+// lowercased and response headers as written, so a case-insensitive match
+// is tried when there is no exact one.
 func (h Headers) Get(key string) string {
 	if v, ok := h[key]; ok {
 		return v
 	}
+	for k, v := range h {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
 	return ""
 }
 
+// HasToken reports whether the comma-separated value under key contains
+// token, compared case-insensitively, e.g. "close" in "Connection: close".
+func (h Headers) HasToken(key, token string) bool {
+	for _, t := range strings.Split(h.Get(key), ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete removes key and any entry matching it case-insensitively.
 func (h Headers) Delete(key string) {
-	delete(h, key)
+	for k := range h {
+		if strings.EqualFold(k, key) {
+			delete(h, k)
+		}
+	}
 }
 
 func (h Headers) Parse(d []byte) (n int, done bool, err error) {
@@ -44,6 +77,9 @@ func (h Headers) Parse(d []byte) (n int, done bool, err error) {
 		return 2, true, nil
 	}
 	parts := bytes.SplitN(d[:rnIdx], []byte(":"), 2)
+	if len(parts) != 2 {
+		return 0, false, fmt.Errorf("missing colon in header line: %s", d[:rnIdx])
+	}
 	key := string(parts[0])
 	key = strings.ToLower(key)
 	if key != strings.TrimRight(key, " ") {
@@ -53,6 +89,11 @@ func (h Headers) Parse(d []byte) (n int, done bool, err error) {
 	if !isValidKey(key) {
 		return 0, false, fmt.Errorf("invalid key formatting: %s", key)
 	}
+	// a CR or LF left in a value could end the field early when it is
+	// written out again (RFC 9110 section 5.5)
+	if bytes.ContainsAny(parts[1], "\r\n\x00") {
+		return 0, false, fmt.Errorf("invalid character in header value: %q", parts[1])
+	}
 	value := string(bytes.TrimSpace(parts[1]))
 	if v, ok := h[key]; ok {
 		joinedV := v + ", " + value
@@ -80,3 +80,20 @@ func TestValidSingleHeaderKeyWithMultipleValues(t *testing.T) {
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 }
+
+func TestHasToken(t *testing.T) {
+	headers := Headers{"connection": "keep-alive, Upgrade"}
+	assert.True(t, headers.HasToken("Connection", "upgrade"))
+	assert.True(t, headers.HasToken("connection", "keep-alive"))
+	assert.False(t, headers.HasToken("connection", "close"))
+	assert.False(t, headers.HasToken("transfer-encoding", "chunked"))
+}
+
+func TestMissingColonHeader(t *testing.T) {
+	headers := NewHeaders()
+	data := []byte("Host\r\n\r\n")
+	n, done, err := headers.Parse(data)
+	require.Error(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+}
@@ -0,0 +1,331 @@
+// Package metrics - to count what the server does and expose it in the
+// Prometheus text format
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// ContentType is the media type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the default histogram buckets, for latencies in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and writes them out, in the order they were made.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// family is a metric and all of its series, one per set of label values.
+type family struct {
+	name, help, typ string
+	labels          []string
+	// buckets are the upper bounds of a histogram's buckets, +Inf aside
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	// value is the value of a counter or gauge
+	value float64
+	// counts, sum and count are those of a histogram,
+	// counts[i] observations fell in bucket i alone
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// add makes a family, panicking if name is taken or invalid, which is a
+// mistake in the program.
+func (reg *Registry) add(name, help, typ string, labels []string, buckets []float64) *family {
+	if !validName(name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", name))
+	}
+	for _, l := range labels {
+		if !validName(l) || strings.HasPrefix(l, "__") || (typ == "histogram" && l == "le") {
+			panic(fmt.Sprintf("metrics: invalid label name %q", l))
+		}
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, f := range reg.families {
+		if f.name == name {
+			panic(fmt.Sprintf("metrics: %s registered twice", name))
+		}
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	// a metric without labels has a single series, shown from the start
+	if len(labels) == 0 {
+		f.with(nil, func(*series) {})
+	}
+	reg.families = append(reg.families, f)
+	return f
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_' || c == ':' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// with runs fn on the series for values, making it if needed. It panics
+// if there isn't one value for each label.
+func (f *family) with(values []string, fn func(*series)) {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: slices.Clone(values)}
+		if f.typ == "histogram" {
+			s.counts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+// Counter is a value that only goes up, e.g. the number of requests.
+type Counter struct {
+	f *family
+}
+
+// NewCounter makes a counter with a series for each combination of values
+// of labels.
+func (reg *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{reg.add(name, help, "counter", labels, nil)}
+}
+
+// Add adds v, which mustn't be negative, to the series for values.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.f.with(values, func(s *series) { s.value += v })
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Gauge is a value that goes up and down, e.g. open connections.
+type Gauge struct {
+	f *family
+}
+
+func (reg *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{reg.add(name, help, "gauge", labels, nil)}
+}
+
+func (g *Gauge) Set(v float64, values ...string) {
+	g.f.with(values, func(s *series) { s.value = v })
+}
+
+func (g *Gauge) Add(v float64, values ...string) {
+	g.f.with(values, func(s *series) { s.value += v })
+}
+
+func (g *Gauge) Inc(values ...string) {
+	g.Add(1, values...)
+}
+
+func (g *Gauge) Dec(values ...string) {
+	g.Add(-1, values...)
+}
+
+// Histogram counts observations, e.g. latencies, in buckets.
+type Histogram struct {
+	f *family
+}
+
+// NewHistogram makes a histogram with the given bucket upper bounds, which
+// must be increasing. A +Inf bucket is always added.
+func (reg *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s aren't increasing", name))
+	}
+	buckets = slices.Clone(buckets)
+	if n := len(buckets); n > 0 && math.IsInf(buckets[n-1], 1) {
+		buckets = buckets[:n-1]
+	}
+	return &Histogram{reg.add(name, help, "histogram", labels, buckets)}
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	// the first bucket whose upper bound is at least v, or +Inf
+	i, _ := slices.BinarySearch(h.f.buckets, v)
+	h.f.with(values, func(s *series) {
+		s.counts[i]++
+		s.sum += v
+		s.count++
+	})
+}
+
+// WriteText writes every metric to out in the Prometheus text exposition
+// format, version 0.0.4.
+func (reg *Registry) WriteText(out io.Writer) error {
+	reg.mu.Lock()
+	families := slices.Clone(reg.families)
+	reg.mu.Unlock()
+
+	var b bytes.Buffer
+	for _, f := range families {
+		f.write(&b)
+	}
+	_, err := out.Write(b.Bytes())
+	return err
+}
+
+func (f *family) write(b *bytes.Buffer) {
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.typ)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.typ != "histogram" {
+			writeSample(b, f.name, f.labels, s.values, "", s.value)
+			continue
+		}
+		var cumulative uint64
+		for i, n := range s.counts {
+			cumulative += n
+			le := math.Inf(1)
+			if i < len(f.buckets) {
+				le = f.buckets[i]
+			}
+			writeSample(b, f.name+"_bucket", f.labels, s.values, formatFloat(le), float64(cumulative))
+		}
+		writeSample(b, f.name+"_sum", f.labels, s.values, "", s.sum)
+		writeSample(b, f.name+"_count", f.labels, s.values, "", float64(s.count))
+	}
+}
+
+// writeSample writes a line like `name{label="value",le="0.5"} 3`, le is
+// only added for histogram buckets.
+func writeSample(b *bytes.Buffer, name string, labels, values []string, le string, v float64) {
+	b.WriteString(name)
+	if len(labels) > 0 || le != "" {
+		b.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, `%s="%s"`, l, escapeLabel(values[i]))
+		}
+		if le != "" {
+			if len(labels) > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, `le="%s"`, le)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(v))
+	b.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// Handler serves the metrics to a scraper, mount it at e.g. /metrics.
+func (reg *Registry) Handler(w *response.Writer, r *request.Request) {
+	if r.RequestLine.Method != "GET" && r.RequestLine.Method != "HEAD" {
+		w.Headers.Set("Allow", "GET, HEAD")
+		server.WriteError(w, &server.HandlerError{
+			Code:    int(response.MethodNotAllowed),
+			Message: "Method Not Allowed",
+		}, "Only GET and HEAD are supported")
+		return
+	}
+	var body bytes.Buffer
+	if err := reg.WriteText(&body); err != nil {
+		w.Logger.Error("error writing metrics", "err", err)
+		return
+	}
+	if err := w.WriteStatusLine(response.OK); err != nil {
+		w.Logger.Error("error writing metrics", "err", err)
+		return
+	}
+	h := headers.Headers{}
+	h.Set("Content-Length", strconv.Itoa(body.Len()))
+	h.Set("Content-Type", ContentType)
+	h.Set("Cache-Control", "no-store")
+	if err := w.WriteHeaders(h); err != nil {
+		w.Logger.Error("error writing metrics", "err", err)
+		return
+	}
+	if _, err := w.WriteBody(body.Bytes()); err != nil {
+		w.Logger.Error("error writing metrics", "err", err)
+	}
+}
@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+	"github.com/k4rldoherty/http-from-tcp/internal/servertest"
+)
+
+func text(t *testing.T, reg *Registry) string {
+	t.Helper()
+	var b bytes.Buffer
+	require.NoError(t, reg.WriteText(&b))
+	return b.String()
+}
+
+func TestWriteText(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.NewCounter("jobs_total", "Jobs done,\nby queue.", "queue")
+	g := reg.NewGauge("temperature", "Current temperature.")
+	h := reg.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+
+	c.Inc("b")
+	c.Add(2.5, `a"\`)
+	g.Set(3)
+	g.Dec()
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(7)
+
+	assert.Equal(t, `# HELP jobs_total Jobs done,\nby queue.
+# TYPE jobs_total counter
+jobs_total{queue="a\"\\"} 2.5
+jobs_total{queue="b"} 1
+# HELP temperature Current temperature.
+# TYPE temperature gauge
+temperature 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 7.15
+latency_seconds_count 3
+`, text(t, reg))
+}
+
+func TestMisuse(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.NewCounter("a_total", "A.", "x")
+	assert.Panics(t, func() { reg.NewGauge("a_total", "Again.") })
+	assert.Panics(t, func() { reg.NewGauge("0bad", "Bad name.") })
+	assert.Panics(t, func() { reg.NewHistogram("h", "Bad label.", DefBuckets, "le") })
+	assert.Panics(t, func() { reg.NewHistogram("h", "Unsorted.", []float64{2, 1}) })
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { c.Add(-1, "x") })
+}
+
+func TestHandler(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("hits_total", "Hits.").Inc()
+	reg.NewGauge("idle", "Never set.")
+
+	r := servertest.NewRequest("GET /metrics HTTP/1.1\r\nHost: x\r\n\r\n")
+	rec := servertest.NewRecorder(r)
+	reg.Handler(rec.Writer, r)
+	res, err := rec.Result()
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, res.StatusLine.StatusCode)
+	assert.Equal(t, ContentType, res.Headers.Get("content-type"))
+	assert.Contains(t, string(res.Body), "hits_total 1\n")
+	assert.Contains(t, string(res.Body), "idle 0\n")
+
+	r = servertest.NewRequest("POST /metrics HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\n\r\n")
+	rec = servertest.NewRecorder(r)
+	reg.Handler(rec.Writer, r)
+	res, err = rec.Result()
+	require.NoError(t, err)
+	assert.Equal(t, response.MethodNotAllowed, res.StatusLine.StatusCode)
+	assert.Equal(t, "GET, HEAD", res.Headers.Get("allow"))
+}
+
+func TestServerMiddleware(t *testing.T) {
+	reg := NewRegistry()
+	m := NewServer(reg)
+	m.Route = func(r *request.Request) string {
+		if strings.HasPrefix(r.RequestLine.Target, "/api/") {
+			return "api"
+		}
+		return "other"
+	}
+	h := m.Middleware(func(w *response.Writer, r *request.Request) {
+		_, _ = io.ReadAll(r.BodyReader())
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"})
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	for _, raw := range []string{
+		"POST /api/items HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc",
+		"BREW /pot HTTP/1.1\r\nHost: x\r\n\r\n",
+	} {
+		r := servertest.NewRequest(raw)
+		rec := servertest.NewRecorder(r)
+		h(rec.Writer, r)
+		_, err := rec.Result()
+		require.NoError(t, err)
+	}
+
+	out := text(t, reg)
+	assert.Contains(t, out, `http_requests_total{method="POST",route="api",status="200"} 1`+"\n")
+	assert.Contains(t, out, `http_requests_total{method="OTHER",route="other",status="200"} 1`+"\n")
+	assert.Contains(t, out, `http_request_size_bytes_bucket{method="POST",route="api",le="100"} 1`+"\n")
+	assert.Contains(t, out, `http_request_size_bytes_sum{method="POST",route="api"} 3`+"\n")
+	assert.Contains(t, out, `http_response_size_bytes_sum{method="POST",route="api"} 5`+"\n")
+	assert.Contains(t, out, `http_request_duration_seconds_count{method="POST",route="api"} 1`+"\n")
+}
+
+func TestServerMiddlewareEmptyResponse(t *testing.T) {
+	reg := NewRegistry()
+	m := NewServer(reg)
+	h := m.Middleware(func(w *response.Writer, r *request.Request) {})
+
+	r := servertest.NewRequest("GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	rec := servertest.NewRecorder(r)
+	h(rec.Writer, r)
+	_, err := rec.Result()
+	require.NoError(t, err)
+
+	out := text(t, reg)
+	assert.Contains(t, out, `http_requests_total{method="GET",route="other",status="200"} 1`+"\n")
+	assert.NotContains(t, out, `status="0"`)
+}
+
+func TestServerObserver(t *testing.T) {
+	reg := NewRegistry()
+	m := NewServer(reg)
+	s := server.New(func(w *response.Writer, r *request.Request) {
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(headers.Headers{"Content-Length": "0"})
+	}, server.WithObserver(m))
+
+	client := servertest.Dial(s)
+	_, err := io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	rd := response.NewReader(client)
+	_, err = rd.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Contains(t, text(t, reg), "http_connections_active 1\n")
+
+	_, err = io.WriteString(client, "not a request\r\n\r\n")
+	require.NoError(t, err)
+	res, err := rd.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, response.BadRequest, res.StatusLine.StatusCode)
+	_, err = rd.ReadResponse("GET")
+	require.ErrorIs(t, err, io.EOF)
+
+	// the count drops once the server is done with the connection
+	assert.Eventually(t, func() bool {
+		return strings.Contains(text(t, reg), "http_connections_active 0\n")
+	}, time.Second, 5*time.Millisecond)
+	out := text(t, reg)
+	assert.Contains(t, out, "http_connections_accepted_total 1\n")
+	assert.Contains(t, out, `http_request_parse_errors_total{kind="malformed"} 1`+"\n")
+
+	// an expectation the server can't meet is counted too
+	client = servertest.Dial(s)
+	_, err = io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\nExpect: teapot\r\n\r\n")
+	require.NoError(t, err)
+	res, err = response.NewReader(client).ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCode(417), res.StatusLine.StatusCode)
+	assert.Contains(t, text(t, reg), `http_request_parse_errors_total{kind="expectation_failed"} 1`+"\n")
+}
+
+func TestErrorKind(t *testing.T) {
+	tests := map[string]error{
+		"unsupported_encoding": fmt.Errorf("%w: br", request.ErrUnsupportedEncoding),
+		"body_too_large":       request.ErrBodyTooLarge,
+		"expectation_failed":   fmt.Errorf("%w: teapot", request.ErrUnsupportedExpectation),
+		"timeout":              os.ErrDeadlineExceeded,
+		"malformed":            errors.New("invalid request line"),
+	}
+	for want, err := range tests {
+		assert.Equal(t, want, errorKind(err))
+	}
+}
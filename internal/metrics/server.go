@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// SizeBuckets are the buckets of the request and response size histograms
+var SizeBuckets = []float64{100, 1000, 10000, 100000, 1e6, 1e7, 1e8}
+
+// Server keeps the metrics of a server.Server. It is both a
+// server.Observer, for connections and requests that can't be read, and a
+// middleware, for the requests the handler answers.
+type Server struct {
+	// Route names the route a request took, for the route label. It must
+	// only return a few distinct values, a series is kept for each. By
+	// default every request is counted under the route "other".
+	Route func(r *request.Request) string
+
+	connsAccepted *Counter
+	connsActive   *Gauge
+	requests      *Counter
+	requestSize   *Histogram
+	responseSize  *Histogram
+	duration      *Histogram
+	parseErrors   *Counter
+}
+
+// NewServer registers the server metrics with reg.
+func NewServer(reg *Registry) *Server {
+	return &Server{
+		connsAccepted: reg.NewCounter("http_connections_accepted_total",
+			"Connections accepted."),
+		connsActive: reg.NewGauge("http_connections_active",
+			"Connections being served."),
+		requests: reg.NewCounter("http_requests_total",
+			"Requests answered, by method, route and status.", "method", "route", "status"),
+		requestSize: reg.NewHistogram("http_request_size_bytes",
+			"Size of request bodies read, in bytes.", SizeBuckets, "method", "route"),
+		responseSize: reg.NewHistogram("http_response_size_bytes",
+			"Size of response bodies sent, in bytes.", SizeBuckets, "method", "route"),
+		duration: reg.NewHistogram("http_request_duration_seconds",
+			"Time taken to answer requests, in seconds.", DefBuckets, "method", "route"),
+		parseErrors: reg.NewCounter("http_request_parse_errors_total",
+			"Requests that couldn't be read, by kind of error.", "kind"),
+	}
+}
+
+func (m *Server) ConnOpened() {
+	m.connsAccepted.Inc()
+	m.connsActive.Inc()
+}
+
+func (m *Server) ConnClosed() {
+	m.connsActive.Dec()
+}
+
+func (m *Server) RequestError(err error) {
+	m.parseErrors.Inc(errorKind(err))
+}
+
+// errorKind sorts the errors requests fail to be read with into a few
+// kinds, for the kind label.
+func errorKind(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, request.ErrUnsupportedEncoding):
+		return "unsupported_encoding"
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return "body_too_large"
+	case errors.Is(err, headers.ErrHeadTooLarge):
+		return "head_too_large"
+	case errors.Is(err, request.ErrUnsupportedExpectation):
+		return "expectation_failed"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "network"
+	default:
+		return "malformed"
+	}
+}
+
+// Middleware counts each request next answers and times it, up to when
+// the response is finished. It should be outermost, so the time includes
+// the other middleware.
+func (m *Server) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		start := time.Now()
+		w.OnFinish(func(w *response.Writer, err error) {
+			method := methodLabel(r.RequestLine.Method)
+			route := "other"
+			if m.Route != nil {
+				route = m.Route(r)
+			}
+			status := "hijacked"
+			if !w.Hijacked() {
+				status = strconv.Itoa(int(w.StatusCode))
+			}
+			m.duration.Observe(time.Since(start).Seconds(), method, route)
+			m.requests.Inc(method, route, status)
+			m.requestSize.Observe(float64(r.BodyLen()), method, route)
+			m.responseSize.Observe(float64(w.BytesWritten()), method, route)
+		})
+		next(w, r)
+	}
+}
+
+// methodLabel keeps the method label to the standard methods, anything
+// else a client sends is counted as "OTHER".
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH":
+		return method
+	default:
+		return "OTHER"
+	}
+}
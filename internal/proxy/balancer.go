@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"cmp"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/client"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultMaxFails            = 3
+	DefaultEjectDuration       = 30 * time.Second
+	DefaultRetries             = 1
+)
+
+// ringReplicas is how many points each upstream gets on the hash ring,
+// more spread the keys more evenly between them
+const ringReplicas = 64
+
+type Strategy int
+
+const (
+	RoundRobin Strategy = iota
+	LeastConnections
+	// ConsistentHash sends requests with the same key to the same upstream
+	// for as long as it is available
+	ConsistentHash
+)
+
+type Upstream struct {
+	Addr string
+	// active counts the requests in flight to the upstream
+	active atomic.Int64
+	// healthy is cleared while active health checks fail
+	healthy atomic.Bool
+
+	mu sync.Mutex
+	// failures counts consecutive failed requests,
+	// MaxFails of them eject the upstream until ejectedUntil
+	failures     int
+	ejectedUntil time.Time
+}
+
+// Available reports whether requests may be sent to the upstream.
+func (u *Upstream) Available() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy.Load() && !time.Now().Before(u.ejectedUntil)
+}
+
+type Pool struct {
+	Strategy Strategy
+	// HashHeader is the request header ConsistentHash keys on. The client's
+	// IP is used when it's empty or the request doesn't have the header.
+	HashHeader string
+	// HealthCheckPath is requested from every upstream each
+	// HealthCheckInterval once StartHealthChecks is called. Upstreams that
+	// don't answer with a 2xx or 3xx get no requests until they do.
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	// Client sends the health checks, client.DefaultClient if nil. Give
+	// it the same Client as the ReverseProxy, e.g. for TLS upstreams.
+	Client *client.Client
+	// MaxFails consecutive requests an upstream couldn't take eject it for
+	// EjectDuration, zero never ejects
+	MaxFails      int
+	EjectDuration time.Duration
+	// Retries is how many other upstreams an idempotent request is sent to
+	// when the upstream it went to couldn't take it
+	Retries int
+	// Logger is where ejections and health changes are logged
+	Logger *slog.Logger
+
+	upstreams []*Upstream
+	next      atomic.Uint64
+	ring      []ringPoint
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+func NewPool(addrs ...string) *Pool {
+	p := &Pool{
+		HealthCheckPath:     "/",
+		HealthCheckInterval: DefaultHealthCheckInterval,
+		MaxFails:            DefaultMaxFails,
+		EjectDuration:       DefaultEjectDuration,
+		Retries:             DefaultRetries,
+		Logger:              slog.Default(),
+		stop:                make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		u := &Upstream{Addr: addr}
+		u.healthy.Store(true)
+		p.upstreams = append(p.upstreams, u)
+		for i := range ringReplicas {
+			p.ring = append(p.ring, ringPoint{hash: hash(addr + "#" + strconv.Itoa(i)), upstream: u})
+		}
+	}
+	slices.SortFunc(p.ring, func(a, b ringPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	return p
+}
+
+func (p *Pool) Upstreams() []*Upstream {
+	return p.upstreams
+}
+
+// pick chooses the upstream for r by the pool's strategy, out of those
+// that are available and haven't been tried. It returns nil if there are
+// none left.
+func (p *Pool) pick(r *request.Request, tried map[*Upstream]bool) *Upstream {
+	usable := func(u *Upstream) bool {
+		return !tried[u] && u.Available()
+	}
+	switch p.Strategy {
+	case LeastConnections:
+		var best *Upstream
+		for _, u := range p.upstreams {
+			if usable(u) && (best == nil || u.active.Load() < best.active.Load()) {
+				best = u
+			}
+		}
+		return best
+	case ConsistentHash:
+		if len(p.ring) == 0 {
+			return nil
+		}
+		h := hash(p.hashKey(r))
+		start, _ := slices.BinarySearchFunc(p.ring, h, func(pt ringPoint, h uint32) int {
+			return cmp.Compare(pt.hash, h)
+		})
+		// walk clockwise past anything unavailable
+		for i := range p.ring {
+			if u := p.ring[(start+i)%len(p.ring)].upstream; usable(u) {
+				return u
+			}
+		}
+		return nil
+	default:
+		n := len(p.upstreams)
+		if n == 0 {
+			return nil
+		}
+		start := int((p.next.Add(1) - 1) % uint64(n))
+		for i := range n {
+			if u := p.upstreams[(start+i)%n]; usable(u) {
+				return u
+			}
+		}
+		return nil
+	}
+}
+
+func (p *Pool) hashKey(r *request.Request) string {
+	if p.HashHeader != "" {
+		if v := r.Headers.Get(p.HashHeader); v != "" {
+			return v
+		}
+	}
+	return clientIP(r.RemoteAddr)
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// failed records a request u couldn't take, ejecting it after MaxFails
+// of them in a row.
+func (p *Pool) failed(u *Upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures++
+	if p.MaxFails > 0 && u.failures >= p.MaxFails {
+		p.Logger.Warn("ejecting upstream", "upstream", u.Addr, "failures", u.failures)
+		u.ejectedUntil = time.Now().Add(p.EjectDuration)
+		u.failures = 0
+	}
+}
+
+func (p *Pool) succeeded(u *Upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures = 0
+}
+
+// StartHealthChecks checks every upstream straight away and then each
+// HealthCheckInterval, until Close is called.
+func (p *Pool) StartHealthChecks() {
+	p.checkAll()
+	go func() {
+		ticker := time.NewTicker(p.HealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.checkAll()
+			}
+		}
+	}()
+}
+
+func (p *Pool) Close() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *Pool) checkAll() {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		wg.Go(func() {
+			healthy := p.check(u)
+			if healthy != u.healthy.Swap(healthy) {
+				p.Logger.Info("upstream health changed", "upstream", u.Addr, "healthy", healthy)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func (p *Pool) check(u *Upstream) bool {
+	c := p.Client
+	if c == nil {
+		c = client.DefaultClient
+	}
+	res, err := c.Do(u.Addr, request.New("GET", p.HealthCheckPath, nil))
+	if err != nil {
+		return false
+	}
+	closeBody(p.Logger, res)
+	return res.StatusCode >= 200 && res.StatusCode < 400
+}
+
+// idempotent methods can safely be sent again
+// when the first attempt may or may not have arrived
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// handlePooled forwards r to an upstream from the pool. Requests an
+// upstream couldn't take count against it, and idempotent ones are sent to
+// another upstream, as long as the whole body is still in hand to resend.
+func (p *ReverseProxy) handlePooled(w *response.Writer, r *request.Request) {
+	retryable := idempotent(r.RequestLine.Method) && r.State == request.Done
+	tried := map[*Upstream]bool{}
+	for attempt := 0; ; attempt++ {
+		u := p.Pool.pick(r, tried)
+		if u == nil {
+			server.WriteError(w, &server.HandlerError{
+				Code:    int(response.ServiceUnavailable),
+				Message: "Service Unavailable",
+			}, "No upstream server is available")
+			return
+		}
+		tried[u] = true
+
+		u.active.Add(1)
+		res, err := p.send(r, u.Addr)
+		if err != nil {
+			u.active.Add(-1)
+			w.Logger.Warn("error reaching upstream", "upstream", u.Addr, "err", err)
+			p.Pool.failed(u)
+			if retryable && attempt < p.Pool.Retries {
+				continue
+			}
+			badGateway(w)
+			return
+		}
+		p.Pool.succeeded(u)
+		relay(w, r, res)
+		closeBody(w.Logger, res)
+		u.active.Add(-1)
+		return
+	}
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/client"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// named starts an upstream that answers every request with its name
+func named(t *testing.T, name string) string {
+	t.Helper()
+	return serve(t, func(w *response.Writer, r *request.Request) {
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(len(name)))
+		_, _ = w.WriteBody([]byte(name))
+	})
+}
+
+// startPool starts a proxy in front of pool, returning its address
+func startPool(t *testing.T, pool *Pool) string {
+	t.Helper()
+	t.Cleanup(pool.Close)
+	return serve(t, (&ReverseProxy{Pool: pool}).Handle)
+}
+
+func fetch(t *testing.T, addr string, req *request.Request) (int, string) {
+	t.Helper()
+	res, err := client.Do(addr, req)
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res.StatusCode, string(body)
+}
+
+func TestRoundRobin(t *testing.T) {
+	addr := startPool(t, NewPool(named(t, "a"), named(t, "b"), named(t, "c")))
+	got := []string{}
+	for range 6 {
+		_, body := fetch(t, addr, request.New("GET", "/", nil))
+		got = append(got, body)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, got)
+}
+
+func TestLeastConnections(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	slow := serve(t, func(w *response.Writer, r *request.Request) {
+		arrived <- struct{}{}
+		<-release
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(4))
+		_, _ = w.WriteBody([]byte("slow"))
+	})
+	pool := NewPool(slow, named(t, "fast"))
+	pool.Strategy = LeastConnections
+	addr := startPool(t, pool)
+
+	done := make(chan string)
+	go func() {
+		res, err := client.Do(addr, request.New("GET", "/", nil))
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		done <- string(body)
+	}()
+	<-arrived
+
+	// the slow upstream is busy, so everything else goes to the other one
+	for range 3 {
+		_, body := fetch(t, addr, request.New("GET", "/", nil))
+		assert.Equal(t, "fast", body)
+	}
+	close(release)
+	assert.Equal(t, "slow", <-done)
+}
+
+func TestConsistentHash(t *testing.T) {
+	pool := NewPool(named(t, "a"), named(t, "b"), named(t, "c"))
+	pool.Strategy = ConsistentHash
+	pool.HashHeader = "X-User"
+	addr := startPool(t, pool)
+
+	seen := map[string]bool{}
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+		req := request.New("GET", "/", nil)
+		req.Headers.Set("x-user", user)
+		_, first := fetch(t, addr, req)
+		seen[first] = true
+		for range 3 {
+			req := request.New("GET", "/", nil)
+			req.Headers.Set("x-user", user)
+			_, body := fetch(t, addr, req)
+			assert.Equal(t, first, body, user)
+		}
+	}
+	assert.Greater(t, len(seen), 1)
+}
+
+func TestRetryAndPassiveEjection(t *testing.T) {
+	// nothing listens on port 1
+	pool := NewPool("localhost:1", named(t, "live"))
+	pool.MaxFails = 1
+	addr := startPool(t, pool)
+
+	status, body := fetch(t, addr, request.New("GET", "/", nil))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "live", body)
+	assert.False(t, pool.Upstreams()[0].Available())
+
+	// with the dead upstream ejected, even a POST finds the live one
+	status, body = fetch(t, addr, request.New("POST", "/", nil))
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "live", body)
+}
+
+func TestNoRetryForNonIdempotentRequests(t *testing.T) {
+	pool := NewPool("localhost:1", named(t, "live"))
+	addr := startPool(t, pool)
+	status, _ := fetch(t, addr, request.New("POST", "/", nil))
+	assert.Equal(t, 502, status)
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	sick := serve(t, func(w *response.Writer, r *request.Request) {
+		if r.RequestLine.Target == "/healthz" {
+			server.WriteError(w, &server.HandlerError{Code: 503, Message: "Service Unavailable"}, "")
+			return
+		}
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(4))
+		_, _ = w.WriteBody([]byte("sick"))
+	})
+	pool := NewPool(sick, named(t, "well"))
+	pool.HealthCheckPath = "/healthz"
+	pool.HealthCheckInterval = time.Hour
+	pool.StartHealthChecks()
+	addr := startPool(t, pool)
+
+	assert.False(t, pool.Upstreams()[0].Available())
+	for range 3 {
+		_, body := fetch(t, addr, request.New("GET", "/", nil))
+		assert.Equal(t, "well", body)
+	}
+}
+
+func TestHealthChecksUseThePoolClient(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	pool := NewPool(ts.Listener.Addr().String())
+	pool.HealthCheckInterval = time.Hour
+	t.Cleanup(pool.Close)
+	pool.StartHealthChecks()
+	// the default client speaks plaintext to a TLS upstream
+	assert.False(t, pool.Upstreams()[0].Available())
+
+	pool.Client = client.NewTLS(&tls.Config{RootCAs: roots})
+	pool.checkAll()
+	assert.True(t, pool.Upstreams()[0].Available())
+}
+
+func TestNoUpstreamAvailable(t *testing.T) {
+	pool := NewPool("localhost:1")
+	pool.MaxFails = 1
+	pool.Retries = 0
+	addr := startPool(t, pool)
+
+	status, _ := fetch(t, addr, request.New("GET", "/", nil))
+	assert.Equal(t, 502, status)
+	status, _ = fetch(t, addr, request.New("GET", "/", nil))
+	assert.Equal(t, 503, status)
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// ForwardProxy sends requests on to whichever server they name, for
+// clients configured to use it as their proxy. Plain HTTP requests come
+// with an absolute-form target, e.g. "GET http://example.com/ HTTP/1.1",
+// anything else is tunnelled with CONNECT, which the server must be
+// started WithTunneling to allow.
+type ForwardProxy struct {
+	// Allow, when not empty, limits the destinations requests may go to,
+	// and Deny refuses destinations even if they are allowed. Entries are
+	// a host name, "*.example.com" for its subdomains, an IP address or a
+	// CIDR block, any of them optionally followed by ":port". Host names
+	// are resolved and every address they have is checked, then the
+	// proxy connects to the address it checked.
+	Allow []string
+	Deny  []string
+	// Resolver looks up destination host names, net.DefaultResolver
+	// if nil
+	Resolver *net.Resolver
+	// Username and Password, when set, are required from clients as basic
+	// auth in a Proxy-Authorization header
+	Username string
+	Password string
+}
+
+func NewForward() *ForwardProxy {
+	return &ForwardProxy{}
+}
+
+// Handle is a server.Handler for both absolute-form and CONNECT requests.
+// A CONNECT request it allows is left for the server to tunnel.
+func (p *ForwardProxy) Handle(w *response.Writer, r *request.Request) {
+	if !p.authorized(r) {
+		w.Headers.Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		server.WriteError(w, &server.HandlerError{
+			Code:    int(response.ProxyAuthRequired),
+			Message: "Proxy Authentication Required",
+		}, "Proxy credentials are required")
+		return
+	}
+
+	var addr string
+	var u *url.URL
+	if r.RequestLine.Method == "CONNECT" {
+		addr = r.RequestLine.Target
+	} else {
+		var err error
+		u, err = url.Parse(r.RequestLine.Target)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			server.WriteError(w, &server.HandlerError{
+				Code:    int(response.BadRequest),
+				Message: "Bad Request",
+			}, "A proxy request needs an absolute http:// target")
+			return
+		}
+		addr = u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	dest, err := p.destination(r.Context(), addr)
+	if errors.Is(err, errNotAllowed) {
+		w.Logger.Info("refused destination", "addr", addr, "err", err)
+		server.WriteError(w, &server.HandlerError{
+			Code:    int(response.Forbidden),
+			Message: "Forbidden",
+		}, "The proxy does not allow that destination")
+		return
+	}
+	if err != nil {
+		w.Logger.Warn("error resolving destination", "addr", addr, "err", err)
+		badGateway(w)
+		return
+	}
+	if u == nil {
+		// the server tunnels to the target, now the address checked
+		r.RequestLine.Target = dest
+		return
+	}
+
+	// the target's authority replaces whatever Host was sent (RFC 9112
+	// section 3.2.2)
+	r.RequestLine.Target = u.RequestURI()
+	r.Headers.Delete("Host")
+	r.Headers.Set("host", u.Host)
+	New(dest).Handle(w, r)
+}
+
+func (p *ForwardProxy) authorized(r *request.Request) bool {
+	if p.Username == "" && p.Password == "" {
+		return true
+	}
+	scheme, credentials, ok := strings.Cut(r.Headers.Get("proxy-authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(p.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(p.Password)) == 1
+}
+
+var errNotAllowed = errors.New("destination not allowed")
+
+// destination resolves addr, a host:port, and checks each address the
+// host has against the Allow and Deny lists. It returns the address to
+// connect to, so a name can't resolve to a refused address by the time
+// it is dialled.
+func (p *ForwardProxy) destination(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errNotAllowed, err)
+	}
+	resolver := p.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no addresses for %s", host)
+	}
+	for _, ip := range ips {
+		if !p.allowed(host, ip.IP, port) {
+			return "", fmt.Errorf("%w: %s is %s", errNotAllowed, host, ip)
+		}
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// allowed checks a destination, by name and by one of its addresses,
+// against the Allow and Deny lists.
+func (p *ForwardProxy) allowed(host string, ip net.IP, port string) bool {
+	for _, pattern := range p.Deny {
+		if matchDestination(pattern, host, ip, port) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range p.Allow {
+		if matchDestination(pattern, host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDestination reports whether pattern matches the destination host,
+// at address ip, on port. Address patterns go by ip and name patterns
+// by host.
+func matchDestination(pattern, host string, ip net.IP, port string) bool {
+	if h, p, err := net.SplitHostPort(pattern); err == nil {
+		if p != port {
+			return false
+		}
+		pattern = h
+	}
+	if _, block, err := net.ParseCIDR(pattern); err == nil {
+		return block.Contains(ip)
+	}
+	if patternIP := net.ParseIP(strings.Trim(pattern, "[]")); patternIP != nil {
+		return patternIP.Equal(ip)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+strings.ToLower(suffix))
+	}
+	return strings.EqualFold(pattern, host)
+}
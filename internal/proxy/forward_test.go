@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/client"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+func startForward(t *testing.T, p *ForwardProxy) string {
+	t.Helper()
+	s, err := server.Serve(0, p.Handle, server.WithTunneling())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s.Listener.Addr().String()
+}
+
+func TestForwardAbsoluteForm(t *testing.T) {
+	seen := make(chan *request.Request, 1)
+	upstream := serve(t, func(w *response.Writer, r *request.Request) {
+		seen <- r
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(2))
+		_, _ = w.WriteBody([]byte("ok"))
+	})
+	addr := startForward(t, NewForward())
+
+	req := request.New("GET", "http://"+upstream+"/path?q=1", nil)
+	req.Headers.Set("host", "ignored.example")
+	req.Headers.Set("proxy-connection", "keep-alive")
+	status, body := fetch(t, addr, req)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "ok", body)
+
+	up := <-seen
+	assert.Equal(t, "/path?q=1", up.RequestLine.Target)
+	assert.Equal(t, upstream, up.Headers.Get("host"))
+	assert.Equal(t, "", up.Headers.Get("proxy-connection"))
+}
+
+func TestForwardRejectsOriginForm(t *testing.T) {
+	addr := startForward(t, NewForward())
+	status, _ := fetch(t, addr, request.New("GET", "/", nil))
+	assert.Equal(t, 400, status)
+}
+
+func TestForwardAuth(t *testing.T) {
+	upstream := named(t, "secret")
+	p := NewForward()
+	p.Username = "dev"
+	p.Password = "hunter2"
+	addr := startForward(t, p)
+
+	res, err := client.Do(addr, request.New("GET", "http://"+upstream+"/", nil))
+	require.NoError(t, err)
+	assert.Equal(t, 407, res.StatusCode)
+	assert.Equal(t, `Basic realm="proxy"`, res.Headers.Get("proxy-authenticate"))
+	require.NoError(t, res.Body.Close())
+
+	req := request.New("GET", "http://"+upstream+"/", nil)
+	req.Headers.Set("proxy-authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("dev:wrong")))
+	status, _ := fetch(t, addr, req)
+	assert.Equal(t, 407, status)
+
+	req = request.New("GET", "http://"+upstream+"/", nil)
+	req.Headers.Set("proxy-authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("dev:hunter2")))
+	status, body := fetch(t, addr, req)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "secret", body)
+}
+
+func TestForwardDestinationLists(t *testing.T) {
+	upstream := named(t, "up")
+	_, port, err := net.SplitHostPort(upstream)
+	require.NoError(t, err)
+
+	p := NewForward()
+	p.Allow = []string{"127.0.0.0/8", "*.example.com"}
+	p.Deny = []string{"127.0.0.2"}
+	addr := startForward(t, p)
+
+	status, _ := fetch(t, addr, request.New("GET", "http://127.0.0.1:"+port+"/", nil))
+	assert.Equal(t, 200, status)
+	status, _ = fetch(t, addr, request.New("GET", "http://127.0.0.2:"+port+"/", nil))
+	assert.Equal(t, 403, status)
+	status, _ = fetch(t, addr, request.New("CONNECT", "10.0.0.1:443", nil))
+	assert.Equal(t, 403, status)
+}
+
+func TestForwardChecksResolvedAddresses(t *testing.T) {
+	upstream := named(t, "up")
+	_, port, err := net.SplitHostPort(upstream)
+	require.NoError(t, err)
+
+	p := NewForward()
+	p.Deny = []string{"127.0.0.0/8"}
+	addr := startForward(t, p)
+
+	// localhost is refused for the address it resolves to, not let
+	// through for its name
+	status, _ := fetch(t, addr, request.New("GET", "http://localhost:"+port+"/", nil))
+	assert.Equal(t, 403, status)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = io.WriteString(conn, "CONNECT localhost:"+port+" HTTP/1.1\r\nHost: localhost:"+port+"\r\n\r\n")
+	require.NoError(t, err)
+	res, err := response.NewReader(conn).ReadResponse("CONNECT")
+	require.NoError(t, err)
+	assert.Equal(t, response.Forbidden, res.StatusLine.StatusCode)
+}
+
+func TestMatchDestination(t *testing.T) {
+	tests := []struct {
+		pattern, host, port string
+		// ip is the address host resolved to, host itself if empty
+		ip   string
+		want bool
+	}{
+		{"example.com", "example.com", "80", "", true},
+		{"example.com", "EXAMPLE.com.", "443", "", true},
+		{"example.com", "www.example.com", "80", "", false},
+		{"*.example.com", "www.example.com", "80", "", true},
+		{"*.example.com", "example.com", "80", "", false},
+		{"example.com:443", "example.com", "443", "", true},
+		{"example.com:443", "example.com", "80", "", false},
+		{"10.0.0.0/8", "10.1.2.3", "80", "", true},
+		{"10.0.0.0/8", "11.1.2.3", "80", "", false},
+		{"10.0.0.0/8:22", "10.1.2.3", "80", "", false},
+		{"::1", "::1", "80", "", true},
+		{"[::1]:8080", "::1", "8080", "", true},
+		{"10.0.0.0/8", "internal.example", "80", "10.1.2.3", true},
+		{"127.0.0.1", "localhost", "80", "127.0.0.1", true},
+		{"localhost", "localhost", "80", "127.0.0.1", true},
+	}
+	for _, tt := range tests {
+		ip := tt.ip
+		if ip == "" {
+			ip = tt.host
+		}
+		assert.Equal(t, tt.want, matchDestination(tt.pattern, tt.host, net.ParseIP(ip), tt.port), "%s %s:%s", tt.pattern, tt.host, tt.port)
+	}
+}
+
+func TestConnectThroughForwardProxy(t *testing.T) {
+	upstream := named(t, "tunnelled")
+	conn, err := net.Dial("tcp", startForward(t, NewForward()))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	_, err = io.WriteString(conn, "CONNECT "+upstream+" HTTP/1.1\r\nHost: "+upstream+"\r\n\r\n")
+	require.NoError(t, err)
+	rd := response.NewReader(conn)
+	res, err := rd.ReadResponse("CONNECT")
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, res.StatusLine.StatusCode)
+
+	// the rest of the connection goes straight to the upstream
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+upstream+"\r\n\r\n")
+	require.NoError(t, err)
+	res, err = rd.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, "tunnelled", string(res.Body))
+}
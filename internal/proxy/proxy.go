@@ -0,0 +1,240 @@
+// Package proxy - to forward requests to another server and relay its responses
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/client"
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/requestid"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+	"github.com/k4rldoherty/http-from-tcp/internal/tracing"
+)
+
+// hopByHop are the headers that describe a single connection rather than
+// the message, so they aren't passed on (RFC 9110 section 7.6.1)
+var hopByHop = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type ReverseProxy struct {
+	// Upstream is the host:port of the server requests are forwarded to
+	Upstream string
+	// Prefix is stripped from the request target before it is
+	// forwarded, e.g. "/api"
+	Prefix string
+	// RewriteHost sends the upstream's address as the Host header instead
+	// of the one the client sent, for upstreams that serve more than one site
+	RewriteHost bool
+	// Pool, when set, picks the upstream for each request in place of
+	// Upstream, see balancer.go
+	Pool *Pool
+	// Client sends the requests upstream, client.DefaultClient if nil.
+	// One made with client.NewTLS reaches an https upstream.
+	Client *client.Client
+}
+
+func New(upstream string) *ReverseProxy {
+	return &ReverseProxy{Upstream: upstream}
+}
+
+// Handle is a server.Handler forwarding the request to the upstream and
+// relaying its response, streaming the bodies both ways.
+func (p *ReverseProxy) Handle(w *response.Writer, r *request.Request) {
+	if p.Pool != nil {
+		p.handlePooled(w, r)
+		return
+	}
+	res, err := p.send(r, p.Upstream)
+	if err != nil {
+		w.Logger.Warn("error reaching upstream", "upstream", p.Upstream, "err", err)
+		badGateway(w)
+		return
+	}
+	defer closeBody(w.Logger, res)
+	relay(w, r, res)
+}
+
+// send forwards r to the upstream at addr. If r is being traced, it goes
+// in a client span, covering the wait for the response head, whose trace
+// context is sent along so the upstream's spans join the trace.
+func (p *ReverseProxy) send(r *request.Request, addr string) (*client.Response, error) {
+	ctx, span := tracing.Start(r.Context(), r.RequestLine.Method, tracing.Client)
+	defer span.End()
+	span.SetAttribute("http.request.method", r.RequestLine.Method)
+	span.SetAttribute("server.address", addr)
+
+	out := p.outgoing(r, addr)
+	out.SetContext(ctx)
+	tracing.Inject(ctx, out.Headers)
+	c := p.Client
+	if c == nil {
+		c = client.DefaultClient
+	}
+	res, err := c.Do(addr, out)
+	if err != nil {
+		span.SetStatus(tracing.StatusError, err.Error())
+		return nil, err
+	}
+	span.SetAttribute("http.response.status_code", res.StatusCode)
+	if res.StatusCode >= 400 {
+		span.SetStatus(tracing.StatusError, fmt.Sprintf("status %d", res.StatusCode))
+	}
+	return res, nil
+}
+
+// outgoing makes the request sent to the upstream at addr from the one
+// the client sent.
+func (p *ReverseProxy) outgoing(r *request.Request, addr string) *request.Request {
+	target := r.RequestLine.Target
+	if p.Prefix != "" {
+		target = strings.TrimPrefix(target, strings.TrimSuffix(p.Prefix, "/"))
+		if !strings.HasPrefix(target, "/") {
+			target = "/" + target
+		}
+	}
+	out := request.New(r.RequestLine.Method, target, r.BodyReader())
+	for k, v := range r.Headers {
+		out.Headers.Set(k, v)
+	}
+	removeHopByHop(out.Headers)
+	// the body is sent straight away, there's no waiting on a 100 Continue
+	out.Headers.Delete("Expect")
+	if r.Headers.HasToken("transfer-encoding", "chunked") {
+		// re-encoded as it streams, with the client's trailers at the end
+		out.Headers.Delete("Content-Length")
+		out.Headers.Set("transfer-encoding", "chunked")
+		out.Trailers = r.Trailers
+	}
+	if p.RewriteHost {
+		out.Headers.Delete("Host")
+		out.Headers.Set("host", addr)
+	}
+	// the upstream logs the request under the same ID
+	if id := requestid.FromContext(r.Context()); id != "" {
+		out.Headers.Delete(requestid.Header)
+		out.Headers.Set("x-request-id", id)
+	}
+
+	if ip := clientIP(r.RemoteAddr); ip != "" {
+		appendValue(out.Headers, "x-forwarded-for", ip)
+		appendValue(out.Headers, "forwarded", forwarded(ip, r.Headers.Get("host")))
+	}
+	return out
+}
+
+// relay writes the upstream response to the client. A body without a
+// Content-Length is passed on chunked, followed by the upstream trailers.
+func relay(w *response.Writer, r *request.Request, res *client.Response) {
+	h := headers.NewHeaders()
+	for k, v := range res.Headers {
+		h.Set(k, v)
+	}
+	removeHopByHop(h)
+	// the client is told the proxy's request ID, which the upstream
+	// was sent
+	if requestid.FromContext(r.Context()) != "" {
+		h.Delete(requestid.Header)
+	}
+	bodyless := r.RequestLine.Method == "HEAD" || res.StatusCode < 200 || res.StatusCode == 204 || res.StatusCode == 304
+	streamed := !bodyless && h.Get("Content-Length") == ""
+	if streamed {
+		h.Set("Transfer-Encoding", "chunked")
+	}
+
+	if err := w.WriteStatusLine(response.StatusCode(res.StatusCode)); err != nil {
+		w.Logger.Warn("error writing status line", "err", err)
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		w.Logger.Warn("error writing headers", "err", err)
+		return
+	}
+	if bodyless {
+		return
+	}
+	if _, err := io.Copy(w, res.Body); err != nil {
+		w.Logger.Warn("error relaying body", "err", err)
+		return
+	}
+	if !streamed {
+		return
+	}
+	if err := w.WriteChunkedBodyDone(); err != nil {
+		w.Logger.Warn("error finishing body", "err", err)
+		return
+	}
+	if err := w.WriteTrailer(res.Trailers); err != nil {
+		w.Logger.Warn("error writing trailers", "err", err)
+	}
+}
+
+func badGateway(w *response.Writer) {
+	server.WriteError(w, &server.HandlerError{
+		Code:    int(response.BadGateway),
+		Message: "Bad Gateway",
+	}, "The upstream server could not be reached")
+}
+
+func closeBody(logger *slog.Logger, res *client.Response) {
+	if err := res.Body.Close(); err != nil {
+		logger.Warn("error closing upstream body", "err", err)
+	}
+}
+
+// removeHopByHop deletes the hop-by-hop headers from h, along with any
+// the Connection header names.
+func removeHopByHop(h headers.Headers) {
+	for _, name := range strings.Split(h.Get("Connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			h.Delete(name)
+		}
+	}
+	for _, name := range hopByHop {
+		h.Delete(name)
+	}
+}
+
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// forwarded makes a Forwarded element (RFC 7239) for a request from ip.
+func forwarded(ip, host string) string {
+	// IPv6 addresses have to be bracketed and quoted
+	if strings.Contains(ip, ":") {
+		ip = `"[` + ip + `]"`
+	}
+	element := "for=" + ip
+	if host != "" {
+		element += fmt.Sprintf(";host=%q", host)
+	}
+	return element + ";proto=http"
+}
+
+// appendValue adds v to the comma-separated list under key.
+func appendValue(h headers.Headers, key, v string) {
+	if prior := h.Get(key); prior != "" {
+		h.Delete(key)
+		h.Set(key, prior+", "+v)
+		return
+	}
+	h.Set(key, v)
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/client"
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+	"github.com/k4rldoherty/http-from-tcp/internal/tracing"
+)
+
+func serve(t *testing.T, handler server.Handler) string {
+	t.Helper()
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s.Listener.Addr().String()
+}
+
+// startProxy starts an upstream running handler and a proxy in front of
+// it, returning the proxy's address
+func startProxy(t *testing.T, handler server.Handler) string {
+	t.Helper()
+	return serve(t, New(serve(t, handler)).Handle)
+}
+
+func TestForwardsHeadersAndStatus(t *testing.T) {
+	seen := make(chan *request.Request, 1)
+	addr := startProxy(t, func(w *response.Writer, r *request.Request) {
+		seen <- r
+		_ = w.WriteStatusLine(response.NotFound)
+		h := response.GetDefaultHeaders(7)
+		h.Set("X-Upstream", "yes")
+		h.Set("Keep-Alive", "timeout=5")
+		_ = w.WriteHeaders(h)
+		_, _ = w.WriteBody([]byte("missing"))
+	})
+
+	req := request.New("GET", "/thing", nil)
+	req.Headers.Set("host", "public.example")
+	req.Headers.Set("x-forwarded-for", "10.0.0.1")
+	res, err := client.Do(addr, req)
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, "missing", string(body))
+	assert.Equal(t, "yes", res.Headers.Get("x-upstream"))
+	assert.Equal(t, "", res.Headers.Get("keep-alive"))
+
+	up := <-seen
+	assert.Equal(t, "/thing", up.RequestLine.Target)
+	assert.Equal(t, "public.example", up.Headers.Get("host"))
+	assert.Equal(t, "10.0.0.1, 127.0.0.1", up.Headers.Get("x-forwarded-for"))
+	assert.Equal(t, `for=127.0.0.1;host="public.example";proto=http`, up.Headers.Get("forwarded"))
+	// the upstream gets the proxy's request ID, which the client sees too
+	assert.NotEmpty(t, up.Headers.Get("x-request-id"))
+	assert.Equal(t, res.Headers.Get("x-request-id"), up.Headers.Get("x-request-id"))
+}
+
+func TestStripsConnectionHeaders(t *testing.T) {
+	seen := make(chan *request.Request, 1)
+	p := New(serve(t, func(w *response.Writer, r *request.Request) {
+		seen <- r
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(0))
+	}))
+	p.Prefix = "/api"
+	p.RewriteHost = true
+	addr := serve(t, p.Handle)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = io.WriteString(conn, "GET /api/users?id=1 HTTP/1.1\r\nHost: public.example\r\n"+
+		"Connection: keep-alive, X-Secret\r\nX-Secret: s\r\nTE: trailers\r\n\r\n")
+	require.NoError(t, err)
+
+	up := <-seen
+	assert.Equal(t, "/users?id=1", up.RequestLine.Target)
+	assert.Equal(t, p.Upstream, up.Headers.Get("host"))
+	assert.Equal(t, "", up.Headers.Get("x-secret"))
+	assert.Equal(t, "", up.Headers.Get("te"))
+}
+
+func TestStreamsChunkedBodiesAndTrailers(t *testing.T) {
+	addr := startProxy(t, func(w *response.Writer, r *request.Request) {
+		body, err := io.ReadAll(r.BodyReader())
+		require.NoError(t, err)
+		_ = w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Length")
+		_ = w.WriteHeaders(h)
+		_ = w.WriteChunkedBody([]byte(strings.ToUpper(string(body))))
+		_ = w.WriteChunkedBody([]byte("|" + r.Trailers.Get("x-sent")))
+		_ = w.WriteChunkedBodyDone()
+		_ = w.WriteTrailer(headers.Headers{"X-Length": strconv.Itoa(len(body))})
+	})
+
+	req := request.New("POST", "/echo", io.MultiReader(strings.NewReader("hello "), strings.NewReader("world")))
+	req.Trailers.Set("x-sent", "done")
+	res, err := client.Do(addr, req)
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, "chunked", res.Headers.Get("transfer-encoding"))
+	assert.Equal(t, "HELLO WORLD|done", string(body))
+	assert.Equal(t, "11", res.Trailers.Get("x-length"))
+}
+
+func TestRechunksCloseDelimitedBody(t *testing.T) {
+	addr := startProxy(t, func(w *response.Writer, r *request.Request) {
+		_ = w.WriteStatusLine(response.OK)
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/plain")
+		_ = w.WriteHeaders(h)
+		_, _ = io.WriteString(w, "no length")
+	})
+	res, err := client.Do(addr, request.New("GET", "/", nil))
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "chunked", res.Headers.Get("transfer-encoding"))
+	assert.Equal(t, "no length", string(body))
+}
+
+func TestBadGateway(t *testing.T) {
+	// nothing listens on port 1
+	addr := serve(t, New("localhost:1").Handle)
+	res, err := client.Do(addr, request.New("GET", "/", nil))
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, 502, res.StatusCode)
+}
+
+// spanRecorder keeps the spans a tracer exports
+type spanRecorder struct {
+	spans []*tracing.Span
+}
+
+func (e *spanRecorder) Export(spans []*tracing.Span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestPropagatesTraceContext(t *testing.T) {
+	seen := make(chan *request.Request, 1)
+	upstream := serve(t, func(w *response.Writer, r *request.Request) {
+		seen <- r
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	exp := &spanRecorder{}
+	tr := tracing.NewTracer(exp)
+	addr := serve(t, tr.Middleware(New(upstream).Handle))
+
+	req := request.New("GET", "/", nil)
+	req.Headers.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Headers.Set("tracestate", "rojo=1")
+	res, err := client.Do(addr, req)
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	up := <-seen
+	tr.Close()
+
+	// the proxy's server span and the client span it sent the request in
+	require.Len(t, exp.spans, 2)
+	out, in := exp.spans[0], exp.spans[1]
+	assert.Equal(t, tracing.Client, out.Kind)
+	assert.Equal(t, in.Context.SpanID, out.Parent.SpanID)
+	assert.Equal(t, "00f067aa0ba902b7", in.Parent.SpanID.String())
+	assert.Equal(t, int64(200), out.Attribute("http.response.status_code"))
+
+	// the upstream continues the trace from the client span
+	sc, ok := tracing.Extract(up.Headers)
+	require.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, out.Context.SpanID, sc.SpanID)
+	assert.Equal(t, "rojo=1", sc.State)
+}
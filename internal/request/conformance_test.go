@@ -0,0 +1,301 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// conformance holds requests from, or built on, the examples and rules of
+// RFC 9112, with whether each parsing mode accepts them and what a request
+// that is accepted parses to. Section numbers are RFC 9112's unless
+// stated otherwise.
+var conformance = []struct {
+	name string
+	raw  string
+	// lenient and strict are whether a Reader accepts the request
+	// without and with Strict set
+	lenient, strict bool
+	line            RequestLine
+	headers         map[string]string
+	body            string
+	trailers        map[string]string
+}{
+	{
+		name:    "origin-form (3.2.1)",
+		raw:     "GET /where?q=now HTTP/1.1\r\nHost: www.example.org\r\n\r\n",
+		lenient: true, strict: true,
+		line:    RequestLine{"GET", "/where?q=now", "1.1"},
+		headers: map[string]string{"host": "www.example.org"},
+	},
+	{
+		name:    "absolute-form (3.2.2)",
+		raw:     "GET http://www.example.org/pub/WWW/TheProject.html HTTP/1.1\r\nHost: www.example.org\r\n\r\n",
+		lenient: true, strict: true,
+		line: RequestLine{"GET", "http://www.example.org/pub/WWW/TheProject.html", "1.1"},
+	},
+	{
+		name:    "authority-form (3.2.3)",
+		raw:     "CONNECT www.example.com:80 HTTP/1.1\r\nHost: www.example.com\r\n\r\n",
+		lenient: true, strict: true,
+		line: RequestLine{"CONNECT", "www.example.com:80", "1.1"},
+	},
+	{
+		name:    "asterisk-form (3.2.4)",
+		raw:     "OPTIONS * HTTP/1.1\r\nHost: www.example.org:8001\r\n\r\n",
+		lenient: true, strict: true,
+		line: RequestLine{"OPTIONS", "*", "1.1"},
+	},
+	{
+		name:    "field values trimmed (5.1)",
+		raw:     "GET / HTTP/1.1\r\nHost: a\r\nUser-Agent: \t curl/7.64.1 \t\r\nAccept-Language: en, mi\r\n\r\n",
+		lenient: true, strict: true,
+		line:    RequestLine{"GET", "/", "1.1"},
+		headers: map[string]string{"user-agent": "curl/7.64.1", "accept-language": "en, mi"},
+	},
+	{
+		name:    "HTTP/1.0 without Host (3.2)",
+		raw:     "GET / HTTP/1.0\r\n\r\n",
+		lenient: true, strict: true,
+		line: RequestLine{"GET", "/", "1.0"},
+	},
+	{
+		name:    "HTTP/1.1 without Host (3.2)",
+		raw:     "GET / HTTP/1.1\r\n\r\n",
+		lenient: true, strict: false,
+		line: RequestLine{"GET", "/", "1.1"},
+	},
+	{
+		name:    "several Host fields (3.2)",
+		raw:     "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n",
+		lenient: true, strict: false,
+		line:    RequestLine{"GET", "/", "1.1"},
+		headers: map[string]string{"host": "a, b"},
+	},
+	{
+		name:    "unsupported version (2.3)",
+		raw:     "GET / HTTP/2.0\r\nHost: a\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "version is case-sensitive (2.3)",
+		raw:     "GET / http/1.1\r\nHost: a\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "extra space in request line (3)",
+		raw:     "GET  / HTTP/1.1\r\nHost: a\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "method not a token (3.1)",
+		raw:     "GET<junk> / HTTP/1.1\r\nHost: a\r\n\r\n",
+		lenient: true, strict: false,
+		line: RequestLine{"GET<junk>", "/", "1.1"},
+	},
+	{
+		name:    "control character in target (3.2)",
+		raw:     "GET /a\x01b HTTP/1.1\r\nHost: a\r\n\r\n",
+		lenient: true, strict: false,
+		line: RequestLine{"GET", "/a\x01b", "1.1"},
+	},
+	{
+		name:    "bare LF ending the request line (2.2)",
+		raw:     "GET / HTTP/1.1\nHost: a\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "bare LF in a field line (2.2)",
+		raw:     "GET / HTTP/1.1\r\nHost: a\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "bare CR in a field line (2.2)",
+		raw:     "GET / HTTP/1.1\r\nHost: a\rb\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "NUL in a field value (RFC 9110 5.5)",
+		raw:     "GET / HTTP/1.1\r\nHost: a\x00b\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "whitespace before the first field (2.2)",
+		raw:     "GET / HTTP/1.1\r\n Host: a\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "whitespace before colon (5.1)",
+		raw:     "GET / HTTP/1.1\r\nHost : a\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "obs-fold (5.2)",
+		raw:     "GET / HTTP/1.1\r\nHost: a\r\nX-Long: one\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "field name not a token (5.1)",
+		raw:     "GET / HTTP/1.1\r\nHost: a\r\nHéader: 1\r\n\r\n",
+		lenient: true, strict: false,
+		line:    RequestLine{"GET", "/", "1.1"},
+		headers: map[string]string{"héader": "1"},
+	},
+	{
+		name:    "Content-Length (6.2)",
+		raw:     "POST /submit HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello",
+		lenient: true, strict: true,
+		line: RequestLine{"POST", "/submit", "1.1"},
+		body: "hello",
+	},
+	{
+		name:    "no framing means no body (6.3)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\n\r\n",
+		lenient: true, strict: true,
+		line: RequestLine{"POST", "/", "1.1"},
+	},
+	{
+		name:    "repeated identical Content-Length (6.3)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+		lenient: false, strict: true,
+		line: RequestLine{"POST", "/", "1.1"},
+		body: "hello",
+	},
+	{
+		name:    "differing Content-Length (6.3)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "negative Content-Length (6.3)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -5\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "signed Content-Length (8.6 of RFC 9110)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "Content-Length too big to represent (6.3)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999999999999999999\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "body shorter than Content-Length (8)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\n\r\nhello",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "chunked (7.1)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nWiki\r\n5\r\npedia\r\nE\r\n in\r\n\r\nchunks.\r\n0\r\n\r\n",
+		lenient: true, strict: true,
+		line: RequestLine{"POST", "/", "1.1"},
+		body: "Wikipedia in\r\n\r\nchunks.",
+	},
+	{
+		name:    "chunk extensions (7.1.1)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;name=value;flag\r\nhello\r\n0;last\r\n\r\n",
+		lenient: true, strict: true,
+		line: RequestLine{"POST", "/", "1.1"},
+		body: "hello",
+	},
+	{
+		name:    "chunk extension with a bare LF (7.1.1)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;a\nX\r\nhello\r\n0\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "chunk extension with a quoted value (7.1.1)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;name=\"a; b\"\r\nhello\r\n0\r\n\r\n",
+		lenient: true, strict: true,
+		line: RequestLine{"POST", "/", "1.1"},
+		body: "hello",
+	},
+	{
+		name:    "trailer section (7.1.2)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTrailer: Expires\r\n\r\n5\r\nhello\r\n0\r\nExpires: Wed, 21 Oct 2015 07:28:00 GMT\r\n\r\n",
+		lenient: true, strict: true,
+		line:     RequestLine{"POST", "/", "1.1"},
+		body:     "hello",
+		trailers: map[string]string{"expires": "Wed, 21 Oct 2015 07:28:00 GMT"},
+	},
+	{
+		name:    "chunk size too big to represent (7.1)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n10000000000000000\r\nabc\r\n0\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "chunk size not hex (7.1)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0x5\r\nhello\r\n0\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "chunk data longer than its size (7.1)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello!\r\n0\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "chunked body without last chunk (7.1)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "chunked not the last coding (6.3)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, gzip\r\n\r\n0\r\n\r\n",
+		lenient: false, strict: false,
+	},
+	{
+		name:    "coding before chunked (6.1)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n",
+		lenient: true, strict: false,
+		line: RequestLine{"POST", "/", "1.1"},
+	},
+	{
+		name:    "Transfer-Encoding and Content-Length (6.3)",
+		raw:     "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		lenient: true, strict: false,
+		line: RequestLine{"POST", "/", "1.1"},
+		body: "hello",
+	},
+	{
+		name:    "Transfer-Encoding in HTTP/1.0 (6.1)",
+		raw:     "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		lenient: true, strict: false,
+		line: RequestLine{"POST", "/", "1.0"},
+		body: "hello",
+	},
+}
+
+func TestConformance(t *testing.T) {
+	for _, c := range conformance {
+		for _, strict := range []bool{false, true} {
+			accept := c.lenient
+			name := c.name + "/lenient"
+			if strict {
+				accept, name = c.strict, c.name+"/strict"
+			}
+			t.Run(name, func(t *testing.T) {
+				rd := NewReader(&chunkReader{data: c.raw, numBytesPerRead: 3})
+				rd.Strict = strict
+				r, err := rd.ReadRequest()
+				if !accept {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, c.line, r.RequestLine)
+				for k, v := range c.headers {
+					assert.Equal(t, v, r.Headers.Get(k), k)
+				}
+				assert.Equal(t, c.body, string(r.Body))
+				for k, v := range c.trailers {
+					assert.Equal(t, v, r.Trailers.Get(k), k)
+				}
+				// nothing is left over to be read as another request
+				assert.Empty(t, rd.Buffered())
+			})
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package request
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrUnsupportedEncoding is returned for a body in a content coding that
+// can't be decoded. Servers answer it with 415 Unsupported Media Type.
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// ErrBodyTooLarge is returned once a decoded body grows past the limit,
+// which stops small compressed bodies from expanding without bound.
+var ErrBodyTooLarge = errors.New("decoded body too large")
+
+// ErrUnsupportedExpectation is reported for an Expect other than
+// 100-continue. Servers answer it with 417 Expectation Failed.
+var ErrUnsupportedExpectation = errors.New("unsupported expectation")
+
+// DefaultMaxDecodedSize is the limit on a decoded body when none is set
+const DefaultMaxDecodedSize = 10 << 20
+
+// prepareDecoding records the Content-Encoding to undo on the body and
+// drops the headers that describe the encoded bytes.
+func (r *Request) prepareDecoding(maxSize int64) error {
+	ce := r.Headers.Get("content-encoding")
+	if ce == "" {
+		return nil
+	}
+	codings := []string{}
+	for _, c := range strings.Split(ce, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		switch c {
+		case "identity", "":
+		case "gzip", "x-gzip", "deflate":
+			codings = append(codings, c)
+		default:
+			return fmt.Errorf("%w: %s", ErrUnsupportedEncoding, c)
+		}
+	}
+	r.codings = codings
+	r.maxDecoded = maxSize
+	r.Headers.Delete("content-encoding")
+	r.Headers.Delete("content-length")
+	return nil
+}
+
+// decodeBody replaces a fully read, encoded Body with its decoded bytes.
+func (r *Request) decodeBody() error {
+	if len(r.Body) == 0 {
+		r.codings = nil
+		return nil
+	}
+	decoded, err := io.ReadAll(newDecoder(bytes.NewReader(r.Body), r.codings, r.maxDecoded))
+	if err != nil {
+		return err
+	}
+	r.Body = decoded
+	r.codings = nil
+	return nil
+}
+
+// newDecoder undoes codings on src, the last one applied first.
+func newDecoder(src io.Reader, codings []string, maxSize int64) io.Reader {
+	for i := len(codings) - 1; i >= 0; i-- {
+		src = &lazyDecoder{src: src, coding: codings[i]}
+	}
+	// zero is the default limit, only a negative size lifts it
+	if maxSize == 0 {
+		maxSize = DefaultMaxDecodedSize
+	}
+	if maxSize > 0 {
+		src = &cappedReader{r: src, remaining: maxSize}
+	}
+	return src
+}
+
+// lazyDecoder creates its decompressor on the first Read, as gzip and zlib
+// readers read a header straight away and that would otherwise pull the
+// body off the connection before the handler asks for it.
+type lazyDecoder struct {
+	src    io.Reader
+	coding string
+	r      io.Reader
+}
+
+func (d *lazyDecoder) Read(p []byte) (int, error) {
+	if d.r == nil {
+		var err error
+		switch d.coding {
+		case "gzip", "x-gzip":
+			d.r, err = gzip.NewReader(d.src)
+		case "deflate":
+			d.r, err = zlib.NewReader(d.src)
+		default:
+			err = fmt.Errorf("%w: %s", ErrUnsupportedEncoding, d.coding)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	return d.r.Read(p)
+}
+
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// read one byte past the limit to tell a body
+	// that fits exactly from one that is too large
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if c.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,83 @@
+package request
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// fuzzCorpus seeds the request fuzz target with valid messages and ones
+// known to trip up parsers: smuggling vectors, obsolete line folding,
+// numbers too big for their type, null bytes and CRLFs split across reads.
+var fuzzCorpus = []string{
+	"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+	"GET /path?q=1 HTTP/1.0\r\n\r\n",
+	"POST /submit HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello",
+	"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTrailer: x-sum\r\n\r\n3;ext=1\r\nabc\r\n0\r\nX-Sum: 9\r\n\r\n",
+	"GET / HTTP/1.1\r\nHost: a\r\n\r\nGET /second HTTP/1.1\r\nHost: a\r\n\r\n",
+	// smuggling
+	"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /admin HTTP/1.1\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!",
+	"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -5\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello",
+	"GET / HTTP/1.1\r\nHost: a\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	// obs-fold
+	"GET / HTTP/1.1\r\nHost: a\r\nX-Folded: one\r\n two\r\n\r\n",
+	"GET / HTTP/1.1\r\nX-Long: a\r\n Transfer-Encoding: chunked\r\nHost: a\r\n\r\n0\r\n\r\n",
+	// huge numbers
+	"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999999999999999999\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nFFFFFFFFFFFFFFF\r\nabc",
+	"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n10000000000000000\r\nabc\r\n0\r\n\r\n",
+	// null bytes
+	"GET /\x00 HTTP/1.1\r\nHost: a\r\n\r\n",
+	"GET / HTTP/1.1\r\nHost: a\x00b\r\n\r\n",
+	"GET\x00 / HTTP/1.1\r\nHost: a\r\n\r\n",
+	// split and bare CRLFs
+	"GET / HTTP/1.1\r\r\nHost: a\r\n\r\n",
+	"GET / HTTP/1.1\nHost: a\n\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\n0\r\n\r\n",
+	"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n",
+}
+
+func FuzzRequestFromReader(f *testing.F) {
+	for _, raw := range fuzzCorpus {
+		f.Add([]byte(raw), uint8(1), false)
+		f.Add([]byte(raw), uint8(7), true)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, readSize uint8, strict bool) {
+		n := int(readSize%16) + 1
+		_, _ = RequestFromReader(&chunkReader{data: string(data), numBytesPerRead: n})
+
+		// reads can split the message anywhere without changing
+		// how it is framed
+		split := NewReader(&chunkReader{data: string(data), numBytesPerRead: n})
+		split.Strict = strict
+		r, err := split.ReadRequest()
+		whole := NewReader(bytes.NewReader(data))
+		whole.Strict = strict
+		want, wantErr := whole.ReadRequest()
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("read %d bytes at a time got error %v, all at once got %v", n, err, wantErr)
+		}
+		if err != nil {
+			return
+		}
+		if r.RequestLine != want.RequestLine || !bytes.Equal(r.Body, want.Body) {
+			t.Fatalf("read %d bytes at a time got %+v %q, all at once got %+v %q",
+				n, r.RequestLine, r.Body, want.RequestLine, want.Body)
+		}
+		if r.State != Done {
+			t.Fatalf("request read in state %d", r.State)
+		}
+		// a body framed by its length is exactly that long
+		if cl := r.Headers.Get("content-length"); cl != "" && r.chunks == nil && strict {
+			length, err := strconv.Atoi(cl)
+			if err == nil && length != len(r.Body) {
+				t.Fatalf("Content-Length %d but read %d bytes", length, len(r.Body))
+			}
+		}
+	})
+}
@@ -2,6 +2,8 @@
 package request
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/k4rldoherty/http-from-tcp/internal/chunked"
 	"github.com/k4rldoherty/http-from-tcp/internal/headers"
 )
 
@@ -27,7 +30,33 @@ type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
 	Body        []byte
-	State       ParserState
+	// Trailers holds the trailer fields of a chunked body
+	Trailers headers.Headers
+	State    ParserState
+	// RemoteAddr is the address of the client that sent the request,
+	// set by the server
+	RemoteAddr string
+	// bodyLen is the number of body bytes parsed so far
+	bodyLen int
+	// headLen is the size of the request line and headers parsed so far
+	headLen int
+	// contentLength is the declared body length,
+	// or -1 when the body is chunked or absent
+	contentLength int
+	chunks        *chunked.Decoder
+	strict        bool
+	// rd is the connection the rest of the body is read from,
+	// nil once the body has been read
+	rd           *Reader
+	continueSent bool
+	// codings are the content codings still to be undone on the body,
+	// outermost last, see decode.go
+	codings    []string
+	maxDecoded int64
+	decoded    io.Reader
+	// src is the body of a request made with New
+	src io.Reader
+	ctx context.Context
 }
 
 type RequestLine struct {
@@ -39,10 +68,14 @@ type RequestLine struct {
 func (r *Request) Parse(data []byte, hitEOF bool) (int, error) {
 	totalBytesParsed := 0
 	for r.State != Done {
+		head := r.State < ParsingBody
 		n, err := r.parseSingle(data[totalBytesParsed:], hitEOF)
 		if err != nil {
 			return 0, err
 		}
+		if head {
+			r.headLen += n
+		}
 		totalBytesParsed += n
 		if n == 0 {
 			break
@@ -54,6 +87,11 @@ func (r *Request) Parse(data []byte, hitEOF bool) (int, error) {
 func (r *Request) parseSingle(data []byte, hitEOF bool) (int, error) {
 	switch r.State {
 	case Initialized:
+		if r.strict {
+			if err := validateLine(data); err != nil {
+				return 0, err
+			}
+		}
 		bytes, rl, err := parseRequestLine(string(data))
 		if err != nil {
 			return 0, err
@@ -61,40 +99,56 @@ func (r *Request) parseSingle(data []byte, hitEOF bool) (int, error) {
 		if bytes == 0 {
 			return 0, nil
 		}
+		if r.strict {
+			if err := validateRequestLine(rl); err != nil {
+				return 0, err
+			}
+		}
 		r.RequestLine = *rl
 		r.State = ParsingHeaders
 		return bytes, nil
 	case ParsingHeaders:
+		// a line starting with whitespace continues the one before it
+		// (obs-fold), which a proxy may have read as part of that field
+		// rather than as a field of its own (RFC 9112 section 5.2)
+		if len(data) > 0 && (data[0] == ' ' || data[0] == '\t') {
+			return 0, errors.New("obsolete line folding in header field")
+		}
+		if r.strict {
+			if err := r.validateFieldLine(data); err != nil {
+				return 0, err
+			}
+		}
 		n, done, err := r.Headers.Parse(data)
 		if err != nil {
 			return 0, err
 		}
 		if done {
+			if err := r.prepareBody(); err != nil {
+				return 0, err
+			}
 			r.State = ParsingBody
 		}
 		return n, nil
 	case ParsingBody:
-		cl := r.Headers.Get("content-length")
-		if cl == "" {
+		if r.chunks != nil {
+			return r.parseChunk(data, hitEOF)
+		}
+		if r.contentLength == -1 {
 			r.State = Done
 			return 0, nil
 		}
-		i, err := strconv.Atoi(cl)
-		if err != nil {
-			return 0, err
-		}
-		r.Body = append(r.Body, data...)
-		bodyLen := len(r.Body)
-		if bodyLen == i {
+		// anything past the content length
+		// belongs to the next request on the connection
+		n := min(len(data), r.contentLength-r.bodyLen)
+		r.Body = append(r.Body, data[:n]...)
+		r.bodyLen += n
+		if r.bodyLen == r.contentLength {
 			r.State = Done
-		} else if bodyLen > i {
-			return 0, errors.New("body longer than content length")
-		} else {
-			if hitEOF {
-				return 0, errors.New("body shorter than content length")
-			}
+		} else if hitEOF {
+			return 0, errors.New("body shorter than content length")
 		}
-		return len(data), nil
+		return n, nil
 	case Done:
 		return 0, errors.New("parse function called in Done state")
 	default:
@@ -102,60 +156,237 @@ func (r *Request) parseSingle(data []byte, hitEOF bool) (int, error) {
 	}
 }
 
-func RequestFromReader(r io.Reader) (*Request, error) {
+// prepareBody works out how the body is delimited once the headers are in.
+// A chunked Transfer-Encoding takes precedence over a Content-Length.
+func (r *Request) prepareBody() error {
+	if r.strict {
+		if err := r.validateHeaders(); err != nil {
+			return err
+		}
+	}
+	r.contentLength = -1
+	if te := r.Headers.Get("transfer-encoding"); te != "" {
+		// without chunked last nothing marks where the body ends
+		// (RFC 9112 section 6.3)
+		codings := strings.Split(te, ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return fmt.Errorf("transfer encoding doesn't end in chunked: %s", te)
+		}
+		r.chunks = chunked.NewDecoder()
+		r.Trailers = r.chunks.Trailers
+		return nil
+	}
+	// an empty Content-Length is invalid, not missing
+	cl, ok := r.Headers["content-length"]
+	if !ok {
+		return nil
+	}
+	if r.strict {
+		var err error
+		r.contentLength, err = parseContentLength(cl)
+		return err
+	}
+	// unlike Atoi, ParseUint takes no sign,
+	// so "-1" can't make the length negative
+	length, err := strconv.ParseUint(cl, 10, strconv.IntSize-1)
+	if err != nil {
+		return fmt.Errorf("invalid content length: %s", cl)
+	}
+	r.contentLength = int(length)
+	return nil
+}
+
+func (r *Request) parseChunk(data []byte, hitEOF bool) (int, error) {
+	n, chunk, err := r.chunks.Parse(data)
+	if err != nil {
+		return 0, err
+	}
+	r.Body = append(r.Body, chunk...)
+	r.bodyLen += len(chunk)
+	if r.chunks.State == chunked.Done {
+		r.State = Done
+	} else if n == 0 && hitEOF {
+		return 0, errors.New("chunked body ended early")
+	}
+	return n, nil
+}
+
+// Reader reads successive requests from a single connection. Bytes read
+// past the end of one request are kept in the buffer for the next.
+type Reader struct {
+	src io.Reader
 	// buffer to read data into
-	buf := make([]byte, BUFFERSIZE)
+	buf []byte
 	// how much data we have read
 	// from the reader into the buffer
-	readToIndex := 0
+	readToIndex int
+	hitEOF      bool
+	// Strict rejects requests that RFC 9112 allows a server to refuse and
+	// that intermediaries might frame differently, see validate.go
+	Strict bool
+	// DecodeBodies undoes a gzip or deflate Content-Encoding on request
+	// bodies, so handlers see the bytes the client compressed. Decoded
+	// bodies larger than MaxDecodedSize fail with ErrBodyTooLarge. Zero
+	// means DefaultMaxDecodedSize and a negative size means no limit.
+	DecodeBodies   bool
+	MaxDecodedSize int64
+	// SendContinue writes a 100 Continue response. It is called the first
+	// time a body is read from the connection for a request that sent
+	// "Expect: 100-continue".
+	SendContinue func() error
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		src: r,
+		buf: make([]byte, BUFFERSIZE),
+	}
+}
+
+func RequestFromReader(r io.Reader) (*Request, error) {
+	rd := NewReader(r)
+	request, err := rd.ReadRequest()
+	if err != nil {
+		return nil, err
+	}
+	// a lone request owns everything that was sent, so all of it is read
+	// before looking for data past the end of its body, however the
+	// reads happened to split it
+	extra := int64(rd.readToIndex)
+	if !rd.hitEOF {
+		n, err := io.Copy(io.Discard, rd.src)
+		if err != nil {
+			return nil, err
+		}
+		extra += n
+	}
+	if extra > 0 && request.bodyLen > 0 {
+		return nil, errors.New("body longer than content length")
+	}
+	return request, nil
+}
+
+// ReadRequest parses the next request from the connection, including its
+// body. It returns io.EOF if the connection was closed before any part of
+// a request arrived.
+func (rd *Reader) ReadRequest() (*Request, error) {
+	request, err := rd.ReadRequestHead()
+	if err != nil {
+		return nil, err
+	}
+	if err := request.ReadBody(); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// ReadRequestHead parses the request line and headers of the next request,
+// leaving the body on the connection to be read through the request's
+// BodyReader or ReadBody.
+func (rd *Reader) ReadRequestHead() (*Request, error) {
 	// initialize request with state
 	// as initialized
 	request := Request{
 		State:   Initialized,
 		Headers: headers.NewHeaders(),
 		Body:    []byte{},
+		strict:  rd.Strict,
 	}
-	hitEOF := false
-	for request.State != Done {
-		// if the buffer is full
-		// create a new one twice the size and copy the data in
-		if readToIndex == len(buf) {
-			nb := make([]byte, len(buf)*2)
-			copy(nb, buf[:readToIndex])
-			buf = nb
-		}
-		// if end of file flag is false
-		// read into the buffer from the prev readToIndex
-		// check if EOF
-		// and if not increase readToIndex by the bytes read into the buffer
-		if !hitEOF {
-			n, err := r.Read(buf[readToIndex:])
-			if errors.Is(err, io.EOF) {
-				hitEOF = true
-			} else if err != nil {
-				return nil, err
-			} else if n > 0 {
-				readToIndex += n
-			}
-		}
-		// read from r into buffer starting at readToIndex
-		// parse read in bytes
-		consumed, err := request.Parse(buf[:readToIndex], hitEOF)
-		if err != nil {
+	for request.State < ParsingBody {
+		if err := rd.step(&request); err != nil {
 			return nil, err
 		}
-		// remove parsed data from buffer
-		if consumed > 0 {
-			copy(buf, buf[consumed:readToIndex])
-			// decrement readToIndex by the bytes parsed
-			readToIndex -= consumed
+	}
+	if request.State != Done {
+		request.rd = rd
+	}
+	if rd.DecodeBodies {
+		if err := request.prepareDecoding(rd.MaxDecodedSize); err != nil {
+			return nil, err
 		}
+	}
+	return &request, nil
+}
 
-		if hitEOF && readToIndex == 0 {
-			break
+// step parses whatever is already buffered into request, which may be left
+// over from the previous request, and reads more from the connection if
+// that made no progress.
+func (rd *Reader) step(request *Request) error {
+	consumed, err := request.Parse(rd.buf[:rd.readToIndex], rd.hitEOF)
+	if err != nil {
+		return err
+	}
+	if request.headTooLarge(rd.readToIndex - consumed) {
+		return headers.ErrHeadTooLarge
+	}
+	// remove parsed data from buffer
+	if consumed > 0 {
+		copy(rd.buf, rd.buf[consumed:rd.readToIndex])
+		// decrement readToIndex by the bytes parsed
+		rd.readToIndex -= consumed
+		return nil
+	}
+	if request.State == Done {
+		return nil
+	}
+	if rd.hitEOF {
+		if request.State == Initialized && rd.readToIndex == 0 {
+			return io.EOF
 		}
+		return io.ErrUnexpectedEOF
 	}
-	return &request, nil
+	// the client is waiting for permission before it sends the body
+	if request.State == ParsingBody {
+		if err := rd.Continue(request); err != nil {
+			return err
+		}
+	}
+	return rd.fill()
+}
+
+// headTooLarge reports whether the head of r, with the buffered bytes of
+// it still to parse, is over headers.MaxHeadSize.
+func (r *Request) headTooLarge(buffered int) bool {
+	if r.State >= ParsingBody {
+		return r.headLen > headers.MaxHeadSize
+	}
+	return r.headLen+buffered > headers.MaxHeadSize
+}
+
+// Buffered returns the bytes read from the connection past the last
+// request parsed, e.g. the start of a tunnel after a CONNECT request.
+func (rd *Reader) Buffered() []byte {
+	return rd.buf[:rd.readToIndex]
+}
+
+// Continue sends the interim 100 Continue response for a request that
+// asked for one, if it hasn't been sent yet. It does nothing when
+// SendContinue is nil.
+func (rd *Reader) Continue(r *Request) error {
+	if rd.SendContinue == nil || r.continueSent || !r.ExpectsContinue() {
+		return nil
+	}
+	r.continueSent = true
+	return rd.SendContinue()
+}
+
+// fill reads more data from the connection into the buffer,
+// growing it when it is full.
+func (rd *Reader) fill() error {
+	// if the buffer is full
+	// create a new one twice the size and copy the data in
+	if rd.readToIndex == len(rd.buf) {
+		nb := make([]byte, len(rd.buf)*2)
+		copy(nb, rd.buf[:rd.readToIndex])
+		rd.buf = nb
+	}
+	n, err := rd.src.Read(rd.buf[rd.readToIndex:])
+	rd.readToIndex += n
+	if errors.Is(err, io.EOF) {
+		rd.hitEOF = true
+		return nil
+	}
+	return err
 }
 
 func parseRequestLine(rl string) (int, *RequestLine, error) {
@@ -203,12 +434,120 @@ func parseTarget(target string) (string, error) {
 
 func parseVersion(version string) (string, error) {
 	vp := strings.Split(version, "/")
-	if len(vp) != 2 {
+	if len(vp) != 2 || vp[0] != "HTTP" {
 		return "", fmt.Errorf("invalid version format: %s", version)
 	}
 	v := vp[1]
-	if v != "1.1" {
-		return "", fmt.Errorf("invalid version: %s. http version 1.1 is supported", vp[1])
+	if v != "1.1" && v != "1.0" {
+		return "", fmt.Errorf("invalid version: %s. http versions 1.0 and 1.1 are supported", vp[1])
 	}
 	return vp[1], nil
 }
+
+// ReadBody reads the rest of the body from the connection into Body.
+// It does nothing for a request whose body has already been read.
+func (r *Request) ReadBody() error {
+	if r.rd != nil {
+		for r.State != Done {
+			if err := r.rd.step(r); err != nil {
+				return err
+			}
+		}
+		r.rd = nil
+	}
+	if len(r.codings) > 0 {
+		return r.decodeBody()
+	}
+	return nil
+}
+
+// BodyReader returns a reader over the request body. If the body is still
+// on the connection it is read as it is consumed, and bytes read through
+// the returned reader are removed from Body.
+func (r *Request) BodyReader() io.Reader {
+	if r.decoded != nil {
+		return r.decoded
+	}
+	if r.src != nil {
+		return r.src
+	}
+	var raw io.Reader
+	if r.rd == nil {
+		raw = bytes.NewReader(r.Body)
+	} else {
+		raw = &bodyReader{r: r}
+	}
+	if len(r.codings) > 0 {
+		r.decoded = newDecoder(raw, r.codings, r.maxDecoded)
+		return r.decoded
+	}
+	return raw
+}
+
+// Context returns the context of the request, context.Background() unless
+// one was set with SetContext.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext replaces the context of the request, for middleware to pass
+// values on to the handler.
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// BodyLen returns how many body bytes have been read from the connection
+// so far, without chunked framing but before any content coding is undone.
+func (r *Request) BodyLen() int64 {
+	return int64(r.bodyLen)
+}
+
+type bodyReader struct {
+	r *Request
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	r := b.r
+	for len(r.Body) == 0 && r.State != Done {
+		if r.rd == nil {
+			break
+		}
+		if err := r.rd.step(r); err != nil {
+			return 0, err
+		}
+	}
+	if len(r.Body) == 0 {
+		r.rd = nil
+		return 0, io.EOF
+	}
+	n := copy(p, r.Body)
+	r.Body = r.Body[n:]
+	return n, nil
+}
+
+// ExpectsContinue reports whether the client sent "Expect: 100-continue"
+// and is waiting for an interim response before sending the body.
+func (r *Request) ExpectsContinue() bool {
+	return r.RequestLine.HTTPVersion == "1.1" &&
+		r.Headers.HasToken("expect", "100-continue") &&
+		r.State != Done
+}
+
+// KeepAlive reports whether the client expects the connection to stay
+// open after the response. HTTP/1.1 connections persist unless the client
+// sends "Connection: close", HTTP/1.0 connections close unless it sends
+// "Connection: keep-alive".
+func (r *Request) KeepAlive() bool {
+	// a message framed by both headers may have been read differently
+	// by something in front of us, so don't trust what follows it
+	if r.Headers.Get("transfer-encoding") != "" && r.Headers.Get("content-length") != "" {
+		return false
+	}
+	if r.RequestLine.HTTPVersion == "1.0" {
+		return r.Headers.HasToken("connection", "keep-alive")
+	}
+	return !r.Headers.HasToken("connection", "close")
+}
@@ -1,12 +1,18 @@
 package request
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"io"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
 )
 
 type chunkReader struct {
@@ -156,6 +162,41 @@ func TestBodyLongerThanContentLength(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestBodyLongerThanContentLengthAnyReadSize(t *testing.T) {
+	for _, size := range []int{1, 2, 26, 64, 1024} {
+		_, err := RequestFromReader(&chunkReader{
+			data:            "POST /submit HTTP/1.1\r\nHost: x\r\nContent-Length: 2\r\n\r\nhi there",
+			numBytesPerRead: size,
+		})
+		assert.Error(t, err, "%d bytes per read", size)
+	}
+}
+
+// endlessReader repeats line for ever, like a client that never ends its
+// headers
+type endlessReader struct {
+	line string
+	pos  int
+}
+
+func (er *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = er.line[er.pos%len(er.line)]
+		er.pos++
+	}
+	return len(p), nil
+}
+
+func TestHeadTooLarge(t *testing.T) {
+	for _, line := range []string{"X-Filler: yes\r\n", "a"} {
+		_, err := RequestFromReader(io.MultiReader(strings.NewReader("GET / HTTP/1.1\r\n"), &endlessReader{line: line}))
+		assert.ErrorIs(t, err, headers.ErrHeadTooLarge, "%q", line)
+	}
+	head := "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", headers.MaxHeadSize) + "\r\n\r\n"
+	_, err := RequestFromReader(strings.NewReader(head))
+	assert.ErrorIs(t, err, headers.ErrHeadTooLarge)
+}
+
 func TestZeroContentLengthNoBody(t *testing.T) {
 	reader := &chunkReader{
 		data: "POST /submit HTTP/1.1\r\n" +
@@ -182,3 +223,232 @@ func TestNoContentLengthButBody(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, len(r.Body), 0)
 }
+
+func TestInvalidContentLength(t *testing.T) {
+	for _, cl := range []string{"-1", "+5", "5x", " "} {
+		_, err := RequestFromReader(strings.NewReader("POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: " + cl + "\r\n\r\nhello"))
+		assert.Error(t, err, cl)
+	}
+}
+
+func TestHTTP10Request(t *testing.T) {
+	reader := &chunkReader{
+		data:            "GET /health HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HTTPVersion)
+	assert.False(t, r.KeepAlive())
+}
+
+func TestKeepAlive(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost:42069\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+}
+
+func TestReaderPipelinedRequests(t *testing.T) {
+	rd := NewReader(&chunkReader{
+		data: "POST /a HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET /b HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.Target)
+	assert.Equal(t, "hello", string(r.Body))
+
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.Target)
+
+	_, err = rd.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReaderTruncatedRequest(t *testing.T) {
+	rd := NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: local"))
+	_, err := rd.ReadRequest()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestChunkedBody(t *testing.T) {
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n6\r\nworld!\r\n0\r\nX-Sum: 12\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, "12", r.Trailers.Get("x-sum"))
+}
+
+func strictRequest(raw string) (*Request, error) {
+	rd := NewReader(&chunkReader{data: raw, numBytesPerRead: 5})
+	rd.Strict = true
+	return rd.ReadRequest()
+}
+
+func TestStrictAcceptsValidRequest(t *testing.T) {
+	r, err := strictRequest("POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5, 5\r\n\r\nhello")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	_, err = strictRequest("GET / HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+}
+
+func TestStrictCRLFSplitAcrossReads(t *testing.T) {
+	rd := NewReader(&chunkReader{data: "GET / HTTP/1.1\r\nHost: a\r\n\r\n", numBytesPerRead: 1})
+	rd.Strict = true
+	_, err := rd.ReadRequest()
+	require.NoError(t, err)
+}
+
+func TestStrictRejects(t *testing.T) {
+	tests := map[string]string{
+		"method with junk":       "GET<junk> / HTTP/1.1\r\nHost: a\r\n\r\n",
+		"missing host":           "GET / HTTP/1.1\r\n\r\n",
+		"multiple hosts":         "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n",
+		"bare LF":                "GET / HTTP/1.1\r\nHost: a\nX-Smuggle: 1\r\n\r\n",
+		"obs-fold":               "GET / HTTP/1.1\r\nHost: a\r\n X-Folded: 1\r\n\r\n",
+		"space before colon":     "GET / HTTP/1.1\r\nHost : a\r\n\r\n",
+		"signed content length":  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello",
+		"differing lengths":      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!",
+		"length and chunked":     "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		"unknown coding":         "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n",
+		"control char in target": "GET /a\x01b HTTP/1.1\r\nHost: a\r\n\r\n",
+	}
+	for name, raw := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := strictRequest(raw)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestRejectsAmbiguousFraming(t *testing.T) {
+	tests := map[string]string{
+		"obs-fold":         "GET / HTTP/1.1\r\nHost: a\r\n X-Folded: 1\r\n\r\n",
+		"chunked not last": "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, gzip\r\n\r\n0\r\n\r\n",
+		"bare LF in value": "GET / HTTP/1.1\r\nHost: a\r\nX-Smuggle: 1\nX-Other: 2\r\n\r\n",
+		"NUL in value":     "GET / HTTP/1.1\r\nHost: a\r\nX-Null: a\x00b\r\n\r\n",
+	}
+	for name, raw := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := RequestFromReader(strings.NewReader(raw))
+			require.Error(t, err)
+			_, err = strictRequest(raw)
+			require.Error(t, err)
+		})
+	}
+}
+
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write([]byte(s))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.String()
+}
+
+func decodingReader(raw string, maxSize int64) *Reader {
+	rd := NewReader(&chunkReader{data: raw, numBytesPerRead: 7})
+	rd.DecodeBodies = true
+	rd.MaxDecodedSize = maxSize
+	return rd
+}
+
+func TestDecodeGzipBody(t *testing.T) {
+	body := gzipped(t, "hello telemetry")
+	rd := decodingReader("POST /t HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: gzip\r\n"+
+		"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body, 1024)
+	r, err := rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "hello telemetry", string(r.Body))
+	assert.Empty(t, r.Headers.Get("content-encoding"))
+}
+
+func TestDecodeStreamingDeflateBody(t *testing.T) {
+	buf := &bytes.Buffer{}
+	zw := zlib.NewWriter(buf)
+	_, err := zw.Write([]byte("streamed and deflated"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	rd := decodingReader("POST /t HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: deflate\r\n"+
+		"Content-Length: "+strconv.Itoa(buf.Len())+"\r\n\r\n"+buf.String(), 0)
+	r, err := rd.ReadRequestHead()
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(r.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, "streamed and deflated", string(decoded))
+}
+
+func TestDecodedBodyTooLarge(t *testing.T) {
+	body := gzipped(t, strings.Repeat("a", 10000))
+	rd := decodingReader("POST /t HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: gzip\r\n"+
+		"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body, 9999)
+	_, err := rd.ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// no size is the default limit, not none
+	body = gzipped(t, strings.Repeat("a", DefaultMaxDecodedSize+1))
+	raw := "POST /t HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: gzip\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	_, err = decodingReader(raw, 0).ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	r, err := decodingReader(raw, -1).ReadRequest()
+	require.NoError(t, err)
+	assert.Len(t, r.Body, DefaultMaxDecodedSize+1)
+}
+
+func TestUnsupportedContentEncoding(t *testing.T) {
+	rd := decodingReader("POST /t HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: br\r\nContent-Length: 2\r\n\r\nhi", 0)
+	_, err := rd.ReadRequest()
+	assert.ErrorIs(t, err, ErrUnsupportedEncoding)
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	r := New("POST", "/submit", strings.NewReader("hello"))
+	r.Headers.Set("host", "example.com")
+	buf := &bytes.Buffer{}
+	require.NoError(t, r.Write(buf))
+	assert.Contains(t, buf.String(), "content-length: 5\r\n")
+
+	parsed, err := RequestFromReader(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "POST", parsed.RequestLine.Method)
+	assert.Equal(t, "/submit", parsed.RequestLine.Target)
+	assert.Equal(t, "example.com", parsed.Headers.Get("host"))
+	assert.Equal(t, "hello", string(parsed.Body))
+}
+
+func TestWriteChunkedWithTrailers(t *testing.T) {
+	// a body of unknown length is sent chunked
+	r := New("PUT", "/", io.MultiReader(strings.NewReader("abc"), strings.NewReader("def")))
+	r.Headers.Set("host", "example.com")
+	r.Trailers.Set("x-sum", "6")
+	buf := &bytes.Buffer{}
+	require.NoError(t, r.Write(buf))
+
+	parsed, err := RequestFromReader(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef", string(parsed.Body))
+	assert.Equal(t, "6", parsed.Trailers.Get("x-sum"))
+}
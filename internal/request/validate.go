@@ -0,0 +1,129 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The checks in this file only run for a Reader in Strict mode. They close
+// the gaps where this parser and a proxy in front of it could disagree on
+// where a message ends (RFC 9112 section 11.2).
+
+// validateLine rejects a CR or LF anywhere in the next line other than in
+// its terminating CRLF.
+func validateLine(data []byte) error {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end == -1 {
+		// the rest of the line hasn't arrived,
+		// a CR at the end may be the start of its CRLF
+		end = len(bytes.TrimSuffix(data, []byte("\r")))
+	}
+	if bytes.ContainsAny(data[:end], "\r\n") {
+		return errors.New("bare CR or LF in message head")
+	}
+	return nil
+}
+
+func validateRequestLine(rl *RequestLine) error {
+	if !isToken(rl.Method) {
+		return fmt.Errorf("invalid method token: %q", rl.Method)
+	}
+	if rl.Target == "" {
+		return errors.New("empty request target")
+	}
+	for _, c := range []byte(rl.Target) {
+		if c <= ' ' || c == 0x7f {
+			return fmt.Errorf("invalid character in request target: %q", rl.Target)
+		}
+	}
+	return nil
+}
+
+func (r *Request) validateFieldLine(data []byte) error {
+	if err := validateLine(data); err != nil {
+		return err
+	}
+	end := bytes.Index(data, []byte("\r\n"))
+	if end <= 0 {
+		return nil
+	}
+	name, _, ok := bytes.Cut(data[:end], []byte(":"))
+	if !ok {
+		return nil
+	}
+	if len(name) > 0 && (name[len(name)-1] == ' ' || name[len(name)-1] == '\t') {
+		return fmt.Errorf("whitespace before colon in header field: %q", name)
+	}
+	if !isToken(string(name)) {
+		return fmt.Errorf("invalid header field name: %q", name)
+	}
+	if strings.EqualFold(string(name), "host") && r.Headers.Get("host") != "" {
+		return errors.New("multiple Host headers")
+	}
+	return nil
+}
+
+// validateHeaders checks the complete header section for framing
+// conflicts and a missing Host.
+func (r *Request) validateHeaders() error {
+	if r.RequestLine.HTTPVersion == "1.1" && r.Headers.Get("host") == "" {
+		return errors.New("missing Host header")
+	}
+	te := r.Headers.Get("transfer-encoding")
+	cl := r.Headers.Get("content-length")
+	if te != "" && cl != "" {
+		return errors.New("both Transfer-Encoding and Content-Length present")
+	}
+	if te != "" && !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+		return fmt.Errorf("unsupported transfer encoding: %s", te)
+	}
+	if te != "" && r.RequestLine.HTTPVersion == "1.0" {
+		return errors.New("transfer encoding in an HTTP/1.0 request")
+	}
+	return nil
+}
+
+// parseContentLength accepts only plain digits. Repeated values, which the
+// headers package joins with commas, must all be identical.
+func parseContentLength(v string) (int, error) {
+	var length string
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return 0, fmt.Errorf("invalid content length: %q", v)
+		}
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, fmt.Errorf("invalid content length: %q", v)
+			}
+		}
+		if length != "" && part != length {
+			return 0, fmt.Errorf("conflicting content lengths: %q", v)
+		}
+		length = part
+	}
+	n, err := strconv.Atoi(length)
+	if err != nil {
+		return 0, fmt.Errorf("invalid content length: %q", v)
+	}
+	return n, nil
+}
+
+// isToken reports whether s is an RFC 9110 token.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1:
+		default:
+			return false
+		}
+	}
+	return true
+}
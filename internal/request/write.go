@@ -0,0 +1,82 @@
+package request
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/chunked"
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+)
+
+// New makes an HTTP/1.1 request to send with Write. body may be nil.
+func New(method, target string, body io.Reader) *Request {
+	return &Request{
+		RequestLine: RequestLine{
+			Method:      method,
+			Target:      target,
+			HTTPVersion: "1.1",
+		},
+		Headers:       headers.NewHeaders(),
+		Body:          []byte{},
+		Trailers:      headers.NewHeaders(),
+		State:         Done,
+		contentLength: -1,
+		src:           body,
+	}
+}
+
+// Write sends the request on w. The body is read from BodyReader and framed
+// by the request's Content-Length. Without one it is sent chunked, followed
+// by Trailers, unless its length is known up front, in which case a
+// Content-Length header is added.
+func (r *Request) Write(w io.Writer) error {
+	body := r.BodyReader()
+	length := int64(-1)
+	isChunked := r.Headers.HasToken("transfer-encoding", "chunked")
+	if cl := r.Headers.Get("content-length"); cl != "" && !isChunked {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid content length: %s", cl)
+		}
+		length = n
+	} else if !isChunked {
+		if l, ok := body.(interface{ Len() int }); ok {
+			length = int64(l.Len())
+			if length > 0 {
+				r.Headers.Set("content-length", strconv.FormatInt(length, 10))
+			}
+		} else {
+			isChunked = true
+			r.Headers.Set("transfer-encoding", "chunked")
+		}
+	}
+
+	version := r.RequestLine.HTTPVersion
+	if version == "" {
+		version = "1.1"
+	}
+	head := fmt.Appendf(nil, "%s %s HTTP/%s\r\n", r.RequestLine.Method, r.RequestLine.Target, version)
+	for k, v := range r.Headers {
+		head = fmt.Appendf(head, "%s: %s\r\n", k, v)
+	}
+	head = append(head, "\r\n"...)
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+
+	if isChunked {
+		cw := chunked.NewWriter(w)
+		if _, err := io.Copy(cw, body); err != nil {
+			return err
+		}
+		// trailers of a streamed body are only complete once it is read
+		return cw.End(r.Trailers)
+	}
+	if length > 0 {
+		if _, err := io.CopyN(w, body, length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Package requestid - to give each request an ID that ties together its
+// response, logs and error pages
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Header is the header the ID is sent back in, and read from when the
+// client is trusted to pick it
+const Header = "X-Request-Id"
+
+// maxLen is the longest incoming ID that is accepted
+const maxLen = 128
+
+type Format int
+
+const (
+	// UUID is a random, version 4 UUID (RFC 9562)
+	UUID Format = iota
+	// ULID is a Universally Unique Lexicographically Sortable Identifier,
+	// so IDs sort by the time they were made
+	ULID
+)
+
+// ParseFormat returns the Format named "uuid" or "ulid".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "uuid":
+		return UUID, nil
+	case "ulid":
+		return ULID, nil
+	default:
+		return 0, fmt.Errorf("unknown request ID format %q", name)
+	}
+}
+
+// New makes an ID in format f.
+func (f Format) New() string {
+	if f == ULID {
+		return newULID(time.Now())
+	}
+	return newUUID()
+}
+
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 9562 variant
+	h := hex.EncodeToString(b[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// crockford is the base32 alphabet of ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID makes a ULID: 48 bits of milliseconds since the epoch and 80
+// random bits, as 26 base32 characters.
+func newULID(t time.Time) string {
+	var b [16]byte
+	_, _ = rand.Read(b[6:])
+	ms := uint64(t.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+	// the 128 bits, 5 at a time from the end, fill 26 characters
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// Valid reports whether id is fit to be used as a request ID: up to 128
+// visible ASCII characters, so it can't break a header or log line.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLen {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID in ctx, or "".
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
@@ -0,0 +1,55 @@
+package requestid
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUUID(t *testing.T) {
+	id := UUID.New()
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, id)
+	assert.NotEqual(t, id, UUID.New())
+}
+
+func TestULID(t *testing.T) {
+	id := ULID.New()
+	assert.Regexp(t, regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`), id)
+	assert.NotEqual(t, id, ULID.New())
+
+	// the timestamp from the example in the spec
+	at := time.UnixMilli(1469918176385)
+	assert.True(t, strings.HasPrefix(newULID(at), "01ARYZ6S41"))
+	// later IDs sort after earlier ones
+	assert.Less(t, newULID(at), newULID(at.Add(time.Millisecond)))
+}
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("ULID")
+	require.NoError(t, err)
+	assert.Equal(t, ULID, f)
+	f, err = ParseFormat("uuid")
+	require.NoError(t, err)
+	assert.Equal(t, UUID, f)
+	_, err = ParseFormat("snowflake")
+	assert.Error(t, err)
+}
+
+func TestValid(t *testing.T) {
+	assert.True(t, Valid("abc-123"))
+	assert.True(t, Valid(UUID.New()))
+	assert.False(t, Valid(""))
+	assert.False(t, Valid("has space"))
+	assert.False(t, Valid("new\nline"))
+	assert.False(t, Valid("ümlaut"))
+	assert.False(t, Valid(strings.Repeat("a", 129)))
+}
+
+func TestContext(t *testing.T) {
+	assert.Equal(t, "", FromContext(t.Context()))
+	assert.Equal(t, "abc", FromContext(NewContext(t.Context(), "abc")))
+}
@@ -0,0 +1,43 @@
+package response
+
+import (
+	"bufio"
+	"errors"
+	"net"
+)
+
+var (
+	// ErrHijacked is returned for writes to a Writer whose connection
+	// has been hijacked
+	ErrHijacked = errors.New("connection has been hijacked")
+	// ErrNotHijackable is returned by Hijack for a Writer that isn't
+	// writing to a connection the server manages
+	ErrNotHijackable = errors.New("connection can't be hijacked")
+)
+
+// Hijack takes the connection over from the server, e.g. to speak another
+// protocol on it after a 101 Switching Protocols. The server doesn't write
+// to or close the connection once the handler returns, that is up to the
+// caller. The reader returns any bytes already read from the connection
+// past what was parsed of the request before reading any more from it.
+// Writes through w afterwards fail with ErrHijacked.
+func (w *Writer) Hijack() (net.Conn, *bufio.Reader, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.Hijacker == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	conn, br, err := w.Hijacker()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	w.State = Done
+	return conn, br, nil
+}
+
+// Hijacked reports whether the handler has taken over the connection.
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
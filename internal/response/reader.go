@@ -0,0 +1,411 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/chunked"
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+)
+
+// readBufferSize is the initial size of a Reader's buffer,
+// it grows to fit longer lines
+const readBufferSize = 4096
+
+type ParserState int
+
+const (
+	ParsingStatusLine ParserState = iota
+	ParsingHeaders
+	ParsingBody
+	ParsingDone
+)
+
+type StatusLine struct {
+	HTTPVersion string
+	StatusCode  StatusCode
+	Reason      string
+}
+
+// Response is a response read from a connection, e.g. by a client or proxy.
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	Body       []byte
+	// Trailers holds the trailer fields of a chunked body
+	Trailers headers.Headers
+	// Interim holds the status lines of any 1xx responses that came
+	// before this one, e.g. 100 Continue
+	Interim []StatusLine
+	State   ParserState
+
+	// method is that of the request the response answers, responses to
+	// HEAD and successful responses to CONNECT never have a body
+	method string
+	// contentLength is the declared body length, -1 when there is none
+	contentLength int64
+	bodyLen       int64
+	// headLen is the size of the status lines and headers parsed so far,
+	// interim responses included
+	headLen        int
+	closeDelimited bool
+	chunks         *chunked.Decoder
+	// rd is the connection the rest of the body is read from,
+	// nil once the body has been read
+	rd *Reader
+}
+
+// Parse parses as much of a response from data as it can, returning how
+// many bytes it consumed. hitEOF tells it the connection has closed, which
+// ends a body that isn't otherwise delimited.
+func (r *Response) Parse(data []byte, hitEOF bool) (int, error) {
+	total := 0
+	for r.State != ParsingDone {
+		head := r.State < ParsingBody
+		n, err := r.parseSingle(data[total:], hitEOF)
+		if err != nil {
+			return 0, err
+		}
+		if head {
+			r.headLen += n
+		}
+		total += n
+		if n == 0 {
+			break
+		}
+	}
+	return total, nil
+}
+
+func (r *Response) parseSingle(data []byte, hitEOF bool) (int, error) {
+	switch r.State {
+	case ParsingStatusLine:
+		lineEnd := bytes.Index(data, []byte(headers.CRLF))
+		if lineEnd == -1 {
+			return 0, nil
+		}
+		sl, err := parseStatusLine(string(data[:lineEnd]))
+		if err != nil {
+			return 0, err
+		}
+		r.StatusLine = *sl
+		r.State = ParsingHeaders
+		return lineEnd + 2, nil
+	case ParsingHeaders:
+		n, done, err := r.Headers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		if !done {
+			return n, nil
+		}
+		code := r.StatusLine.StatusCode
+		if code >= 100 && code < 200 && code != 101 {
+			// an interim response, the final one follows it
+			r.Interim = append(r.Interim, r.StatusLine)
+			r.Headers = headers.NewHeaders()
+			r.State = ParsingStatusLine
+			return n, nil
+		}
+		if err := r.prepareBody(); err != nil {
+			return 0, err
+		}
+		r.State = ParsingBody
+		return n, nil
+	case ParsingBody:
+		switch {
+		case r.chunks != nil:
+			return r.parseChunk(data, hitEOF)
+		case r.closeDelimited:
+			r.Body = append(r.Body, data...)
+			r.bodyLen += int64(len(data))
+			if hitEOF {
+				r.State = ParsingDone
+			}
+			return len(data), nil
+		case r.contentLength == -1:
+			r.State = ParsingDone
+			return 0, nil
+		}
+		n := int(min(int64(len(data)), r.contentLength-r.bodyLen))
+		r.Body = append(r.Body, data[:n]...)
+		r.bodyLen += int64(n)
+		if r.bodyLen == r.contentLength {
+			r.State = ParsingDone
+		} else if hitEOF {
+			return 0, fmt.Errorf("body shorter than content length: %w", io.ErrUnexpectedEOF)
+		}
+		return n, nil
+	case ParsingDone:
+		return 0, errors.New("parse function called in Done state")
+	default:
+		return 0, errors.New("unknown state")
+	}
+}
+
+// prepareBody works out how the body is delimited once the headers are in,
+// following RFC 9112 section 6.3.
+func (r *Response) prepareBody() error {
+	r.contentLength = -1
+	code := r.StatusLine.StatusCode
+	if r.method == "HEAD" || r.tunnel() || code < 200 || code == 204 || code == 304 {
+		return nil
+	}
+	if te := r.Headers.Get("transfer-encoding"); te != "" {
+		codings := strings.Split(te, ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			r.chunks = chunked.NewDecoder()
+			r.Trailers = r.chunks.Trailers
+		} else {
+			r.closeDelimited = true
+		}
+		return nil
+	}
+	cl := r.Headers.Get("content-length")
+	if cl == "" {
+		r.closeDelimited = true
+		return nil
+	}
+	// repeated values have been joined, they must all agree
+	values := strings.Split(cl, ",")
+	for _, v := range values {
+		if strings.TrimSpace(v) != strings.TrimSpace(values[0]) {
+			return fmt.Errorf("conflicting content lengths: %s", cl)
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(values[0]), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid content length: %s", cl)
+	}
+	r.contentLength = n
+	return nil
+}
+
+func (r *Response) parseChunk(data []byte, hitEOF bool) (int, error) {
+	n, chunk, err := r.chunks.Parse(data)
+	if err != nil {
+		return 0, err
+	}
+	r.Body = append(r.Body, chunk...)
+	r.bodyLen += int64(len(chunk))
+	if r.chunks.State == chunked.Done {
+		r.State = ParsingDone
+	} else if n == 0 && hitEOF {
+		return 0, fmt.Errorf("chunked body ended early: %w", io.ErrUnexpectedEOF)
+	}
+	return n, nil
+}
+
+func parseStatusLine(line string) (*StatusLine, error) {
+	// the reason phrase may be empty, and then the space before it
+	// is sometimes left out too
+	version, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return nil, fmt.Errorf("invalid status line: %s", line)
+	}
+	code, reason, _ := strings.Cut(rest, " ")
+	v, ok := strings.CutPrefix(version, "HTTP/")
+	if !ok || (v != "1.0" && v != "1.1") {
+		return nil, fmt.Errorf("invalid version: %s", version)
+	}
+	if len(code) != 3 || strings.Trim(code, "0123456789") != "" {
+		return nil, fmt.Errorf("invalid status code: %s", code)
+	}
+	c, err := strconv.Atoi(code)
+	if err != nil || c < 100 {
+		return nil, fmt.Errorf("invalid status code: %s", code)
+	}
+	return &StatusLine{
+		HTTPVersion: v,
+		StatusCode:  StatusCode(c),
+		Reason:      reason,
+	}, nil
+}
+
+// KeepAlive reports whether the connection can carry another response
+// once this one has been read.
+func (r *Response) KeepAlive() bool {
+	if r.closeDelimited || r.StatusLine.StatusCode == 101 || r.tunnel() {
+		return false
+	}
+	if r.StatusLine.HTTPVersion == "1.0" {
+		return r.Headers.HasToken("connection", "keep-alive")
+	}
+	return !r.Headers.HasToken("connection", "close")
+}
+
+// tunnel reports whether the response opened a tunnel, after which the
+// connection no longer carries HTTP.
+func (r *Response) tunnel() bool {
+	return r.method == "CONNECT" && r.StatusLine.StatusCode/100 == 2
+}
+
+// Reader reads successive responses from a single connection, the way
+// request.Reader reads requests.
+type Reader struct {
+	src         io.Reader
+	buf         []byte
+	readToIndex int
+	hitEOF      bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		src: r,
+		buf: make([]byte, readBufferSize),
+	}
+}
+
+// ResponseFromReader parses a single response, including its body, from
+// r. Use a Reader for a response to a HEAD request.
+func ResponseFromReader(r io.Reader) (*Response, error) {
+	return NewReader(r).ReadResponse("GET")
+}
+
+// ReadResponse reads the next response, including its body, to a request
+// made with method. It returns io.EOF if the connection was closed before
+// any part of a response arrived.
+func (rd *Reader) ReadResponse(method string) (*Response, error) {
+	res, err := rd.ReadResponseHead(method)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.ReadBody(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ReadResponseHead reads the status line and headers of the next final
+// response to a request made with method, skipping interim ones. The body
+// is left on the connection to be read through BodyReader or ReadBody.
+func (rd *Reader) ReadResponseHead(method string) (*Response, error) {
+	res := &Response{
+		State:   ParsingStatusLine,
+		Headers: headers.NewHeaders(),
+		Body:    []byte{},
+		method:  method,
+	}
+	for res.State < ParsingBody {
+		if err := rd.step(res); err != nil {
+			return nil, err
+		}
+	}
+	// a response without a body may be done already
+	if _, err := res.Parse(nil, false); err != nil {
+		return nil, err
+	}
+	if res.State != ParsingDone {
+		res.rd = rd
+	}
+	return res, nil
+}
+
+// Buffered is the number of bytes read from the connection past the last
+// response parsed.
+func (rd *Reader) Buffered() int {
+	return rd.readToIndex
+}
+
+func (rd *Reader) step(res *Response) error {
+	consumed, err := res.Parse(rd.buf[:rd.readToIndex], rd.hitEOF)
+	if err != nil {
+		return err
+	}
+	// the same limit the server puts on request heads
+	if res.headTooLarge(rd.readToIndex - consumed) {
+		return headers.ErrHeadTooLarge
+	}
+	if consumed > 0 {
+		copy(rd.buf, rd.buf[consumed:rd.readToIndex])
+		rd.readToIndex -= consumed
+		return nil
+	}
+	if res.State == ParsingDone {
+		return nil
+	}
+	if rd.hitEOF {
+		if res.State == ParsingStatusLine && len(res.Interim) == 0 && rd.readToIndex == 0 {
+			return io.EOF
+		}
+		return io.ErrUnexpectedEOF
+	}
+	return rd.fill()
+}
+
+// headTooLarge reports whether the head of r, with the buffered bytes of
+// it still to parse, is over headers.MaxHeadSize.
+func (r *Response) headTooLarge(buffered int) bool {
+	if r.State >= ParsingBody {
+		return r.headLen > headers.MaxHeadSize
+	}
+	return r.headLen+buffered > headers.MaxHeadSize
+}
+
+// fill reads more data from the connection into the buffer,
+// growing it when it is full.
+func (rd *Reader) fill() error {
+	if rd.readToIndex == len(rd.buf) {
+		nb := make([]byte, len(rd.buf)*2)
+		copy(nb, rd.buf[:rd.readToIndex])
+		rd.buf = nb
+	}
+	n, err := rd.src.Read(rd.buf[rd.readToIndex:])
+	rd.readToIndex += n
+	if errors.Is(err, io.EOF) {
+		rd.hitEOF = true
+		return nil
+	}
+	return err
+}
+
+// ReadBody reads the rest of the body from the connection into Body.
+func (r *Response) ReadBody() error {
+	if r.rd == nil {
+		return nil
+	}
+	for r.State != ParsingDone {
+		if err := r.rd.step(r); err != nil {
+			return err
+		}
+	}
+	r.rd = nil
+	return nil
+}
+
+// BodyReader returns a reader over the body. If the body is still on the
+// connection it is read as it is consumed, and bytes read through the
+// returned reader are removed from Body.
+func (r *Response) BodyReader() io.Reader {
+	if r.rd == nil {
+		return bytes.NewReader(r.Body)
+	}
+	return &bodyReader{r: r}
+}
+
+type bodyReader struct {
+	r *Response
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	r := b.r
+	for len(r.Body) == 0 && r.State != ParsingDone {
+		if r.rd == nil {
+			break
+		}
+		if err := r.rd.step(r); err != nil {
+			return 0, err
+		}
+	}
+	if len(r.Body) == 0 {
+		r.rd = nil
+		return 0, io.EOF
+	}
+	n := copy(p, r.Body)
+	r.Body = r.Body[n:]
+	return n, nil
+}
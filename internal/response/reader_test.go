@@ -0,0 +1,237 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+)
+
+// trickleReader hands out n bytes per Read, like a slow connection
+type trickleReader struct {
+	data string
+	n    int
+}
+
+func (tr *trickleReader) Read(p []byte) (int, error) {
+	if tr.data == "" {
+		return 0, io.EOF
+	}
+	n := copy(p, tr.data[:min(tr.n, len(tr.data))])
+	tr.data = tr.data[n:]
+	return n, nil
+}
+
+func TestParseContentLength(t *testing.T) {
+	raw := "HTTP/1.1 404 Not Found\r\nContent-Length: 7\r\nX-Test: yes\r\n\r\nmissing"
+	res, err := ResponseFromReader(&trickleReader{data: raw, n: 3})
+	require.NoError(t, err)
+	assert.Equal(t, StatusLine{HTTPVersion: "1.1", StatusCode: NotFound, Reason: "Not Found"}, res.StatusLine)
+	assert.Equal(t, "yes", res.Headers.Get("x-test"))
+	assert.Equal(t, "missing", string(res.Body))
+	assert.True(t, res.KeepAlive())
+}
+
+func TestParseChunkedWithTrailers(t *testing.T) {
+	raw := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: 11\r\n\r\n"
+	res, err := ResponseFromReader(&trickleReader{data: raw, n: 2})
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(res.Body))
+	assert.Equal(t, "11", res.Trailers.Get("x-sum"))
+}
+
+func TestParseCloseDelimited(t *testing.T) {
+	res, err := ResponseFromReader(strings.NewReader("HTTP/1.0 200 OK\r\n\r\nuntil close"))
+	require.NoError(t, err)
+	assert.Equal(t, "until close", string(res.Body))
+	assert.False(t, res.KeepAlive())
+}
+
+func TestParseInterimResponses(t *testing.T) {
+	raw := "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n"
+	res, err := ResponseFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	assert.Equal(t, NoContent, res.StatusLine.StatusCode)
+	require.Len(t, res.Interim, 2)
+	assert.Equal(t, StatusCode(100), res.Interim[0].StatusCode)
+	assert.Equal(t, StatusCode(103), res.Interim[1].StatusCode)
+	assert.Equal(t, "", res.Headers.Get("link"))
+	assert.Empty(t, res.Body)
+}
+
+func TestParseSwitchingProtocols(t *testing.T) {
+	rd := NewReader(strings.NewReader("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\nframes"))
+	res, err := rd.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, ParsingDone, res.State)
+	assert.False(t, res.KeepAlive())
+	// what follows belongs to the new protocol
+	assert.Equal(t, len("frames"), rd.Buffered())
+}
+
+func TestParseHeadResponse(t *testing.T) {
+	rd := NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	res, err := rd.ReadResponse("HEAD")
+	require.NoError(t, err)
+	assert.Empty(t, res.Body)
+	res, err = rd.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(res.Body))
+	_, err = rd.ReadResponse("GET")
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestParseConnectResponse(t *testing.T) {
+	rd := NewReader(strings.NewReader("HTTP/1.1 200 Connection Established\r\n\r\ntunnelled"))
+	res, err := rd.ReadResponse("CONNECT")
+	require.NoError(t, err)
+	assert.Empty(t, res.Body)
+	assert.False(t, res.KeepAlive())
+	assert.Equal(t, len("tunnelled"), rd.Buffered())
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"bad version":          "HTTP/2.0 200 OK\r\n\r\n",
+		"bad code":             "HTTP/1.1 2000 OK\r\n\r\n",
+		"no code":              "HTTP/1.1\r\n\r\n",
+		"conflicting lengths":  "HTTP/1.1 200 OK\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab",
+		"truncated body":       "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort",
+		"truncated chunks":     "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel",
+		"truncated head":       "HTTP/1.1 200 OK\r\nContent-",
+		"invalid chunk length": "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+	}
+	for name, raw := range tests {
+		_, err := ResponseFromReader(strings.NewReader(raw))
+		assert.Error(t, err, name)
+	}
+}
+
+// endlessReader repeats line for ever, like a peer that never ends its head
+type endlessReader struct {
+	line string
+	pos  int
+}
+
+func (er *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = er.line[er.pos%len(er.line)]
+		er.pos++
+	}
+	return len(p), nil
+}
+
+func TestHeadTooLarge(t *testing.T) {
+	for _, line := range []string{"X-Filler: yes\r\n", "a"} {
+		_, err := ResponseFromReader(io.MultiReader(strings.NewReader("HTTP/1.1 200 OK\r\n"), &endlessReader{line: line}))
+		assert.ErrorIs(t, err, headers.ErrHeadTooLarge, "%q", line)
+	}
+	// interim responses count towards the limit too
+	_, err := ResponseFromReader(&endlessReader{line: "HTTP/1.1 100 Continue\r\n\r\n"})
+	assert.ErrorIs(t, err, headers.ErrHeadTooLarge)
+}
+
+func TestStreamingBody(t *testing.T) {
+	raw := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n"
+	rd := NewReader(&trickleReader{data: raw, n: 4})
+	res, err := rd.ReadResponseHead("GET")
+	require.NoError(t, err)
+	assert.Equal(t, ParsingBody, res.State)
+	body, err := io.ReadAll(res.BodyReader())
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef", string(body))
+	assert.Equal(t, ParsingDone, res.State)
+}
+
+// writeAndRead writes a response with a Writer and parses it back
+func writeAndRead(t *testing.T, method string, write func(w *Writer)) *Response {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf, &headers.Headers{})
+	w.KeepAlive = true
+	w.SuppressBody = method == "HEAD"
+	write(w)
+	require.NoError(t, w.Finish())
+	require.True(t, w.Complete())
+
+	rd := NewReader(buf)
+	res, err := rd.ReadResponse(method)
+	require.NoError(t, err)
+	assert.Equal(t, 0, rd.Buffered(), "bytes left after the response")
+	return res
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	t.Run("content length", func(t *testing.T) {
+		res := writeAndRead(t, "GET", func(w *Writer) {
+			require.NoError(t, w.WriteStatusLine(OK))
+			h := GetDefaultHeaders(5)
+			h.Delete("Connection")
+			require.NoError(t, w.WriteHeaders(h))
+			_, err := w.WriteBody([]byte("hello"))
+			require.NoError(t, err)
+		})
+		assert.Equal(t, OK, res.StatusLine.StatusCode)
+		assert.Equal(t, "OK", res.StatusLine.Reason)
+		assert.Equal(t, "hello", string(res.Body))
+		assert.True(t, res.KeepAlive())
+	})
+
+	t.Run("chunked with trailers", func(t *testing.T) {
+		res := writeAndRead(t, "GET", func(w *Writer) {
+			require.NoError(t, w.WriteStatusLine(OK))
+			h := headers.NewHeaders()
+			h.Set("Transfer-Encoding", "chunked")
+			h.Set("Trailer", "X-Sum")
+			require.NoError(t, w.WriteHeaders(h))
+			require.NoError(t, w.WriteChunkedBody([]byte("hello ")))
+			require.NoError(t, w.WriteChunkedBody([]byte("world")))
+			require.NoError(t, w.WriteChunkedBodyDone())
+			require.NoError(t, w.WriteTrailer(headers.Headers{"X-Sum": "11"}))
+		})
+		assert.Equal(t, "hello world", string(res.Body))
+		assert.Equal(t, "11", res.Trailers.Get("x-sum"))
+	})
+
+	t.Run("head", func(t *testing.T) {
+		res := writeAndRead(t, "HEAD", func(w *Writer) {
+			require.NoError(t, w.WriteStatusLine(OK))
+			require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+			_, err := w.WriteBody([]byte("hello"))
+			require.NoError(t, err)
+		})
+		assert.Equal(t, "5", res.Headers.Get("content-length"))
+		assert.Empty(t, res.Body)
+	})
+
+	t.Run("not modified", func(t *testing.T) {
+		res := writeAndRead(t, "GET", func(w *Writer) {
+			require.NoError(t, w.WriteStatusLine(NotModified))
+			require.NoError(t, w.WriteHeaders(headers.Headers{"ETag": `"abc"`}))
+		})
+		assert.Equal(t, NotModified, res.StatusLine.StatusCode)
+		assert.Equal(t, `"abc"`, res.Headers.Get("etag"))
+		assert.Empty(t, res.Body)
+	})
+
+	t.Run("http/1.0 close delimited", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf, &headers.Headers{})
+		w.HTTPVersion = "1.0"
+		require.NoError(t, w.WriteStatusLine(OK))
+		require.NoError(t, w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"}))
+		require.NoError(t, w.WriteChunkedBody([]byte("streamed")))
+		require.NoError(t, w.Finish())
+
+		res, err := ResponseFromReader(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "1.0", res.StatusLine.HTTPVersion)
+		assert.Equal(t, "streamed", string(res.Body))
+		assert.False(t, res.KeepAlive())
+	})
+}
@@ -10,15 +10,71 @@ import (
 type StatusCode int
 
 const (
-	OK          StatusCode = 200
-	BadRequest  StatusCode = 400
-	ServerError StatusCode = 500
+	OK                  StatusCode = 200
+	NoContent           StatusCode = 204
+	PartialContent      StatusCode = 206
+	MovedPermanently    StatusCode = 301
+	NotModified         StatusCode = 304
+	BadRequest          StatusCode = 400
+	Forbidden           StatusCode = 403
+	NotFound            StatusCode = 404
+	MethodNotAllowed    StatusCode = 405
+	ProxyAuthRequired   StatusCode = 407
+	PreconditionFailed  StatusCode = 412
+	ContentTooLarge     StatusCode = 413
+	RangeNotSatisfiable StatusCode = 416
+	ExpectationFailed   StatusCode = 417
+	UpgradeRequired     StatusCode = 426
+	ServerError         StatusCode = 500
+	BadGateway          StatusCode = 502
+	ServiceUnavailable  StatusCode = 503
 )
 
+var statusText = map[StatusCode]string{
+	100: "Continue",
+	101: "Switching Protocols",
+	200: "OK",
+	201: "Created",
+	202: "Accepted",
+	204: "No Content",
+	206: "Partial Content",
+	301: "Moved Permanently",
+	302: "Found",
+	304: "Not Modified",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	407: "Proxy Authentication Required",
+	408: "Request Timeout",
+	411: "Length Required",
+	412: "Precondition Failed",
+	413: "Content Too Large",
+	415: "Unsupported Media Type",
+	416: "Range Not Satisfiable",
+	417: "Expectation Failed",
+	426: "Upgrade Required",
+	431: "Request Header Fields Too Large",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+	505: "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase for a status code,
+// or an empty string if the code is unknown.
+func StatusText(s StatusCode) string {
+	return statusText[s]
+}
+
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	h := headers.Headers{}
 	h.Set("Content-Length", fmt.Sprintf("%v", contentLen))
-	h.Set("Connection", "close")
 	h.Set("Content-Type", "text/plain")
 	return h
 }
@@ -1,17 +1,75 @@
 package response
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
+	"strconv"
 
+	"github.com/k4rldoherty/http-from-tcp/internal/chunked"
 	"github.com/k4rldoherty/http-from-tcp/internal/headers"
 )
 
 type Writer struct {
 	Destination io.Writer
 	StatusCode  StatusCode
-	Headers     *headers.Headers
-	State       WriterState
+	// Headers are added to the header block passed to WriteHeaders,
+	// unless it already sets them
+	Headers *headers.Headers
+	State   WriterState
+	// HTTPVersion is the protocol version written in the status line.
+	// HTTP/1.0 responses never use the chunked encoding.
+	HTTPVersion string
+	// KeepAlive reports whether the connection may be reused after this
+	// response. The server sets it from the request, and writing headers
+	// clears it when the response has to be delimited by closing.
+	KeepAlive bool
+	// SuppressBody is set for responses to HEAD requests. Headers are
+	// written as usual but anything written as the body is discarded.
+	SuppressBody bool
+	// FlushChunks flushes the destination after every chunk of a chunked
+	// body, so a streamed body goes out as it is written. It is set by the
+	// server, which buffers writes to the connection.
+	FlushChunks bool
+	// Hijacker hands the connection to the handler, see Hijack.
+	// It is set by the server.
+	Hijacker func() (net.Conn, *bufio.Reader, error)
+	// Logger is for errors met while answering the request. The server
+	// sets it to a logger carrying the connection and request attributes.
+	Logger *slog.Logger
+
+	hijacked      bool
+	chunked       bool
+	bodyless      bool
+	contentLength int64
+	bodyWritten   int64
+	// bodySent counts the body bytes sent, once encoded but before any
+	// chunked framing
+	bodySent       int64
+	trailerPending bool
+	headerHooks    []func(*Writer, headers.Headers)
+	finishHooks    []func(*Writer, error)
+	// encoders transform the body, body is the outermost of them
+	encoders []BodyEncoder
+	body     io.Writer
+}
+
+// A BodyEncoder transforms a response body on its way to the connection,
+// e.g. to compress it. Flush pushes out everything written so far, Close
+// writes whatever the encoding needs to end the body.
+type BodyEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Flusher is implemented by writers that hold on to what is written until
+// they are flushed, like a Writer. Code handed a Writer as an io.Writer can
+// type-assert it to push out what it has written so far.
+type Flusher interface {
+	Flush() error
 }
 
 type WriterState int
@@ -28,39 +86,108 @@ func NewWriter(dest io.Writer, h *headers.Headers) *Writer {
 		Destination: dest,
 		Headers:     h,
 		State:       WritingStatusLine,
+		HTTPVersion: "1.1",
+		Logger:      slog.Default(),
 	}
 }
 
+// Write writes b as-is, except to the body of a chunked response where it
+// is sent as a chunk, so a Writer can be handed to anything that takes an
+// io.Writer.
 func (w *Writer) Write(b []byte) (int, error) {
+	if w.State == WritingBody {
+		return w.writeBody(b)
+	}
+	return w.write(b)
+}
+
+// Flush sends everything written so far to the client, first whatever
+// the body encoders are holding on to and then anything buffered by the
+// destination.
+func (w *Writer) Flush() error {
+	if w.hijacked {
+		return ErrHijacked
+	}
+	if w.State == WritingBody {
+		if err := w.flushEncoders(); err != nil {
+			return err
+		}
+	}
+	return w.flushDestination()
+}
+
+func (w *Writer) flushDestination() error {
+	if f, ok := w.Destination.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// writeBody sends b through any body encoders and the chunked framing.
+func (w *Writer) writeBody(b []byte) (int, error) {
+	if w.body != nil {
+		return w.body.Write(b)
+	}
+	return bodySink{w}.Write(b)
+}
+
+// bodySink is the end of the body pipeline, where encoded body bytes
+// are framed and written to the destination.
+type bodySink struct {
+	w *Writer
+}
+
+func (s bodySink) Write(b []byte) (int, error) {
+	n := len(b)
+	var err error
+	if s.w.chunked {
+		err = s.w.writeChunk(b)
+	} else {
+		n, err = s.w.write(b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !s.w.SuppressBody {
+		s.w.bodySent += int64(n)
+	}
+	return n, nil
+}
+
+// BytesWritten is the size of the body sent so far, after any content
+// coding but not counting chunked framing, like %b in an Apache log.
+// Bodies of responses to HEAD requests aren't sent, so aren't counted.
+func (w *Writer) BytesWritten() int64 {
+	return w.bodySent
+}
+
+// write sends b to the destination, keeping count of body bytes.
+func (w *Writer) write(b []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
+	if w.SuppressBody && w.State >= WritingBody {
+		return len(b), nil
+	}
 	n, err := w.Destination.Write(b)
+	if w.State == WritingBody {
+		w.bodyWritten += int64(n)
+	}
 	if err != nil {
 		return 0, err
 	}
 	return n, nil
 }
 
+// WriteStatusLine sets the status code. The status line itself is
+// written together with the headers, so header hooks can still change it.
 func (w *Writer) WriteStatusLine(s StatusCode) error {
 	if w.State != WritingStatusLine {
 		return fmt.Errorf("invalid state")
 	}
-	defer func() {
-		w.State = WritingHeaders
-	}()
-	switch s {
-	case OK:
-		_, err := w.Write([]byte("HTTP/1.1 200 OK\r\n"))
-		return err
-	case BadRequest:
-		_, err := w.Write([]byte("HTTP/1.1 400 Bad Request\r\n"))
-		return err
-	case ServerError:
-		_, err := w.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n"))
-		return err
-	default:
-		r := fmt.Sprintf("HTTP/1.1 %v ", s)
-		_, err := w.Write([]byte(r))
-		return err
-	}
+	w.StatusCode = s
+	w.State = WritingHeaders
+	return nil
 }
 
 func (w *Writer) WriteHeaders(h headers.Headers) error {
@@ -70,19 +197,130 @@ func (w *Writer) WriteHeaders(h headers.Headers) error {
 	defer func() {
 		w.State = WritingBody
 	}()
+	for _, hook := range w.headerHooks {
+		hook(w, h)
+	}
+	w.prepareHeaders(h)
+	head := fmt.Appendf(nil, "HTTP/%s %d %s\r\n", w.HTTPVersion, w.StatusCode, StatusText(w.StatusCode))
 	for k, v := range h {
-		_, err := w.Write(fmt.Appendf(nil, "%v: %v\r\n", k, v))
-		if err != nil {
-			return err
-		}
+		head = fmt.Appendf(head, "%v: %v\r\n", k, v)
 	}
-	_, err := w.Write([]byte("\r\n"))
+	head = append(head, "\r\n"...)
+	_, err := w.write(head)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// OnWriteHeaders registers fn to run when the headers are written, before
+// anything is sent. fn may change StatusCode and the headers, and call
+// EncodeBody. Hooks run in the order they were registered.
+func (w *Writer) OnWriteHeaders(fn func(w *Writer, h headers.Headers)) {
+	w.headerHooks = append(w.headerHooks, fn)
+}
+
+// OnFinish registers fn to run once Finish has ended the response, with
+// the error Finish returns. It also runs for a hijacked connection, when
+// the server is done with the request. Hooks run in the reverse order they
+// were registered, like deferred calls, so middleware that sees the
+// request first sees the finished response last.
+func (w *Writer) OnFinish(fn func(w *Writer, err error)) {
+	w.finishHooks = append(w.finishHooks, fn)
+}
+
+// EncodeBody routes the body through the encoder newEncoder returns, which
+// writes on to any encoder added before it and then to the connection.
+// Call it from a header hook, once the headers are final.
+func (w *Writer) EncodeBody(newEncoder func(dst io.Writer) BodyEncoder) {
+	next := w.body
+	if next == nil {
+		next = bodySink{w}
+	}
+	enc := newEncoder(next)
+	w.encoders = append(w.encoders, enc)
+	w.body = enc
+}
+
+// flushEncoders pushes out anything the body encoders are holding on to,
+// outermost first so each passes its output down the chain.
+func (w *Writer) flushEncoders() error {
+	for i := len(w.encoders) - 1; i >= 0; i-- {
+		if err := w.encoders[i].Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) closeEncoders() error {
+	encoders := w.encoders
+	w.encoders = nil
+	w.body = nil
+	for i := len(encoders) - 1; i >= 0; i-- {
+		if err := encoders[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareHeaders works out how the body will be delimited and adjusts the
+// Connection and Transfer-Encoding headers to match.
+func (w *Writer) prepareHeaders(h headers.Headers) {
+	if w.Headers != nil {
+		for k, v := range *w.Headers {
+			if h.Get(k) == "" {
+				h.Set(k, v)
+			}
+		}
+	}
+	if h.HasToken("Connection", "close") {
+		w.KeepAlive = false
+	}
+	w.bodyless = w.SuppressBody || w.StatusCode < 200 || w.StatusCode == 204 || w.StatusCode == 304
+	w.contentLength = -1
+	if cl, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		w.contentLength = cl
+	}
+	if h.HasToken("Transfer-Encoding", "chunked") {
+		if w.HTTPVersion == "1.0" {
+			// HTTP/1.0 clients can't decode chunks,
+			// so the body runs until the connection closes
+			h.Delete("Transfer-Encoding")
+			h.Delete("Trailer")
+			w.KeepAlive = false
+		} else {
+			w.chunked = true
+		}
+	} else if w.contentLength == -1 && !w.bodyless {
+		w.KeepAlive = false
+	}
+	switch {
+	case !w.KeepAlive && !h.HasToken("Connection", "close"):
+		h.Delete("Connection")
+		h.Set("Connection", "close")
+	case w.KeepAlive && w.HTTPVersion == "1.0" && h.Get("Connection") == "":
+		h.Set("Connection", "keep-alive")
+	}
+}
+
+// Complete reports whether a whole response, including any chunked
+// terminator and trailers, has been written.
+func (w *Writer) Complete() bool {
+	switch w.State {
+	case Done:
+		if w.contentLength != -1 && !w.bodyless {
+			return w.contentLength == w.bodyWritten
+		}
+		return !w.trailerPending
+	case WritingBody:
+		return w.bodyless || w.contentLength == w.bodyWritten
+	default:
+		return false
+	}
+}
+
 func (w *Writer) WriteBody(b []byte) (int, error) {
 	if w.State != WritingBody {
 		return 0, fmt.Errorf("invalid state")
@@ -90,34 +328,135 @@ func (w *Writer) WriteBody(b []byte) (int, error) {
 	defer func() {
 		w.State = Done
 	}()
-	n, err := w.Write(b)
+	n, err := w.writeBody(b)
 	if err != nil {
 		return 0, err
 	}
+	if err := w.closeEncoders(); err != nil {
+		return 0, err
+	}
+	// nothing else will be written, so end a chunked body here
+	if w.chunked {
+		if _, err := w.write([]byte("0\r\n\r\n")); err != nil {
+			return 0, err
+		}
+	}
 	return n, nil
 }
 
+// copyBufferSize is the size of the buffer ReadFrom copies through
+// when it can't hand the copy to the connection
+const copyBufferSize = 32 * 1024
+
+// ReadFrom copies the body from src, so io.Copy into a Writer uses it. When
+// the body goes out as-is, the copy is handed to the destination's own
+// ReadFrom, which for a *net.TCPConn and an *os.File (or an
+// *io.LimitedReader around one) lets the kernel send the file with
+// sendfile or splice. A *bufio.Writer in front of the connection passes
+// the copy on once it has been flushed. Otherwise, e.g. for a chunked or
+// encoded body or a TLS connection, the copy goes through a buffer. A
+// Content-Length caps how much is copied.
+func (w *Writer) ReadFrom(src io.Reader) (int64, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
+	if w.State != WritingBody {
+		return 0, fmt.Errorf("invalid state")
+	}
+	if w.SuppressBody {
+		return io.Copy(io.Discard, src)
+	}
+	if w.contentLength != -1 {
+		remaining := w.contentLength - w.bodyWritten
+		// sendfile and splice look through only one *io.LimitedReader
+		// for the file, so one already limited is capped, not wrapped
+		if lr, ok := src.(*io.LimitedReader); ok {
+			if lr.N > remaining {
+				extra := lr.N - remaining
+				lr.N = remaining
+				defer func() { lr.N += extra }()
+			}
+		} else {
+			src = io.LimitReader(src, remaining)
+		}
+	}
+	if dst, ok := w.Destination.(io.ReaderFrom); ok && !w.chunked && w.body == nil {
+		// the head has to go out first, then the destination can hand
+		// the rest to the kernel
+		if err := w.flushDestination(); err != nil {
+			return 0, err
+		}
+		n, err := dst.ReadFrom(src)
+		w.bodyWritten += n
+		w.bodySent += n
+		return n, err
+	}
+	var written int64
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.writeBody(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if errors.Is(err, io.EOF) {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// WriteChunkedBody writes b as the next chunk of the body. Body encoders
+// are flushed after it so a streamed body goes out as it is written.
 func (w *Writer) WriteChunkedBody(b []byte) error {
 	if w.State != WritingBody {
 		return fmt.Errorf("invalid state")
 	}
-	// Write the length of the chunk
-	if _, err := fmt.Fprintf(w, "%X\r\n", len(b)); err != nil {
-		return err
+	if w.body != nil {
+		if _, err := w.body.Write(b); err != nil {
+			return err
+		}
+		return w.flushEncoders()
 	}
-	// Write the chunk, in raw bytes
-	if _, err := w.Write(b); err != nil {
+	_, err := bodySink{w}.Write(b)
+	return err
+}
+
+func (w *Writer) writeChunk(b []byte) error {
+	if _, err := chunked.NewWriter(destination{w}).Write(b); err != nil {
 		return err
 	}
-	// Write the trailing newline
-	if _, err := w.Write([]byte("\r\n")); err != nil {
-		return err
+	if w.FlushChunks {
+		return w.flushDestination()
 	}
 	return nil
 }
 
+// destination writes straight to the destination, past the body
+// pipeline, for the chunked framing.
+type destination struct {
+	w *Writer
+}
+
+func (d destination) Write(b []byte) (int, error) {
+	return d.w.write(b)
+}
+
 func (w *Writer) WriteChunkedBodyDone() error {
+	if w.State == WritingBody {
+		if err := w.closeEncoders(); err != nil {
+			return err
+		}
+	}
 	w.State = Done
+	if !w.chunked {
+		return nil
+	}
+	w.trailerPending = true
 	_, err := w.Write([]byte("0\r\n"))
 	if err != nil {
 		return err
@@ -129,6 +468,10 @@ func (w *Writer) WriteTrailer(t headers.Headers) error {
 	if w.State != Done {
 		return fmt.Errorf("invalid state for writing trailers")
 	}
+	if !w.chunked {
+		return nil
+	}
+	w.trailerPending = false
 	for k, v := range t {
 		_, err := fmt.Fprintf(w, "%v: %v\r\n", k, v)
 		if err != nil {
@@ -141,3 +484,48 @@ func (w *Writer) WriteTrailer(t headers.Headers) error {
 	}
 	return nil
 }
+
+// Finish completes a response the handler left open. It sends an empty
+// 200 if the handler wrote nothing, flushes any body encoders, ends a
+// chunked body and its trailers, and does nothing for a response that is
+// already complete or a hijacked connection. Then it runs
+// the OnFinish hooks. The server calls it after the handler returns.
+func (w *Writer) Finish() error {
+	err := w.finish()
+	hooks := w.finishHooks
+	w.finishHooks = nil
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i](w, err)
+	}
+	return err
+}
+
+func (w *Writer) finish() error {
+	if w.hijacked {
+		return nil
+	}
+	switch w.State {
+	case WritingStatusLine:
+		if err := w.WriteStatusLine(OK); err != nil {
+			return err
+		}
+		if err := w.WriteHeaders(GetDefaultHeaders(0)); err != nil {
+			return err
+		}
+		return w.finish()
+	case WritingBody:
+		if w.bodyless {
+			w.State = Done
+			return w.closeEncoders()
+		}
+		if err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+		return w.WriteTrailer(headers.Headers{})
+	case Done:
+		if w.trailerPending {
+			return w.WriteTrailer(headers.Headers{})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+)
+
+// readerFromDest records what it was asked to copy from,
+// standing in for a *net.TCPConn
+type readerFromDest struct {
+	bytes.Buffer
+	src io.Reader
+}
+
+func (d *readerFromDest) ReadFrom(r io.Reader) (int64, error) {
+	d.src = r
+	return d.Buffer.ReadFrom(r)
+}
+
+// plainDest hides bytes.Buffer's ReadFrom, standing in for a TLS connection
+type plainDest struct {
+	buf bytes.Buffer
+}
+
+func (d *plainDest) Write(b []byte) (int, error) {
+	return d.buf.Write(b)
+}
+
+func startBody(t *testing.T, w *Writer, h headers.Headers) {
+	t.Helper()
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(h))
+}
+
+func TestReadFromHandsFileToDestination(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "body")
+	require.NoError(t, os.WriteFile(name, []byte("hello world"), 0o644))
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	dest := &readerFromDest{}
+	w := NewWriter(dest, &headers.Headers{})
+	startBody(t, w, GetDefaultHeaders(11))
+	n, err := io.Copy(w, f)
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+
+	// the file must still be reachable as one for sendfile to kick in
+	lr, ok := dest.src.(*io.LimitedReader)
+	require.True(t, ok)
+	assert.Implements(t, (*syscall.Conn)(nil), lr.R)
+	assert.True(t, strings.HasSuffix(dest.String(), "\r\n\r\nhello world"))
+	assert.True(t, w.Complete())
+}
+
+func TestReadFromCapsAtContentLength(t *testing.T) {
+	dest := &readerFromDest{}
+	w := NewWriter(dest, &headers.Headers{})
+	startBody(t, w, GetDefaultHeaders(5))
+	n, err := w.ReadFrom(strings.NewReader("hello world"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	assert.True(t, strings.HasSuffix(dest.String(), "\r\n\r\nhello"))
+
+	// a reader that is already limited keeps what wasn't copied
+	dest = &readerFromDest{}
+	w = NewWriter(dest, &headers.Headers{})
+	startBody(t, w, GetDefaultHeaders(5))
+	lr := &io.LimitedReader{R: strings.NewReader("hello world"), N: 8}
+	n, err = w.ReadFrom(lr)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	assert.Same(t, lr, dest.src)
+	assert.Equal(t, int64(3), lr.N)
+}
+
+func TestReadFromChunked(t *testing.T) {
+	dest := &readerFromDest{}
+	w := NewWriter(dest, &headers.Headers{})
+	startBody(t, w, headers.Headers{"Transfer-Encoding": "chunked"})
+	_, err := io.Copy(w, strings.NewReader("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteChunkedBodyDone())
+	require.NoError(t, w.WriteTrailer(headers.Headers{}))
+	assert.Nil(t, dest.src)
+	assert.True(t, strings.HasSuffix(dest.String(), "\r\n\r\nB\r\nhello world\r\n0\r\n\r\n"))
+}
+
+func TestReadFromWithoutReaderFrom(t *testing.T) {
+	dest := &plainDest{}
+	w := NewWriter(dest, &headers.Headers{})
+	startBody(t, w, GetDefaultHeaders(11))
+	_, err := io.Copy(w, strings.NewReader("hello world"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(dest.buf.String(), "\r\n\r\nhello world"))
+	assert.True(t, w.Complete())
+}
+
+func TestHijack(t *testing.T) {
+	w := NewWriter(&bytes.Buffer{}, &headers.Headers{})
+	_, _, err := w.Hijack()
+	assert.ErrorIs(t, err, ErrNotHijackable)
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+	w.Hijacker = func() (net.Conn, *bufio.Reader, error) {
+		return server, bufio.NewReader(server), nil
+	}
+	conn, _, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Equal(t, server, conn)
+	assert.True(t, w.Hijacked())
+
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, ErrHijacked)
+	_, err = w.Write([]byte("late"))
+	assert.ErrorIs(t, err, ErrHijacked)
+	_, err = w.ReadFrom(strings.NewReader("late"))
+	assert.ErrorIs(t, err, ErrHijacked)
+	assert.ErrorIs(t, w.Flush(), ErrHijacked)
+	assert.Error(t, w.WriteStatusLine(OK))
+}
+
+func TestOnFinish(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, &headers.Headers{})
+	var order []string
+	w.OnFinish(func(w *Writer, err error) {
+		order = append(order, "outer")
+		assert.NoError(t, err)
+		assert.True(t, w.Complete())
+	})
+	w.OnFinish(func(w *Writer, err error) {
+		order = append(order, "inner")
+	})
+	startBody(t, w, headers.Headers{"Transfer-Encoding": "chunked"})
+	require.NoError(t, w.WriteChunkedBody([]byte("open")))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, []string{"inner", "outer"}, order)
+	assert.True(t, strings.HasSuffix(buf.String(), "0\r\n\r\n"))
+
+	// hooks run once
+	require.NoError(t, w.Finish())
+	assert.Len(t, order, 2)
+
+	server, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+	w = NewWriter(&bytes.Buffer{}, &headers.Headers{})
+	w.Hijacker = func() (net.Conn, *bufio.Reader, error) {
+		return server, bufio.NewReader(server), nil
+	}
+	hijacked := false
+	w.OnFinish(func(w *Writer, err error) {
+		hijacked = w.Hijacked()
+	})
+	_, _, err := w.Hijack()
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, hijacked)
+}
+
+func TestFinishWithoutResponse(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, &headers.Headers{})
+	require.NoError(t, w.Finish())
+	assert.Equal(t, OK, w.StatusCode)
+	assert.True(t, w.Complete())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, buf.String(), "Content-Length: 0\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+}
+
+func TestFlush(t *testing.T) {
+	var out bytes.Buffer
+	bw := bufio.NewWriter(&out)
+	w := NewWriter(bw, &headers.Headers{})
+	var _ Flusher = w
+	startBody(t, w, headers.Headers{"Transfer-Encoding": "chunked"})
+	require.NoError(t, w.WriteChunkedBody([]byte("held")))
+	assert.Equal(t, 0, out.Len(), "nothing leaves the buffer unflushed")
+
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(out.String(), "4\r\nheld\r\n"))
+
+	w.FlushChunks = true
+	require.NoError(t, w.WriteChunkedBody([]byte("sent")))
+	assert.True(t, strings.HasSuffix(out.String(), "4\r\nsent\r\n"))
+}
+
+func TestReadFromFlushesHeadFirst(t *testing.T) {
+	dest := &readerFromDest{}
+	bw := bufio.NewWriter(dest)
+	w := NewWriter(bw, &headers.Headers{})
+	startBody(t, w, GetDefaultHeaders(4))
+	_, err := w.ReadFrom(strings.NewReader("body"))
+	require.NoError(t, err)
+	require.NoError(t, bw.Flush())
+	assert.True(t, strings.HasSuffix(dest.String(), "\r\n\r\nbody"))
+	// the head went out before the copy was handed on
+	assert.NotNil(t, dest.src)
+}
+
+func TestBytesWritten(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, &headers.Headers{})
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"}))
+	require.NoError(t, w.WriteChunkedBody([]byte("hello ")))
+	_, err := io.Copy(w, strings.NewReader("world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	// the chunk framing isn't counted
+	assert.Equal(t, int64(11), w.BytesWritten())
+
+	w = NewWriter(&readerFromDest{}, &headers.Headers{})
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.ReadFrom(strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), w.BytesWritten())
+
+	w = NewWriter(&buf, &headers.Headers{})
+	w.SuppressBody = true
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Zero(t, w.BytesWritten())
+}
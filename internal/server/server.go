@@ -2,21 +2,169 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
-	"log"
+	"html"
+	"io"
+	"log/slog"
 	"net"
+	"os"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/k4rldoherty/http-from-tcp/internal/headers"
 	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/requestid"
 	"github.com/k4rldoherty/http-from-tcp/internal/response"
 )
 
+const (
+	DefaultIdleTimeout     = 60 * time.Second
+	DefaultWriteBufferSize = 4096
+)
+
 type Server struct {
 	Port     int
 	Listener net.Listener
 	IsOpen   *atomic.Bool
 	Handler  Handler
+	// IdleTimeout is how long a kept-alive connection
+	// may wait for its next request before it is closed
+	IdleTimeout time.Duration
+	// StrictParsing rejects ambiguous requests, see request.Reader
+	StrictParsing bool
+	// ImmediateContinue sends 100 Continue as soon as the headers of an
+	// "Expect: 100-continue" request are read, instead of waiting for the
+	// handler to read the body.
+	ImmediateContinue bool
+	// DecodeRequestBodies undoes gzip and deflate request bodies before the
+	// handler sees them, up to MaxDecodedBodySize bytes once decoded. Zero
+	// means request.DefaultMaxDecodedSize and a negative size no limit.
+	DecodeRequestBodies bool
+	MaxDecodedBodySize  int64
+	// WriteBufferSize is the size of the buffer responses are written
+	// through, so the pieces of a response go out in as few writes as
+	// possible. It is flushed at the end of each response.
+	WriteBufferSize int
+	// FlushChunks flushes the buffer after every chunk of a chunked body,
+	// so streamed responses reach the client as they are written
+	FlushChunks bool
+	// Tunneling opens a tunnel for each CONNECT request the handler
+	// approves, see tunnel.go
+	Tunneling bool
+	// Logger is where the server logs. Each connection logs with its ID
+	// and remote address, and each request adds its method, target and
+	// request ID, see response.Writer.Logger.
+	Logger *slog.Logger
+	// RequestIDFormat is the format of the ID each request is given. The
+	// ID is on the request's context, see requestid.FromContext, and sent
+	// back in the X-Request-Id response header.
+	RequestIDFormat requestid.Format
+	// TrustRequestIDs keeps the X-Request-Id a request comes with instead
+	// of making a new one, for servers behind a proxy that sets it
+	TrustRequestIDs bool
+	// Observer, when set, is told about each connection and about
+	// requests that can't be read, which never reach the handler
+	Observer Observer
+
+	connID atomic.Uint64
+}
+
+// Observer follows what the server does below the handler, e.g. to keep
+// metrics. Its methods are called from every connection's goroutine.
+type Observer interface {
+	ConnOpened()
+	ConnClosed()
+	// RequestError is called with the error a request couldn't be read
+	// with, before the error response is sent
+	RequestError(err error)
+}
+
+// Option configures a Server before it starts accepting connections.
+type Option func(*Server)
+
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.IdleTimeout = d
+	}
+}
+
+// WithStrictParsing turns on RFC 9112 request validation. Use it when the
+// server sits behind a proxy so both agree on where each request ends.
+func WithStrictParsing() Option {
+	return func(s *Server) {
+		s.StrictParsing = true
+	}
+}
+
+func WithImmediateContinue() Option {
+	return func(s *Server) {
+		s.ImmediateContinue = true
+	}
+}
+
+// WithRequestDecompression decodes request bodies sent with a gzip or
+// deflate Content-Encoding. Bodies that decode to more than maxSize bytes
+// are refused with 413, unknown codings with 415. A maxSize of zero uses
+// request.DefaultMaxDecodedSize, a negative one lifts the limit.
+func WithRequestDecompression(maxSize int64) Option {
+	return func(s *Server) {
+		s.DecodeRequestBodies = true
+		s.MaxDecodedBodySize = maxSize
+	}
+}
+
+func WithWriteBufferSize(size int) Option {
+	return func(s *Server) {
+		s.WriteBufferSize = size
+	}
+}
+
+// WithBufferedChunks lets the chunks of a chunked body collect in the write
+// buffer instead of flushing each one, for handlers that call Flush on the
+// response.Writer themselves.
+func WithBufferedChunks() Option {
+	return func(s *Server) {
+		s.FlushChunks = false
+	}
+}
+
+// WithLogger sets the logger the server logs to instead of slog.Default().
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.Logger = l
+	}
+}
+
+func WithRequestIDFormat(f requestid.Format) Option {
+	return func(s *Server) {
+		s.RequestIDFormat = f
+	}
+}
+
+// WithTrustedRequestIDs uses the X-Request-Id of each request that has a
+// valid one. Only use it when every request comes through a proxy that
+// sets or strips the header, or clients can pick their own IDs.
+func WithTrustedRequestIDs() Option {
+	return func(s *Server) {
+		s.TrustRequestIDs = true
+	}
+}
+
+func WithObserver(o Observer) Option {
+	return func(s *Server) {
+		s.Observer = o
+	}
+}
+
+// WithTunneling turns on CONNECT tunneling, for use as a forward proxy.
+func WithTunneling() Option {
+	return func(s *Server) {
+		s.Tunneling = true
+	}
 }
 
 type HandlerError struct {
@@ -26,38 +174,80 @@ type HandlerError struct {
 
 type Handler func(rw *response.Writer, r *request.Request)
 
+// Middleware wraps a Handler to add behaviour around it.
+type Middleware func(next Handler) Handler
+
+// Chain applies middleware to h so that the first one listed is outermost
+// and sees the request first.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// WriteError sends an error page with body, naming the request ID if the
+// response has one so the client can quote it.
 func WriteError(w *response.Writer, err *HandlerError, body string) {
-	w = response.NewWriter(w.Destination, w.Headers)
+	// once part of a response is out, the error can only follow it
+	if w.State != response.WritingStatusLine {
+		version := w.HTTPVersion
+		logger := w.Logger
+		w = response.NewWriter(w.Destination, w.Headers)
+		w.HTTPVersion = version
+		w.Logger = logger
+	}
+	if w.Headers != nil {
+		if id := w.Headers.Get(requestid.Header); id != "" {
+			body += "\n<p>Request ID: " + html.EscapeString(id) + "</p>"
+		}
+	}
+	logger := w.Logger.With("status", err.Code)
+	logger.Debug("writing error response", "message", err.Message)
 	if e := w.WriteStatusLine(response.StatusCode(err.Code)); e != nil {
-		log.Printf("error writing status line: %v\n", e)
+		logger.Warn("error writing status line", "err", e)
 		return
 	}
 	h := response.GetDefaultHeaders(len([]byte(body)))
 	h.Set("Content-Type", "text/html")
 	if e := w.WriteHeaders(h); e != nil {
-		log.Printf("error writing headers: %v\n", e)
+		logger.Warn("error writing headers", "err", e)
 		return
 	}
 	if _, e := w.WriteBody([]byte(body)); e != nil {
-		log.Printf("error writing body: %v\n", e)
+		logger.Warn("error writing body", "err", e)
 		return
 	}
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
+// New makes a Server for handler with the default settings and opts,
+// without listening for connections. Serve makes one and starts listening,
+// ServeConn serves a single connection with it.
+func New(handler Handler, opts ...Option) *Server {
+	s := &Server{
+		IsOpen:          &atomic.Bool{},
+		Handler:         handler,
+		IdleTimeout:     DefaultIdleTimeout,
+		WriteBufferSize: DefaultWriteBufferSize,
+		FlushChunks:     true,
+		Logger:          slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	s := New(handler, opts...)
 	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
 	if err != nil {
-		log.Printf("Serve: %v", err)
+		s.Logger.Error("error listening", "port", port, "err", err)
 		return nil, err
 	}
-	state := atomic.Bool{}
-	state.Store(true)
-	s := &Server{
-		Port:     port,
-		Listener: l,
-		IsOpen:   &state,
-		Handler:  handler,
-	}
+	s.Port = l.Addr().(*net.TCPAddr).Port
+	s.Listener = l
+	s.IsOpen.Store(true)
 	go s.listen()
 	return s, nil
 }
@@ -66,7 +256,7 @@ func (s *Server) Close() error {
 	s.IsOpen.Store(false)
 	err := s.Listener.Close()
 	if err != nil {
-		log.Printf("Close: %v", err)
+		s.Logger.Error("error closing listener", "err", err)
 		return err
 	}
 	return nil
@@ -77,32 +267,186 @@ func (s *Server) listen() {
 		conn, err := s.Listener.Accept()
 		if err != nil {
 			if s.IsOpen.Load() {
-				log.Printf("Listen: %v", err)
+				s.Logger.Error("error accepting connection", "err", err)
 			}
 			continue
 		}
-		go s.handle(conn)
+		go s.ServeConn(conn)
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
+// ServeConn reads requests from conn and answers them until the client
+// is done with it, then closes it. It blocks until then. Connections the
+// listener accepts are served with it, and others can be handed to it,
+// e.g. an in-memory one in tests.
+func (s *Server) ServeConn(conn net.Conn) {
+	logger := s.Logger.With("conn", s.connID.Add(1), "remote_addr", conn.RemoteAddr().String())
+	logger.Debug("connection opened")
+	if s.Observer != nil {
+		s.Observer.ConnOpened()
+		defer s.Observer.ConnClosed()
+	}
+	// a hijacked connection belongs to the handler that took it
+	hijacked := false
+	bw := bufio.NewWriterSize(conn, s.WriteBufferSize)
 	defer func() {
+		if hijacked {
+			logger.Debug("connection hijacked")
+			return
+		}
+		if err := bw.Flush(); err != nil {
+			logger.Warn("error flushing response", "err", err)
+		}
 		if err := conn.Close(); err != nil {
-			log.Printf("error closing connection: %v\n", err)
+			logger.Warn("error closing connection", "err", err)
 			return
 		}
+		logger.Debug("connection closed")
 	}()
 
-	reqWriter := response.NewWriter(conn, &headers.Headers{})
+	rd := request.NewReader(conn)
+	rd.Strict = s.StrictParsing
+	rd.DecodeBodies = s.DecodeRequestBodies
+	rd.MaxDecodedSize = s.MaxDecodedBodySize
+	// current is the response being written, an interim response must not
+	// follow it once its head is out of the buffer
+	var current *response.Writer
+	rd.SendContinue = func() error {
+		if current != nil && current.State >= response.WritingBody {
+			return nil
+		}
+		if _, err := io.WriteString(bw, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+	for served := 0; ; served++ {
+		if served > 0 && s.IdleTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(s.IdleTimeout)); err != nil {
+				logger.Error("error setting idle timeout", "err", err)
+				return
+			}
+		}
+		r, err := rd.ReadRequestHead()
+		if err != nil {
+			// the client closed or went quiet between requests
+			if errors.Is(err, io.EOF) || (served > 0 && errors.Is(err, os.ErrDeadlineExceeded)) {
+				return
+			}
+			id := s.RequestIDFormat.New()
+			w := response.NewWriter(bw, &headers.Headers{requestid.Header: id})
+			w.Logger = logger.With("request_id", id)
+			w.Logger.Warn("error reading request", "err", err)
+			s.requestError(err)
+			WriteError(w, requestError(err), "Could not form a request from data recieved")
+			return
+		}
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			logger.Error("error clearing read deadline", "err", err)
+			return
+		}
+		r.RemoteAddr = conn.RemoteAddr().String()
+		id := s.requestID(r)
+		r.SetContext(requestid.NewContext(r.Context(), id))
 
-	r, err := request.RequestFromReader(conn)
-	if err != nil {
-		log.Printf("handle: %v", err)
-		WriteError(reqWriter, &HandlerError{
-			Code:    400,
-			Message: "Bad Request",
-		}, "Could not form a request from data recieved")
-		return
+		reqWriter := response.NewWriter(bw, &headers.Headers{requestid.Header: id})
+		reqWriter.Logger = logger.With("method", r.RequestLine.Method, "target", r.RequestLine.Target, "request_id", id)
+		current = reqWriter
+		reqWriter.HTTPVersion = r.RequestLine.HTTPVersion
+		reqWriter.KeepAlive = r.KeepAlive()
+		reqWriter.SuppressBody = r.RequestLine.Method == "HEAD"
+		reqWriter.FlushChunks = s.FlushChunks
+		reqWriter.Hijacker = func() (net.Conn, *bufio.Reader, error) {
+			// whatever the handler wrote before taking over goes first
+			if err := bw.Flush(); err != nil {
+				return nil, nil, err
+			}
+			hijacked = true
+			leftover := bytes.Clone(rd.Buffered())
+			return conn, bufio.NewReader(io.MultiReader(bytes.NewReader(leftover), conn)), nil
+		}
+		// HTTP/1.0 requests' expectations are ignored (RFC 9110 section 10.1.1)
+		if expect := r.Headers.Get("expect"); expect != "" && r.RequestLine.HTTPVersion != "1.0" && !r.Headers.HasToken("expect", "100-continue") {
+			err := fmt.Errorf("%w: %s", request.ErrUnsupportedExpectation, expect)
+			s.requestError(err)
+			WriteError(reqWriter, requestError(err), "Only 100-continue expectations are supported")
+			return
+		}
+		if r.ExpectsContinue() {
+			// leave the body for the handler, which may refuse it
+			// with a 413 or 417 before the client ever sends it
+			if s.ImmediateContinue {
+				if err := rd.Continue(r); err != nil {
+					reqWriter.Logger.Warn("error sending 100 Continue", "err", err)
+					return
+				}
+			}
+		} else if err := r.ReadBody(); err != nil {
+			reqWriter.Logger.Warn("error reading request body", "err", err)
+			s.requestError(err)
+			WriteError(reqWriter, requestError(err), "Could not form a request from data recieved")
+			return
+		}
+		tunnel := s.Tunneling && r.RequestLine.Method == "CONNECT"
+		if tunnel && !validAuthority(r.RequestLine.Target) {
+			WriteError(reqWriter, &HandlerError{
+				Code:    400,
+				Message: "Bad Request",
+			}, "CONNECT needs a host:port target")
+			return
+		}
+		s.Handler(reqWriter, r)
+		// a handler approves a tunnel by leaving the response to the server
+		tunnelled := tunnel && !hijacked && reqWriter.State == response.WritingStatusLine
+		if tunnelled {
+			s.tunnel(reqWriter, r)
+		}
+		if err := reqWriter.Finish(); err != nil {
+			reqWriter.Logger.Warn("error finishing response", "err", err)
+			return
+		}
+		if hijacked || tunnelled {
+			return
+		}
+		if err := bw.Flush(); err != nil {
+			reqWriter.Logger.Warn("error flushing response", "err", err)
+			return
+		}
+		// a body the handler left unread is still on the connection
+		if r.State != request.Done || !reqWriter.KeepAlive || !reqWriter.Complete() {
+			return
+		}
+	}
+}
+
+func (s *Server) requestError(err error) {
+	if s.Observer != nil {
+		s.Observer.RequestError(err)
+	}
+}
+
+// requestID picks the ID of r, the one it came with if that is trusted.
+func (s *Server) requestID(r *request.Request) string {
+	if s.TrustRequestIDs {
+		if id := strings.TrimSpace(r.Headers.Get(requestid.Header)); requestid.Valid(id) {
+			return id
+		}
+	}
+	return s.RequestIDFormat.New()
+}
+
+// requestError picks the response for a request that couldn't be read.
+func requestError(err error) *HandlerError {
+	switch {
+	case errors.Is(err, request.ErrUnsupportedEncoding):
+		return &HandlerError{Code: 415, Message: "Unsupported Media Type"}
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return &HandlerError{Code: 413, Message: "Content Too Large"}
+	case errors.Is(err, headers.ErrHeadTooLarge):
+		return &HandlerError{Code: 431, Message: "Request Header Fields Too Large"}
+	case errors.Is(err, request.ErrUnsupportedExpectation):
+		return &HandlerError{Code: 417, Message: "Expectation Failed"}
+	default:
+		return &HandlerError{Code: 400, Message: "Bad Request"}
 	}
-	s.Handler(reqWriter, r)
 }
@@ -0,0 +1,491 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/requestid"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+)
+
+func chunkedHandler(w *response.Writer, r *request.Request) {
+	_ = w.WriteStatusLine(response.OK)
+	h := headers.Headers{}
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Done")
+	_ = w.WriteHeaders(h)
+	_ = w.WriteChunkedBody([]byte("hello "))
+	_ = w.WriteChunkedBody([]byte("world"))
+	_ = w.WriteChunkedBodyDone()
+	_ = w.WriteTrailer(headers.Headers{"X-Done": "yes"})
+}
+
+func startServer(t *testing.T, handler Handler) net.Conn {
+	t.Helper()
+	s, err := Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestHTTP10ChunkedFallback(t *testing.T) {
+	conn := startServer(t, chunkedHandler)
+	_, err := io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+
+	// the body is delimited by the server closing the connection
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	res := string(raw)
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.0 200 OK\r\n"))
+	assert.Contains(t, res, "Connection: close\r\n")
+	assert.NotContains(t, res, "Transfer-Encoding")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nhello world"))
+}
+
+func TestKeepAliveServesMultipleRequests(t *testing.T) {
+	conn := startServer(t, chunkedHandler)
+	br := bufio.NewReader(conn)
+	for range 2 {
+		_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+		for {
+			line, err = br.ReadString('\n')
+			require.NoError(t, err)
+			if line == "X-Done: yes\r\n" {
+				break
+			}
+		}
+		line, err = br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "\r\n", line)
+	}
+}
+
+func TestDefaultHeadersKeepAlive(t *testing.T) {
+	conn := startServer(t, func(w *response.Writer, r *request.Request) {
+		WriteError(w, &HandlerError{Code: 404, Message: "Not Found"}, "")
+	})
+	rd := response.NewReader(conn)
+	for range 2 {
+		_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		res, err := rd.ReadResponse("GET")
+		require.NoError(t, err)
+		assert.Equal(t, response.NotFound, res.StatusLine.StatusCode)
+		assert.Empty(t, res.Headers.Get("connection"))
+	}
+}
+
+func echoHandler(w *response.Writer, r *request.Request) {
+	body, err := io.ReadAll(r.BodyReader())
+	if err != nil {
+		return
+	}
+	_ = w.WriteStatusLine(response.OK)
+	_ = w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	_, _ = w.WriteBody(body)
+}
+
+func TestExpectContinueSentOnBodyRead(t *testing.T) {
+	conn := startServer(t, echoHandler)
+	br := bufio.NewReader(conn)
+	_, err := io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+	line, err = br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(rest), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\nhello"))
+}
+
+func TestExpectContinueRejectedWithoutReadingBody(t *testing.T) {
+	conn := startServer(t, func(w *response.Writer, r *request.Request) {
+		_ = w.WriteStatusLine(response.ContentTooLarge)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	_, err := io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 999999\r\n\r\n")
+	require.NoError(t, err)
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.1 413 Content Too Large\r\n"))
+	assert.NotContains(t, string(raw), "100 Continue")
+}
+
+func TestImmediateContinue(t *testing.T) {
+	s, err := Serve(0, echoHandler, WithImmediateContinue())
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\n")
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+}
+
+func TestUnknownExpectation(t *testing.T) {
+	conn := startServer(t, echoHandler)
+	_, err := io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: teapot\r\nContent-Length: 2\r\n\r\nhi")
+	require.NoError(t, err)
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.1 417 Expectation Failed\r\n"))
+}
+
+func TestHTTP10ExpectationIgnored(t *testing.T) {
+	conn := startServer(t, echoHandler)
+	_, err := io.WriteString(conn, "POST / HTTP/1.0\r\nExpect: teapot\r\nContent-Length: 2\r\n\r\nhi")
+	require.NoError(t, err)
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.0 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(raw), "\r\n\r\nhi"))
+}
+
+func TestHeadTooLarge(t *testing.T) {
+	conn := startServer(t, echoHandler)
+	go func() {
+		_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: "+strings.Repeat("a", headers.MaxHeadSize)+"\r\n\r\n")
+	}()
+	res, err := response.NewReader(conn).ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCode(431), res.StatusLine.StatusCode)
+}
+
+func TestUnsupportedRequestEncoding(t *testing.T) {
+	s, err := Serve(0, echoHandler, WithRequestDecompression(1<<20))
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: br\r\nContent-Length: 2\r\n\r\nhi")
+	require.NoError(t, err)
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.1 415 Unsupported Media Type\r\n"))
+}
+
+// echoListener accepts a single connection and echoes what it receives
+func echoListener(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = io.Copy(conn, conn)
+	}()
+	return l.Addr().String()
+}
+
+func startTunnel(t *testing.T, handler Handler) net.Conn {
+	t.Helper()
+	s, err := Serve(0, handler, WithTunneling())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestConnectTunnel(t *testing.T) {
+	target := echoListener(t)
+	conn := startTunnel(t, func(w *response.Writer, r *request.Request) {})
+
+	// bytes sent before the 200 arrives still reach the target
+	_, err := io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\nearly ")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", line)
+	line, err = br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+
+	_, err = io.WriteString(conn, "late")
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "early late", string(rest))
+}
+
+func TestConnectRefusedByHandler(t *testing.T) {
+	target := echoListener(t)
+	conn := startTunnel(t, func(w *response.Writer, r *request.Request) {
+		WriteError(w, &HandlerError{Code: 403, Message: "Forbidden"}, "")
+	})
+	_, err := io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.1 403 Forbidden\r\n"))
+}
+
+func TestConnectErrors(t *testing.T) {
+	tests := map[string]struct {
+		raw  string
+		want string
+	}{
+		"not authority-form": {
+			raw:  "CONNECT /path HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			want: "HTTP/1.1 400 Bad Request\r\n",
+		},
+		// nothing listens on port 1
+		"unreachable target": {
+			raw:  "CONNECT localhost:1 HTTP/1.1\r\nHost: localhost:1\r\n\r\n",
+			want: "HTTP/1.1 502 Bad Gateway\r\n",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			conn := startTunnel(t, func(w *response.Writer, r *request.Request) {})
+			_, err := io.WriteString(conn, tt.raw)
+			require.NoError(t, err)
+			res, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(res), tt.want), string(res))
+		})
+	}
+}
+
+func TestHijack(t *testing.T) {
+	handlerDone := make(chan struct{})
+	conn := startServer(t, func(w *response.Writer, r *request.Request) {
+		c, br, err := w.Hijack()
+		if err != nil {
+			return
+		}
+		_, _ = io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\n\r\n")
+		go func() {
+			// the connection outlives the handler
+			<-handlerDone
+			defer func() { _ = c.Close() }()
+			_, _ = io.Copy(c, br)
+		}()
+	})
+	// bytes sent straight after the request are kept for the new owner
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\n\r\nearly ")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", line)
+	close(handlerDone)
+
+	_, err = io.WriteString(conn, "late")
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "Upgrade: echo\r\n\r\nearly late", string(rest))
+}
+
+// countingConn counts the writes made to the connection
+type countingConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+func TestOneWritePerChunk(t *testing.T) {
+	release := make(chan struct{})
+	s := New(func(w *response.Writer, r *request.Request) {
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"})
+		_ = w.WriteChunkedBody([]byte("first"))
+		<-release
+		_ = w.WriteChunkedBody([]byte("second"))
+	})
+	client, srv := net.Pipe()
+	defer func() { _ = client.Close() }()
+	conn := &countingConn{Conn: srv}
+	go s.ServeConn(conn)
+	go func() {
+		_, _ = io.WriteString(client, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	}()
+
+	// the head goes out with the first chunk, which isn't held back
+	// waiting for the rest of the body
+	br := bufio.NewReader(client)
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "first\r\n" {
+			break
+		}
+	}
+	assert.Equal(t, int32(1), conn.writes.Load())
+
+	close(release)
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "6\r\nsecond\r\n0\r\n\r\n", string(rest))
+	assert.Equal(t, int32(3), conn.writes.Load())
+}
+
+func TestNoContinueAfterFinalResponse(t *testing.T) {
+	conn := startServer(t, func(w *response.Writer, r *request.Request) {
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(2))
+		_, _ = io.ReadAll(r.BodyReader())
+		_, _ = w.WriteBody([]byte("ok"))
+	})
+	_, err := io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	// the client gives up waiting for a 100 and sends the body anyway
+	time.Sleep(20 * time.Millisecond)
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.1 200 OK\r\n"))
+	assert.NotContains(t, string(raw), "100 Continue")
+}
+
+// logBuffer collects log lines written from the server's goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records decodes the JSON log lines written so far
+func (b *logBuffer) records(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var recs []map[string]any
+	for line := range strings.Lines(b.buf.String()) {
+		var rec map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestLogger(t *testing.T) {
+	var logs logBuffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s, err := Serve(0, func(w *response.Writer, r *request.Request) {
+		w.Logger.Info("handled")
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(headers.Headers{"Content-Length": "0"})
+	}, WithLogger(logger), WithTrustedRequestIDs())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	rd := response.NewReader(conn)
+	_, err = io.WriteString(conn, "GET /a HTTP/1.1\r\nHost: x\r\nX-Request-Id: abc\r\n\r\n")
+	require.NoError(t, err)
+	res, err := rd.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, res.StatusLine.StatusCode)
+	_, err = io.WriteString(conn, "not a request\r\n\r\n")
+	require.NoError(t, err)
+	res, err = rd.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusCode(400), res.StatusLine.StatusCode)
+
+	require.Eventually(t, func() bool {
+		recs := logs.records(t)
+		return len(recs) > 0 && recs[len(recs)-1]["msg"] == "connection closed"
+	}, time.Second, 5*time.Millisecond)
+	byMsg := map[string]map[string]any{}
+	for _, rec := range logs.records(t) {
+		// every line says which connection it's about
+		assert.Equal(t, float64(1), rec["conn"])
+		assert.Equal(t, conn.LocalAddr().String(), rec["remote_addr"])
+		byMsg[rec["msg"].(string)] = rec
+	}
+
+	handled := byMsg["handled"]
+	require.NotNil(t, handled)
+	assert.Equal(t, "GET", handled["method"])
+	assert.Equal(t, "/a", handled["target"])
+	assert.Equal(t, "abc", handled["request_id"])
+
+	bad := byMsg["error reading request"]
+	require.NotNil(t, bad)
+	assert.Equal(t, "WARN", bad["level"])
+	assert.NotEmpty(t, bad["err"])
+	// a request that couldn't be read still gets an ID
+	assert.NotEmpty(t, bad["request_id"])
+	assert.Equal(t, float64(400), byMsg["writing error response"]["status"])
+}
+
+func TestRequestIDs(t *testing.T) {
+	ids := make(chan string, 2)
+	s, err := Serve(0, func(w *response.Writer, r *request.Request) {
+		ids <- requestid.FromContext(r.Context())
+		WriteError(w, &HandlerError{Code: 500, Message: "Internal Server Error"}, "oops")
+	}, WithRequestIDFormat(requestid.ULID))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// the client's ID isn't trusted, so a new one is made
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nX-Request-Id: mine\r\n\r\n")
+	require.NoError(t, err)
+	res, err := response.NewReader(conn).ReadResponse("GET")
+	require.NoError(t, err)
+	id := <-ids
+	assert.Len(t, id, 26)
+	assert.Equal(t, id, res.Headers.Get("x-request-id"))
+	assert.Equal(t, "oops\n<p>Request ID: "+id+"</p>", string(res.Body))
+}
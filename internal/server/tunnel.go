@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+)
+
+// A CONNECT request (RFC 9110 section 9.3.6) asks the server to open a TCP
+// connection to its target and relay bytes both ways. The handler sees the
+// request first: writing any response refuses it, returning without
+// writing one approves it. The server connects to the request target as
+// the handler left it, so a handler may swap a host name for the address
+// it checked.
+
+const DefaultTunnelDialTimeout = 30 * time.Second
+
+// validAuthority reports whether target is an authority-form
+// request target, a host and port.
+func validAuthority(target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	return err == nil && host != "" && port != ""
+}
+
+// tunnel dials the target of r and, once it has taken the connection
+// over from w, splices the two until both sides have finished sending.
+func (s *Server) tunnel(w *response.Writer, r *request.Request) {
+	logger := w.Logger
+	target, err := net.DialTimeout("tcp", r.RequestLine.Target, DefaultTunnelDialTimeout)
+	if err != nil {
+		logger.Warn("error dialing tunnel target", "err", err)
+		WriteError(w, &HandlerError{
+			Code:    int(response.BadGateway),
+			Message: "Bad Gateway",
+		}, "The tunnel target could not be reached")
+		return
+	}
+	defer closeTunnel(logger, target)
+	conn, br, err := w.Hijack()
+	if err != nil {
+		logger.Error("error hijacking tunnel connection", "err", err)
+		return
+	}
+	defer closeTunnel(logger, conn)
+
+	if _, err := io.WriteString(conn, "HTTP/"+r.RequestLine.HTTPVersion+" 200 Connection Established\r\n\r\n"); err != nil {
+		logger.Warn("error opening tunnel", "err", err)
+		return
+	}
+	// br starts with anything the client sent without waiting for the
+	// 200, e.g. a TLS handshake
+	var wg sync.WaitGroup
+	wg.Go(func() { pipe(logger, target, conn, br) })
+	wg.Go(func() { pipe(logger, conn, target, target) })
+	wg.Wait()
+}
+
+// pipe copies from src, which reads from the connection srcConn, to dst,
+// then closes dst for writing so the other end sees the stream finish. If
+// the copy failed both are closed, which ends the other direction too.
+func pipe(logger *slog.Logger, dst, srcConn net.Conn, src io.Reader) {
+	if _, err := io.Copy(dst, src); err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			logger.Warn("error relaying tunnel", "err", err)
+		}
+		closeTunnel(logger, dst)
+		closeTunnel(logger, srcConn)
+		return
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Warn("error closing tunnel for writing", "err", err)
+		}
+		return
+	}
+	closeTunnel(logger, dst)
+}
+
+func closeTunnel(logger *slog.Logger, conn net.Conn) {
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Warn("error closing tunnel connection", "err", err)
+	}
+}
@@ -0,0 +1,180 @@
+package servertest
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// The addresses the two ends of a Pipe report, from the documentation
+// range (RFC 5737)
+var (
+	ClientAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	ServerAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 80}
+)
+
+// Conn is one end of an in-memory connection made by Pipe. Unlike
+// net.Pipe, writes are buffered and never wait for the other end to read,
+// so a client can send a request while the server is still writing the
+// response to the last one, as over TCP. Deadlines and CloseWrite work as
+// they do on a *net.TCPConn.
+type Conn struct {
+	// ReadSize, when set, caps how many bytes each Read returns, so
+	// messages arrive split at arbitrary points as they can over a network
+	ReadSize int
+
+	in, out       *buffer
+	local, remote net.Addr
+}
+
+// buffer carries the bytes going one way along a Pipe.
+type buffer struct {
+	mu   sync.Mutex
+	data []byte
+	// eof is set once the writing end has closed
+	eof bool
+	// closed is set once the reading end has closed
+	closed   bool
+	deadline time.Time
+	// changed is closed and replaced whenever any of the above changes,
+	// waking up a waiting Read
+	changed chan struct{}
+}
+
+func newBuffer() *buffer {
+	return &buffer{changed: make(chan struct{})}
+}
+
+// update runs fn on b and wakes up a waiting Read.
+func (b *buffer) update(fn func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fn()
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Pipe makes an in-memory connection, returning the client's end and the
+// server's end.
+func Pipe() (client, server *Conn) {
+	up, down := newBuffer(), newBuffer()
+	client = &Conn{in: down, out: up, local: ClientAddr, remote: ServerAddr}
+	server = &Conn{in: up, out: down, local: ServerAddr, remote: ClientAddr}
+	return client, server
+}
+
+// Dial connects to s through a Pipe, serving the server's end with
+// s.ServeConn, and returns the client's end.
+func Dial(s *server.Server) *Conn {
+	client, conn := Pipe()
+	go s.ServeConn(conn)
+	return client
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	b := c.in
+	for {
+		b.mu.Lock()
+		switch {
+		case b.closed:
+			b.mu.Unlock()
+			return 0, net.ErrClosed
+		case len(b.data) > 0:
+			if c.ReadSize > 0 && len(p) > c.ReadSize {
+				p = p[:c.ReadSize]
+			}
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			b.mu.Unlock()
+			return n, nil
+		case b.eof:
+			b.mu.Unlock()
+			return 0, io.EOF
+		case !b.deadline.IsZero() && !time.Now().Before(b.deadline):
+			b.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		changed, deadline := b.changed, b.deadline
+		b.mu.Unlock()
+
+		if deadline.IsZero() {
+			<-changed
+			continue
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.in.isClosed() {
+		return 0, net.ErrClosed
+	}
+	b := c.out
+	var err error
+	b.update(func() {
+		if b.eof || b.closed {
+			err = io.ErrClosedPipe
+			return
+		}
+		b.data = append(b.data, p...)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (b *buffer) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// Close closes both directions. The other end reads io.EOF once it has
+// read everything already written.
+func (c *Conn) Close() error {
+	if c.in.isClosed() {
+		return net.ErrClosed
+	}
+	c.in.update(func() { c.in.closed = true })
+	c.out.update(func() { c.out.eof = true })
+	return nil
+}
+
+// CloseWrite shuts down the writing side, so the other end reads io.EOF
+// while this one can still read.
+func (c *Conn) CloseWrite() error {
+	c.out.update(func() { c.out.eof = true })
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.in.update(func() { c.in.deadline = t })
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never block.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
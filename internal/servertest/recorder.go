@@ -0,0 +1,76 @@
+// Package servertest - to test handlers and the server without opening
+// sockets
+package servertest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+)
+
+// NewRequest parses a request, including its body, from raw, as the
+// server would have read it from ClientAddr. It panics if raw isn't a
+// valid request, which is a mistake in the test.
+func NewRequest(raw string) *request.Request {
+	r, err := request.RequestFromReader(strings.NewReader(raw))
+	if err != nil {
+		panic(fmt.Sprintf("servertest: invalid request: %v", err))
+	}
+	r.RemoteAddr = ClientAddr.String()
+	return r
+}
+
+// ResponseRecorder records the response a handler writes to Writer, to be
+// checked with Result.
+type ResponseRecorder struct {
+	// Writer is the response.Writer to pass to the handler, set up for the
+	// request as the server would
+	Writer *response.Writer
+	// Raw is the response as it would have gone out on the connection
+	Raw bytes.Buffer
+	// Flushes counts how many times the handler's writes were flushed
+	// to the connection
+	Flushes int
+
+	method string
+}
+
+// NewRecorder makes a ResponseRecorder for the response to r.
+func NewRecorder(r *request.Request) *ResponseRecorder {
+	rec := &ResponseRecorder{method: r.RequestLine.Method}
+	w := response.NewWriter(&recorderConn{rec}, &headers.Headers{})
+	w.HTTPVersion = r.RequestLine.HTTPVersion
+	w.KeepAlive = r.KeepAlive()
+	w.SuppressBody = r.RequestLine.Method == "HEAD"
+	w.FlushChunks = true
+	rec.Writer = w
+	return rec
+}
+
+// Result finishes the response, as the server does once the handler
+// returns, and parses it. The status, headers, decoded body and trailers
+// are those a client would have read.
+func (rec *ResponseRecorder) Result() (*response.Response, error) {
+	if err := rec.Writer.Finish(); err != nil {
+		return nil, err
+	}
+	return response.NewReader(bytes.NewReader(rec.Raw.Bytes())).ReadResponse(rec.method)
+}
+
+// recorderConn stands in for the connection behind the recorder's Writer.
+type recorderConn struct {
+	rec *ResponseRecorder
+}
+
+func (c *recorderConn) Write(p []byte) (int, error) {
+	return c.rec.Raw.Write(p)
+}
+
+func (c *recorderConn) Flush() error {
+	c.rec.Flushes++
+	return nil
+}
@@ -0,0 +1,162 @@
+package servertest
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+func echo(w *response.Writer, r *request.Request) {
+	body, err := io.ReadAll(r.BodyReader())
+	if err != nil {
+		return
+	}
+	_ = w.WriteStatusLine(response.OK)
+	_ = w.WriteHeaders(headers.Headers{
+		"Transfer-Encoding": "chunked",
+		"Trailer":           "X-Target",
+	})
+	_ = w.WriteChunkedBody([]byte("you sent: "))
+	_ = w.WriteChunkedBody(body)
+	_ = w.WriteChunkedBodyDone()
+	_ = w.WriteTrailer(headers.Headers{"X-Target": r.RequestLine.Target})
+}
+
+func TestNewRequest(t *testing.T) {
+	r := NewRequest("POST /submit HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello")
+	assert.Equal(t, "POST", r.RequestLine.Method)
+	assert.Equal(t, "/submit", r.RequestLine.Target)
+	assert.Equal(t, "example.com", r.Headers.Get("host"))
+	assert.Equal(t, "hello", string(r.Body))
+	assert.Equal(t, "192.0.2.1:1234", r.RemoteAddr)
+
+	assert.Panics(t, func() { NewRequest("not a request\r\n\r\n") })
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRequest("POST /echo HTTP/1.1\r\nHost: x\r\nContent-Length: 2\r\n\r\nhi")
+	rec := NewRecorder(r)
+	echo(rec.Writer, r)
+
+	res, err := rec.Result()
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, res.StatusLine.StatusCode)
+	assert.Equal(t, "chunked", res.Headers.Get("transfer-encoding"))
+	assert.Equal(t, "you sent: hi", string(res.Body))
+	assert.Equal(t, "/echo", res.Trailers.Get("x-target"))
+	// one flush per chunk
+	assert.Equal(t, 2, rec.Flushes)
+	assert.Contains(t, rec.Raw.String(), "0\r\nX-Target: /echo\r\n\r\n")
+}
+
+func TestRecorderFinishesResponse(t *testing.T) {
+	r := NewRequest("HEAD / HTTP/1.1\r\nHost: x\r\n\r\n")
+	rec := NewRecorder(r)
+	_ = rec.Writer.WriteStatusLine(response.OK)
+	_ = rec.Writer.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"})
+	_, _ = rec.Writer.Write([]byte("not sent to HEAD"))
+
+	res, err := rec.Result()
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, res.StatusLine.StatusCode)
+	assert.Empty(t, res.Body)
+	assert.NotContains(t, rec.Raw.String(), "not sent")
+}
+
+func TestDialServesPipelinedRequests(t *testing.T) {
+	client, conn := Pipe()
+	defer func() { _ = client.Close() }()
+	// the server reads the requests a byte at a time
+	conn.ReadSize = 1
+	go server.New(echo).ServeConn(conn)
+
+	_, err := io.WriteString(client, "POST /one HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\n\r\na"+
+		"POST /two HTTP/1.1\r\nHost: x\r\nConnection: close\r\nContent-Length: 1\r\n\r\nb")
+	require.NoError(t, err)
+
+	rd := response.NewReader(client)
+	for _, want := range []string{"/one", "/two"} {
+		res, err := rd.ReadResponse("POST")
+		require.NoError(t, err)
+		assert.Equal(t, want, res.Trailers.Get("x-target"))
+	}
+	// the server closes its end after the last request
+	_, err = rd.ReadResponse("POST")
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestDialIdleTimeout(t *testing.T) {
+	client := Dial(server.New(echo, server.WithIdleTimeout(20*time.Millisecond)))
+	defer func() { _ = client.Close() }()
+
+	_, err := io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	rd := response.NewReader(client)
+	_, err = rd.ReadResponse("GET")
+	require.NoError(t, err)
+
+	// the idle connection is closed once the timeout passes
+	_, err = rd.ReadResponse("GET")
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestConn(t *testing.T) {
+	client, srv := Pipe()
+	assert.Equal(t, ClientAddr, client.LocalAddr())
+	assert.Equal(t, ClientAddr, srv.RemoteAddr())
+
+	// writes don't wait for a reader
+	_, err := client.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, client.CloseWrite())
+	_, err = client.Write([]byte("more"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	// the other way still works after a half-close
+	_, err = srv.Write([]byte("reply"))
+	require.NoError(t, err)
+	got, err := io.ReadAll(srv)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(got))
+
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "reply", string(buf[:n]))
+
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = client.Read(buf)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	require.NoError(t, srv.Close())
+	assert.ErrorIs(t, srv.Close(), net.ErrClosed)
+	_, err = srv.Read(buf)
+	assert.ErrorIs(t, err, net.ErrClosed)
+	require.NoError(t, client.SetReadDeadline(time.Time{}))
+	_, err = client.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestConnReadUnblocksOnWrite(t *testing.T) {
+	client, srv := Pipe()
+	done := make(chan string)
+	go func() {
+		buf := make([]byte, 8)
+		n, _ := srv.Read(buf)
+		done <- string(buf[:n])
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_, err := client.Write([]byte("late"))
+	require.NoError(t, err)
+	assert.Equal(t, "late", <-done)
+}
@@ -0,0 +1,174 @@
+// Package sse - to stream Server-Sent Events to a client
+package sse
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+)
+
+const DefaultHeartbeat = 15 * time.Second
+
+// ErrClosed is returned for writes to a Stream that has been closed.
+var ErrClosed = errors.New("sse: stream closed")
+
+// Event is a single event in the text/event-stream format.
+type Event struct {
+	// ID is sent back by the client as Last-Event-ID when it reconnects
+	ID string
+	// Event is the event type, clients treat an empty one as "message"
+	Event string
+	// Data may span several lines
+	Data string
+	// Retry tells the client how long to wait before reconnecting
+	Retry time.Duration
+}
+
+// Stream writes events to a chunked response. Events and heartbeats may be
+// sent from different goroutines.
+type Stream struct {
+	// LastEventID is the ID of the last event the client received before
+	// it reconnected, empty on a first connection
+	LastEventID string
+
+	w    *response.Writer
+	mu   sync.Mutex
+	err  error
+	done chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+	// stopOnce lets Close be called more than once
+	stopOnce sync.Once
+}
+
+// Start writes the head of an event stream in response to r. When
+// heartbeat is set, a comment is sent that often so intermediaries keep
+// the connection open and a client that has gone away is noticed. The
+// handler must Close the stream before it returns.
+func Start(w *response.Writer, r *request.Request, heartbeat time.Duration) (*Stream, error) {
+	if err := w.WriteStatusLine(response.OK); err != nil {
+		return nil, err
+	}
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	s := &Stream{
+		LastEventID: r.Headers.Get("last-event-id"),
+		w:           w,
+		done:        make(chan struct{}),
+		stop:        make(chan struct{}),
+	}
+	if heartbeat > 0 {
+		s.wg.Go(func() { s.heartbeat(heartbeat) })
+	}
+	return s, nil
+}
+
+func (s *Stream) heartbeat(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.Comment("heartbeat"); err != nil {
+				return
+			}
+		case <-s.stop:
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Send writes e to the client. Once a write has failed, because the client
+// went away, every send returns that error.
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") {
+		return errors.New("sse: event id contains a line break or NUL")
+	}
+	if strings.ContainsAny(e.Event, "\r\n") {
+		return errors.New("sse: event type contains a line break")
+	}
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	if e.Data != "" {
+		for _, line := range splitLines(e.Data) {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range splitLines(text) {
+		b.WriteString(":" + line + "\n")
+	}
+	return s.write(b.String())
+}
+
+func (s *Stream) write(msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	err := s.w.WriteChunkedBody([]byte(msg))
+	if err == nil {
+		// an event is no use sitting in a buffer
+		err = s.w.Flush()
+	}
+	if err != nil {
+		s.err = err
+		close(s.done)
+	}
+	return err
+}
+
+// Done is closed once a write has failed, which means the client has
+// disconnected.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops the heartbeat. The server ends the chunked body once the
+// handler returns.
+func (s *Stream) Close() {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = ErrClosed
+		close(s.done)
+	}
+	s.mu.Unlock()
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.wg.Wait()
+}
+
+// splitLines splits on any of the line endings the format allows:
+// CRLF, LF or a lone CR.
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.Split(s, "\n")
+}
@@ -0,0 +1,113 @@
+package sse
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/client"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+func start(t *testing.T, handler server.Handler) string {
+	t.Helper()
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s.Listener.Addr().String()
+}
+
+func TestEvents(t *testing.T) {
+	addr := start(t, func(w *response.Writer, r *request.Request) {
+		s, err := Start(w, r, 0)
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		_ = s.Send(Event{Data: "plain"})
+		_ = s.Send(Event{ID: "7", Event: "progress", Data: "line one\nline two\r\nline three", Retry: 3 * time.Second})
+		_ = s.Comment("just a comment")
+	})
+
+	res, err := client.Do(addr, request.New("GET", "/events", nil))
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, "text/event-stream", res.Headers.Get("content-type"))
+	assert.Equal(t, "no-cache", res.Headers.Get("cache-control"))
+	assert.Equal(t, "data: plain\n\n"+
+		"id: 7\nevent: progress\nretry: 3000\ndata: line one\ndata: line two\ndata: line three\n\n"+
+		":just a comment\n", string(body))
+}
+
+func TestLastEventID(t *testing.T) {
+	seen := make(chan string, 1)
+	addr := start(t, func(w *response.Writer, r *request.Request) {
+		s, err := Start(w, r, 0)
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		seen <- s.LastEventID
+	})
+	req := request.New("GET", "/events", nil)
+	req.Headers.Set("last-event-id", "41")
+	res, err := client.Do(addr, req)
+	require.NoError(t, err)
+	_, _ = io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	assert.Equal(t, "41", <-seen)
+}
+
+func TestInvalidFields(t *testing.T) {
+	s := &Stream{}
+	assert.Error(t, s.Send(Event{ID: "1\n2", Data: "x"}))
+	assert.Error(t, s.Send(Event{Event: "a\rb", Data: "x"}))
+}
+
+func TestHeartbeatAndDisconnect(t *testing.T) {
+	stopped := make(chan struct{})
+	addr := start(t, func(w *response.Writer, r *request.Request) {
+		s, err := Start(w, r, 5*time.Millisecond)
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		// nothing else is sent, the heartbeat finds out the client left
+		select {
+		case <-s.Done():
+			close(stopped)
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if strings.HasPrefix(line, ":heartbeat") {
+			break
+		}
+	}
+	require.NoError(t, conn.Close())
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not stopped after the client disconnected")
+	}
+}
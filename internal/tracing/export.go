@@ -0,0 +1,244 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/client"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+)
+
+// JSONExporter writes each span to Out as a JSON object on a line of its
+// own, e.g. to stdout while developing.
+type JSONExporter struct {
+	Out io.Writer
+
+	mu sync.Mutex
+}
+
+func NewJSONExporter(out io.Writer) *JSONExporter {
+	return &JSONExporter{Out: out}
+}
+
+type jsonSpan struct {
+	Name         string         `json:"name"`
+	Kind         string         `json:"kind"`
+	TraceID      string         `json:"trace_id"`
+	SpanID       string         `json:"span_id"`
+	ParentSpanID string         `json:"parent_span_id,omitempty"`
+	TraceState   string         `json:"trace_state,omitempty"`
+	Start        string         `json:"start"`
+	End          string         `json:"end"`
+	DurationMS   float64        `json:"duration_ms"`
+	Attributes   map[string]any `json:"attributes,omitempty"`
+	Events       []jsonEvent    `json:"events,omitempty"`
+	Status       string         `json:"status"`
+	Message      string         `json:"status_message,omitempty"`
+}
+
+type jsonEvent struct {
+	Name string `json:"name"`
+	Time string `json:"time"`
+}
+
+func (e *JSONExporter) Export(spans []*Span) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, s := range spans {
+		js := jsonSpan{
+			Name:       s.Name,
+			Kind:       s.Kind.String(),
+			TraceID:    s.Context.TraceID.String(),
+			SpanID:     s.Context.SpanID.String(),
+			TraceState: s.Context.State,
+			Start:      s.StartTime.Format(time.RFC3339Nano),
+			End:        s.EndTime.Format(time.RFC3339Nano),
+			DurationMS: float64(s.EndTime.Sub(s.StartTime).Microseconds()) / 1000,
+			Status:     s.Status.String(),
+			Message:    s.StatusMessage,
+		}
+		if s.Parent.IsValid() {
+			js.ParentSpanID = s.Parent.SpanID.String()
+		}
+		if len(s.Attributes) > 0 {
+			js.Attributes = map[string]any{}
+			for _, a := range s.Attributes {
+				js.Attributes[a.Key] = a.Value
+			}
+		}
+		for _, ev := range s.Events {
+			js.Events = append(js.Events, jsonEvent{Name: ev.Name, Time: ev.Time.Format(time.RFC3339Nano)})
+		}
+		if err := enc.Encode(js); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.Out.Write(b.Bytes())
+	return err
+}
+
+const DefaultOTLPPath = "/v1/traces"
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP over
+// HTTP, JSON encoded.
+type OTLPExporter struct {
+	// Addr is the host:port of the collector, usually port 4318
+	Addr string
+	Path string
+	// ServiceName is the service.name the spans are reported under
+	ServiceName string
+	Client      *client.Client
+}
+
+func NewOTLPExporter(addr, serviceName string) *OTLPExporter {
+	return &OTLPExporter{
+		Addr:        addr,
+		Path:        DefaultOTLPPath,
+		ServiceName: serviceName,
+		Client:      client.DefaultClient,
+	}
+}
+
+// The OTLP JSON encoding, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding. IDs
+// are hex, 64-bit integers are strings and enums are numbers.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		TraceState        string          `json:"traceState,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Events            []otlpEvent     `json:"events,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string `json:"timeUnixNano"`
+		Name         string `json:"name"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+// scopeName names this package as the instrumentation the spans come from
+const scopeName = "github.com/k4rldoherty/http-from-tcp/internal/tracing"
+
+func (e *OTLPExporter) Export(spans []*Span) error {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		sp := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			TraceState:        s.Context.State,
+			Name:              s.Name,
+			Kind:              int(s.Kind),
+			StartTimeUnixNano: unixNano(s.StartTime),
+			EndTimeUnixNano:   unixNano(s.EndTime),
+			Status:            otlpStatus{Code: int(s.Status), Message: s.StatusMessage},
+		}
+		if s.Parent.IsValid() {
+			sp.ParentSpanID = s.Parent.SpanID.String()
+		}
+		for _, a := range s.Attributes {
+			sp.Attributes = append(sp.Attributes, otlpAttr(a.Key, a.Value))
+		}
+		for _, ev := range s.Events {
+			sp.Events = append(sp.Events, otlpEvent{TimeUnixNano: unixNano(ev.Time), Name: ev.Name})
+		}
+		out = append(out, sp)
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			otlpAttr("service.name", e.ServiceName),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: scopeName},
+			Spans: out,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req := request.New("POST", e.Path, bytes.NewReader(body))
+	req.Headers.Set("content-type", "application/json")
+	res, err := e.Client.Do(e.Addr, req)
+	if err != nil {
+		return fmt.Errorf("exporting spans: %w", err)
+	}
+	// the body has to be read for the connection to be reused
+	_, err = io.Copy(io.Discard, res.Body)
+	if cerr := res.Body.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("exporting spans: %w", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("exporting spans: collector answered %d %s", res.StatusCode, res.Reason)
+	}
+	return nil
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpAttr(key string, value any) otlpAttribute {
+	var v otlpValue
+	switch value := value.(type) {
+	case bool:
+		v.BoolValue = &value
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &value
+	case string:
+		v.StringValue = &value
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// Middleware starts a server span for each request, continuing the trace
+// of the caller's traceparent if it sent one. The span is on the request's
+// context for handlers to start child spans from, and next's log lines
+// carry its trace and span IDs. The span ends when the response does.
+func (t *Tracer) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		ctx := r.Context()
+		if sc, ok := Extract(r.Headers); ok {
+			ctx = ContextWithRemoteParent(ctx, sc)
+		}
+		route := ""
+		if t.Route != nil {
+			route = t.Route(r)
+		}
+		name := r.RequestLine.Method
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := t.Start(ctx, name, Server)
+		r.SetContext(ctx)
+
+		path, _, _ := strings.Cut(r.RequestLine.Target, "?")
+		span.SetAttribute("http.request.method", r.RequestLine.Method)
+		span.SetAttribute("url.path", path)
+		span.SetAttribute("network.protocol.version", r.RequestLine.HTTPVersion)
+		if route != "" {
+			span.SetAttribute("http.route", route)
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			span.SetAttribute("client.address", host)
+		}
+		w.Logger = w.Logger.With("trace_id", span.Context.TraceID.String(), "span_id", span.Context.SpanID.String())
+		w.OnWriteHeaders(func(w *response.Writer, h headers.Headers) {
+			span.AddEvent("response headers written")
+		})
+
+		w.OnFinish(func(w *response.Writer, err error) {
+			defer span.End()
+			if w.Hijacked() {
+				span.SetAttribute("http.connection.hijacked", true)
+				return
+			}
+			if err != nil {
+				span.SetStatus(StatusError, err.Error())
+			}
+			if w.State != response.WritingStatusLine {
+				span.SetAttribute("http.response.status_code", int(w.StatusCode))
+				span.SetAttribute("http.response.body.size", w.BytesWritten())
+				// a 4xx is the client's mistake, not a failure of the server
+				if w.StatusCode >= 500 {
+					span.SetStatus(StatusError, fmt.Sprintf("status %d", w.StatusCode))
+				}
+			}
+		})
+		next(w, r)
+	}
+}
@@ -0,0 +1,324 @@
+package tracing
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+)
+
+// SpanKind says what side of a request a span is on. The values are
+// those of OTLP.
+type SpanKind int
+
+const (
+	Internal SpanKind = 1
+	Server   SpanKind = 2
+	Client   SpanKind = 3
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case Server:
+		return "server"
+	case Client:
+		return "client"
+	default:
+		return "internal"
+	}
+}
+
+// StatusCode is the outcome of a span, the values are those of OTLP
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+func (c StatusCode) String() string {
+	switch c {
+	case StatusOK:
+		return "ok"
+	case StatusError:
+		return "error"
+	default:
+		return "unset"
+	}
+}
+
+type Attribute struct {
+	Key string
+	// Value is a string, bool, int64 or float64
+	Value any
+}
+
+// Event is something that happened at a point in a span.
+type Event struct {
+	Name string
+	Time time.Time
+}
+
+// Span is a piece of work in a trace, e.g. answering one request. Once
+// ended it is handed to the exporter and must not be changed. The methods
+// do nothing on a nil Span, so callers needn't check whether a request
+// is being traced.
+type Span struct {
+	Name    string
+	Kind    SpanKind
+	Context SpanContext
+	// Parent is the span this one is a child of, invalid for the first
+	// span of a trace
+	Parent     SpanContext
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes []Attribute
+	Events     []Event
+	Status     StatusCode
+	// StatusMessage says what went wrong, for StatusError
+	StatusMessage string
+
+	// tracer is nil for a span from another service, see
+	// ContextWithRemoteParent
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+// SetAttribute sets the attribute key, replacing any earlier value.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	switch v := value.(type) {
+	case int:
+		value = int64(v)
+	case float32:
+		value = float64(v)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.Attributes {
+		if s.Attributes[i].Key == key {
+			s.Attributes[i].Value = value
+			return
+		}
+	}
+	s.Attributes = append(s.Attributes, Attribute{Key: key, Value: value})
+}
+
+// Attribute returns the value of the attribute key, or nil.
+func (s *Span) Attribute(key string) any {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+func (s *Span) AddEvent(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Events = append(s.Events, Event{Name: name, Time: time.Now()})
+}
+
+func (s *Span) SetStatus(code StatusCode, message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Status = code
+	s.StatusMessage = message
+}
+
+// End records the end of the span and queues it for export, if its trace
+// is sampled. Only the first call does anything.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+	if s.tracer != nil && s.Context.Sampled() {
+		s.tracer.enqueue(s)
+	}
+}
+
+// Exporter sends finished spans somewhere, e.g. to a collector. Export is
+// called from a single goroutine.
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+const (
+	DefaultBatchSize     = 512
+	DefaultQueueSize     = 2048
+	DefaultFlushInterval = 5 * time.Second
+)
+
+// Tracer starts spans and exports them in batches once they end.
+type Tracer struct {
+	Exporter Exporter
+	// SampleRatio is the share of new traces that are recorded. Traces
+	// continued from a caller keep the caller's decision.
+	SampleRatio float64
+	// BatchSize spans are exported at once, or whatever has ended in
+	// FlushInterval if that is fewer
+	BatchSize     int
+	FlushInterval time.Duration
+	// QueueSize is how many ended spans may wait for export, more are
+	// dropped
+	QueueSize int
+	// Route names the route a request took, for the server spans of
+	// Middleware. Without it spans are named after the method alone.
+	Route func(r *request.Request) string
+	// Logger is where dropped spans and export errors are logged,
+	// slog.Default() if nil
+	Logger *slog.Logger
+
+	start sync.Once
+	mu    sync.Mutex
+	// queue is nil once the tracer is closed
+	queue chan *Span
+	done  chan struct{}
+}
+
+// NewTracer makes a Tracer recording every trace and exporting to exp.
+func NewTracer(exp Exporter) *Tracer {
+	return &Tracer{
+		Exporter:      exp,
+		SampleRatio:   1,
+		BatchSize:     DefaultBatchSize,
+		FlushInterval: DefaultFlushInterval,
+		QueueSize:     DefaultQueueSize,
+		Logger:        slog.Default(),
+	}
+}
+
+// Start starts a span. It is a child of the span in ctx, if there is one,
+// and the returned context carries the new span.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	span := &Span{
+		Name:      name,
+		Kind:      kind,
+		StartTime: time.Now(),
+		tracer:    t,
+	}
+	if parent := SpanFromContext(ctx); parent != nil && parent.Context.IsValid() {
+		span.Parent = parent.Context
+		span.Context = SpanContext{
+			TraceID: parent.Context.TraceID,
+			Flags:   parent.Context.Flags,
+			State:   parent.Context.State,
+		}
+	} else {
+		span.Context.TraceID = newTraceID()
+		if t.SampleRatio >= 1 || rand.Float64() < t.SampleRatio {
+			span.Context.Flags = FlagSampled
+		}
+	}
+	span.Context.SpanID = newSpanID()
+	return ContextWithSpan(ctx, span), span
+}
+
+// Start starts a span that is a child of the span in ctx, with the same
+// tracer. If ctx has no span, or only one from another service, nothing
+// is started and the returned span is nil.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil || parent.tracer == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, kind)
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.start.Do(t.run)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.queue == nil {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		t.logger().Warn("queue full, dropping span", "span_id", s.Context.SpanID)
+	}
+}
+
+func (t *Tracer) logger() *slog.Logger {
+	if t.Logger == nil {
+		return slog.Default()
+	}
+	return t.Logger
+}
+
+// run starts the goroutine exporting spans as they are queued.
+func (t *Tracer) run() {
+	queue := make(chan *Span, t.QueueSize)
+	t.queue = queue
+	t.done = make(chan struct{})
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(t.FlushInterval)
+		defer ticker.Stop()
+		var batch []*Span
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if err := t.Exporter.Export(batch); err != nil {
+				t.logger().Error("error exporting spans", "spans", len(batch), "err", err)
+			}
+			batch = nil
+		}
+		for {
+			select {
+			case s, ok := <-queue:
+				if !ok {
+					flush()
+					return
+				}
+				batch = append(batch, s)
+				if len(batch) >= t.BatchSize {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+}
+
+// Close exports the spans that have ended and stops the tracer. Spans
+// ending after it are dropped.
+func (t *Tracer) Close() {
+	t.start.Do(t.run)
+	t.mu.Lock()
+	if t.queue != nil {
+		close(t.queue)
+		t.queue = nil
+	}
+	t.mu.Unlock()
+	<-t.done
+}
@@ -0,0 +1,224 @@
+// Package tracing - to follow requests across services with W3C trace
+// context and export the spans they make
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+)
+
+// TraceID identifies a trace, every span of a request across all services
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// FlagSampled is set in the trace flags of a trace whose spans are
+// recorded
+const FlagSampled byte = 0x01
+
+// SpanContext is what is passed between services about a span, in the
+// traceparent and tracestate headers (https://www.w3.org/TR/trace-context/).
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	// State is the tracestate header, vendor data passed on as it is
+	State string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+// Traceparent formats sc as a version 00 traceparent header.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceparent parses a traceparent header. Versions after 00 are
+// parsed as far as the fields 00 defines, as the spec asks.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	version, ok := parseHex(s[:2])
+	if !ok || version[0] == 0xff {
+		return sc, fmt.Errorf("invalid traceparent version %q", s[:2])
+	}
+	if (version[0] == 0 && len(s) != 55) || (len(s) > 55 && s[55] != '-') {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	traceID, ok := parseHex(s[3:35])
+	if !ok {
+		return sc, fmt.Errorf("invalid trace ID %q", s[3:35])
+	}
+	spanID, ok := parseHex(s[36:52])
+	if !ok {
+		return sc, fmt.Errorf("invalid parent ID %q", s[36:52])
+	}
+	flags, ok := parseHex(s[53:55])
+	if !ok {
+		return sc, fmt.Errorf("invalid trace flags %q", s[53:55])
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, errors.New("all-zero trace or parent ID")
+	}
+	return sc, nil
+}
+
+// parseHex decodes lowercase hex, the only case traceparent allows.
+func parseHex(s string) ([]byte, bool) {
+	if strings.ToLower(s) != s {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+// maxStateMembers is the most list members a tracestate may have
+const maxStateMembers = 32
+
+// validState reports whether s is a well-formed tracestate header. An
+// invalid one is dropped rather than passed on.
+func validState(s string) bool {
+	seen := map[string]bool{}
+	for member := range strings.SplitSeq(s, ",") {
+		member = strings.Trim(member, " \t")
+		if member == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(member, "=")
+		if !ok || !validStateKey(key) || !validStateValue(value) || seen[key] {
+			return false
+		}
+		seen[key] = true
+	}
+	return len(seen) <= maxStateMembers
+}
+
+func validStateKey(key string) bool {
+	if key == "" || len(key) > 256 {
+		return false
+	}
+	for i, c := range key {
+		switch {
+		case 'a' <= c && c <= 'z' || '0' <= c && c <= '9':
+		case i > 0 && strings.ContainsRune("_-*/@", c):
+		default:
+			return false
+		}
+	}
+	return strings.Count(key, "@") <= 1
+}
+
+func validStateValue(value string) bool {
+	if value == "" || len(value) > 256 || strings.HasSuffix(value, " ") {
+		return false
+	}
+	for _, c := range []byte(value) {
+		if c < 0x20 || c > 0x7e || c == ',' || c == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+// Extract reads the span context a caller sent in h. ok is false if there
+// is none or it is malformed, in which case a new trace is started.
+func Extract(h headers.Headers) (sc SpanContext, ok bool) {
+	tp := strings.TrimSpace(h.Get("traceparent"))
+	if tp == "" {
+		return SpanContext{}, false
+	}
+	sc, err := ParseTraceparent(tp)
+	if err != nil {
+		return SpanContext{}, false
+	}
+	if state := h.Get("tracestate"); validState(state) {
+		sc.State = state
+	}
+	return sc, true
+}
+
+// Inject sets traceparent and tracestate in h to the span in ctx, so the
+// request they go out with continues its trace. It does nothing if ctx
+// has no span.
+func Inject(ctx context.Context, h headers.Headers) {
+	span := SpanFromContext(ctx)
+	if span == nil || !span.Context.IsValid() {
+		return
+	}
+	h.Delete("traceparent")
+	h.Delete("tracestate")
+	h.Set("traceparent", span.Context.Traceparent())
+	if span.Context.State != "" {
+		h.Set("tracestate", span.Context.State)
+	}
+}
+
+type contextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span, which spans started
+// from it are children of.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, contextKey{}, span)
+}
+
+// ContextWithRemoteParent returns a copy of ctx whose spans are children
+// of a span in another service, e.g. one read with Extract.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return ContextWithSpan(ctx, &Span{Context: sc})
+}
+
+// SpanFromContext returns the span in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(contextKey{}).(*Span)
+	return span
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
@@ -0,0 +1,287 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/headers"
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+	"github.com/k4rldoherty/http-from-tcp/internal/servertest"
+)
+
+const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// memoryExporter keeps the spans exported to it
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *memoryExporter) Export(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent(parent)
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled())
+	assert.Equal(t, parent, sc.Traceparent())
+
+	// later versions may add fields after the ones version 00 has
+	sc, err = ParseTraceparent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-what-comes-next")
+	require.NoError(t, err)
+	assert.False(t, sc.Sampled())
+
+	for _, bad := range []string{
+		"",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+		"cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01x",
+	} {
+		_, err := ParseTraceparent(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	sc, ok := Extract(headers.Headers{"traceparent": parent, "tracestate": "congo=t61rcWkgMzE, rojo=00f067aa0ba902b7"})
+	require.True(t, ok)
+	assert.Equal(t, "congo=t61rcWkgMzE, rojo=00f067aa0ba902b7", sc.State)
+
+	// a bad tracestate is dropped, the traceparent is still used
+	for _, state := range []string{"Upper=1", "a=1,a=2", "novalue", "k=v=w", manyMembers(33)} {
+		sc, ok = Extract(headers.Headers{"traceparent": parent, "tracestate": state})
+		require.True(t, ok)
+		assert.Empty(t, sc.State, state)
+	}
+
+	_, ok = Extract(headers.Headers{"traceparent": "garbage", "tracestate": "a=1"})
+	assert.False(t, ok)
+	_, ok = Extract(headers.Headers{})
+	assert.False(t, ok)
+}
+
+func manyMembers(n int) string {
+	members := make([]string, n)
+	for i := range members {
+		members[i] = "k" + strings.Repeat("x", i) + "=v"
+	}
+	return strings.Join(members, ",")
+}
+
+func TestInject(t *testing.T) {
+	tr := NewTracer(&memoryExporter{})
+	sc, _ := ParseTraceparent(parent)
+	sc.State = "rojo=1"
+	ctx, span := tr.Start(ContextWithRemoteParent(t.Context(), sc), "GET", Client)
+
+	h := headers.Headers{"Traceparent": "stale"}
+	Inject(ctx, h)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.Context.SpanID.String()+"-01", h.Get("traceparent"))
+	assert.Equal(t, "rojo=1", h.Get("tracestate"))
+	assert.Len(t, h, 2)
+
+	h = headers.Headers{}
+	Inject(t.Context(), h)
+	assert.Empty(t, h)
+}
+
+func serveTraced(t *testing.T, tr *Tracer, raw string, handler server.Handler) *response.Response {
+	t.Helper()
+	r := servertest.NewRequest(raw)
+	rec := servertest.NewRecorder(r)
+	tr.Middleware(handler)(rec.Writer, r)
+	res, err := rec.Result()
+	require.NoError(t, err)
+	return res
+}
+
+func TestMiddleware(t *testing.T) {
+	exp := &memoryExporter{}
+	tr := NewTracer(exp)
+	tr.Route = func(r *request.Request) string { return "/items/{id}" }
+
+	var child *Span
+	serveTraced(t, tr, "GET /items/7?full=1 HTTP/1.1\r\nHost: x\r\nTraceparent: "+parent+"\r\nTracestate: rojo=1\r\n\r\n",
+		func(w *response.Writer, r *request.Request) {
+			_, child = Start(r.Context(), "load item", Internal)
+			child.End()
+			_ = w.WriteStatusLine(response.OK)
+			_ = w.WriteHeaders(response.GetDefaultHeaders(2))
+			_, _ = w.WriteBody([]byte("ok"))
+		})
+	tr.Close()
+
+	require.Len(t, exp.spans, 2)
+	span := exp.spans[1]
+	assert.Equal(t, "GET /items/{id}", span.Name)
+	assert.Equal(t, Server, span.Kind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.Context.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", span.Parent.SpanID.String())
+	assert.Equal(t, "rojo=1", span.Context.State)
+	assert.Equal(t, "/items/7", span.Attribute("url.path"))
+	assert.Equal(t, "/items/{id}", span.Attribute("http.route"))
+	assert.Equal(t, int64(200), span.Attribute("http.response.status_code"))
+	assert.Equal(t, int64(2), span.Attribute("http.response.body.size"))
+	assert.Equal(t, "192.0.2.1", span.Attribute("client.address"))
+	assert.Equal(t, StatusUnset, span.Status)
+	assert.False(t, span.EndTime.Before(span.StartTime))
+	require.Len(t, span.Events, 1)
+
+	// the handler's span is a child of the server span
+	assert.Same(t, child, exp.spans[0])
+	assert.Equal(t, span.Context.SpanID, child.Parent.SpanID)
+	assert.Equal(t, span.Context.TraceID, child.Context.TraceID)
+}
+
+func TestMiddlewareNewTrace(t *testing.T) {
+	exp := &memoryExporter{}
+	tr := NewTracer(exp)
+	serveTraced(t, tr, "GET / HTTP/1.1\r\nHost: x\r\nTraceparent: nonsense\r\n\r\n",
+		func(w *response.Writer, r *request.Request) {
+			server.WriteError(w, &server.HandlerError{Code: 503, Message: "Service Unavailable"}, "down")
+		})
+	// an unsampled caller's trace isn't recorded
+	serveTraced(t, tr, "GET / HTTP/1.1\r\nHost: x\r\nTraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00\r\n\r\n",
+		func(w *response.Writer, r *request.Request) {
+			_ = w.WriteStatusLine(response.NoContent)
+			_ = w.WriteHeaders(headers.Headers{})
+		})
+	tr.Close()
+
+	require.Len(t, exp.spans, 1)
+	span := exp.spans[0]
+	assert.Equal(t, "GET", span.Name)
+	assert.False(t, span.Parent.IsValid())
+	assert.True(t, span.Context.Sampled())
+	assert.Equal(t, StatusError, span.Status)
+	assert.Equal(t, int64(503), span.Attribute("http.response.status_code"))
+}
+
+func TestSampleRatio(t *testing.T) {
+	exp := &memoryExporter{}
+	tr := NewTracer(exp)
+	tr.SampleRatio = 0
+	_, span := tr.Start(t.Context(), "root", Internal)
+	span.End()
+	tr.Close()
+	assert.False(t, span.Context.Sampled())
+	assert.Empty(t, exp.spans)
+
+	// spans end quietly once the tracer is closed
+	_, span = tr.Start(t.Context(), "late", Internal)
+	span.End()
+}
+
+func TestBatching(t *testing.T) {
+	exp := &memoryExporter{}
+	tr := NewTracer(exp)
+	tr.BatchSize = 2
+	for range 3 {
+		_, span := tr.Start(t.Context(), "work", Internal)
+		span.End()
+	}
+	assert.Eventually(t, func() bool {
+		exp.mu.Lock()
+		defer exp.mu.Unlock()
+		return len(exp.spans) == 2
+	}, time.Second, 5*time.Millisecond)
+	tr.Close()
+	assert.Len(t, exp.spans, 3)
+}
+
+func TestJSONExporter(t *testing.T) {
+	var out bytes.Buffer
+	tr := NewTracer(NewJSONExporter(&out))
+	ctx := ContextWithRemoteParent(t.Context(), SpanContext{TraceID: TraceID{1}, SpanID: SpanID{2}, Flags: FlagSampled})
+	_, span := tr.Start(ctx, "GET", Server)
+	span.SetAttribute("http.response.status_code", 200)
+	span.SetStatus(StatusError, "broke")
+	span.End()
+	tr.Close()
+
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &got))
+	assert.Equal(t, "GET", got["name"])
+	assert.Equal(t, "server", got["kind"])
+	assert.Equal(t, "01000000000000000000000000000000", got["trace_id"])
+	assert.Equal(t, "0200000000000000", got["parent_span_id"])
+	assert.Equal(t, map[string]any{"http.response.status_code": float64(200)}, got["attributes"])
+	assert.Equal(t, "error", got["status"])
+	assert.Equal(t, "broke", got["status_message"])
+}
+
+func TestOTLPExporter(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	s, err := server.Serve(0, func(w *response.Writer, r *request.Request) {
+		body, _ := io.ReadAll(r.BodyReader())
+		assert.Equal(t, "/v1/traces", r.RequestLine.Target)
+		assert.Equal(t, "application/json", r.Headers.Get("content-type"))
+		bodies <- body
+		_ = w.WriteStatusLine(response.OK)
+		_ = w.WriteHeaders(response.GetDefaultHeaders(2))
+		_, _ = w.WriteBody([]byte("{}"))
+	})
+	require.NoError(t, err)
+	defer func() { _ = s.Close() }()
+
+	tr := NewTracer(NewOTLPExporter(s.Listener.Addr().String(), "shop"))
+	ctx, root := tr.Start(t.Context(), "GET /", Server)
+	_, child := tr.Start(ctx, "GET", Client)
+	child.SetAttribute("http.response.status_code", 502)
+	child.SetAttribute("retried", true)
+	child.SetStatus(StatusError, "status 502")
+	child.End()
+	root.End()
+	tr.Close()
+
+	var got struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute
+			}
+			ScopeSpans []struct {
+				Spans []map[string]any
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(<-bodies, &got))
+	require.Len(t, got.ResourceSpans, 1)
+	rs := got.ResourceSpans[0]
+	assert.Equal(t, "service.name", rs.Resource.Attributes[0].Key)
+	assert.Equal(t, "shop", *rs.Resource.Attributes[0].Value.StringValue)
+
+	spans := rs.ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+	assert.Equal(t, child.Context.SpanID.String(), spans[0]["spanId"])
+	assert.Equal(t, root.Context.SpanID.String(), spans[0]["parentSpanId"])
+	assert.Equal(t, root.Context.TraceID.String(), spans[0]["traceId"])
+	assert.Equal(t, float64(3), spans[0]["kind"])
+	assert.Equal(t, map[string]any{"code": float64(2), "message": "status 502"}, spans[0]["status"])
+	assert.Equal(t, []any{
+		map[string]any{"key": "http.response.status_code", "value": map[string]any{"intValue": "502"}},
+		map[string]any{"key": "retried", "value": map[string]any{"boolValue": true}},
+	}, spans[0]["attributes"])
+	assert.NotContains(t, spans[1], "parentSpanId")
+	assert.Equal(t, float64(2), spans[1]["kind"])
+}
@@ -0,0 +1,370 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = MessageType(opText)
+	BinaryMessage MessageType = MessageType(opBinary)
+)
+
+// Close status codes (RFC 6455 section 7.4.1)
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	// CloseNoStatus is reported when a close frame had no code,
+	// it is never sent
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// ErrCloseSent is returned for writes after the Conn has sent a close frame.
+var ErrCloseSent = errors.New("websocket: close frame already sent")
+
+// CloseError is returned by ReadMessage once the connection has closed,
+// with the code and reason the peer sent, or those the Conn closed it with
+// after the peer broke the protocol.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket: closed with %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: closed with %d: %s", e.Code, e.Reason)
+}
+
+// Conn is the server end of a WebSocket connection. One goroutine may read
+// from it while others write. Pings are answered as messages are read, so
+// a Conn has to be read from to keep the connection alive.
+type Conn struct {
+	// Subprotocol is the one agreed in the handshake, if any
+	Subprotocol string
+	// MaxMessageSize caps the size of a message ReadMessage returns, once
+	// decompressed. Bigger ones close the connection with 1009. Zero or
+	// less means DefaultMaxMessageSize, there is no reading without a cap.
+	MaxMessageSize int64
+	// FragmentSize splits messages longer than it into several frames,
+	// when it is set
+	FragmentSize int
+	// Logger is where errors closing the connection are logged, the
+	// handler's request logger for a Conn from Upgrade
+	Logger *slog.Logger
+
+	conn     net.Conn
+	br       *bufio.Reader
+	compress bool
+	// readErr is returned by every read once the connection has closed
+	readErr error
+
+	mu        sync.Mutex
+	closeSent bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, subprotocol string, compress bool, maxSize int64, logger *slog.Logger) *Conn {
+	return &Conn{
+		Subprotocol:    subprotocol,
+		MaxMessageSize: maxSize,
+		Logger:         logger,
+		conn:           conn,
+		br:             br,
+		compress:       compress,
+	}
+}
+
+// ReadMessage reads the next data message, reassembling fragments and
+// undoing compression. Control frames that arrive in between are handled
+// as they come: pings are answered, and a close frame is answered and
+// returned as a *CloseError. A peer that breaks the protocol gets the
+// connection closed with the matching code, also returned as a
+// *CloseError. Network errors are returned as they are.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	typ, msg, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+		return 0, nil, err
+	}
+	return typ, msg, nil
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	var (
+		typ        MessageType
+		msg        []byte
+		compressed bool
+		started    bool
+	)
+	for {
+		h, err := readFrameHeader(c.br)
+		if errors.Is(err, errReservedBits) || errors.Is(err, errFrameTooLong) {
+			return 0, nil, c.fail(CloseProtocolError, err.Error())
+		}
+		if err != nil {
+			return 0, nil, c.broken(err)
+		}
+		switch {
+		case !h.op.known():
+			return 0, nil, c.fail(CloseProtocolError, "unknown opcode")
+		case !h.masked:
+			return 0, nil, c.fail(CloseProtocolError, "client frames must be masked")
+		case h.rsv1 && (!c.compress || h.op.control() || h.op == opContinuation):
+			return 0, nil, c.fail(CloseProtocolError, "unexpected RSV1")
+		}
+
+		if h.op.control() {
+			if !h.fin || h.length > maxControlPayload {
+				return 0, nil, c.fail(CloseProtocolError, "invalid control frame")
+			}
+			payload, err := c.readPayload(h)
+			if err != nil {
+				return 0, nil, c.broken(err)
+			}
+			if err := c.control(h.op, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		switch {
+		case h.op == opContinuation && !started:
+			return 0, nil, c.fail(CloseProtocolError, "continuation frame without a message")
+		case h.op != opContinuation && started:
+			return 0, nil, c.fail(CloseProtocolError, "new message before the last one ended")
+		}
+		// checked before the payload is read, as the length is the peer's
+		// word and the payload is allocated in one go
+		if int64(len(msg))+h.length > c.maxMessageSize() {
+			return 0, nil, c.fail(CloseMessageTooBig, "")
+		}
+		if !started {
+			typ, compressed, started = MessageType(h.op), h.rsv1, true
+		}
+		payload, err := c.readPayload(h)
+		if err != nil {
+			return 0, nil, c.broken(err)
+		}
+		msg = append(msg, payload...)
+		if !h.fin {
+			continue
+		}
+
+		if compressed {
+			msg, err = decompress(msg, c.maxMessageSize())
+			if errors.Is(err, errMessageTooBig) {
+				return 0, nil, c.fail(CloseMessageTooBig, "")
+			}
+			if err != nil {
+				return 0, nil, c.fail(CloseInvalidPayload, "invalid compressed message")
+			}
+		}
+		if typ == TextMessage && !utf8.Valid(msg) {
+			return 0, nil, c.fail(CloseInvalidPayload, "invalid UTF-8 in text message")
+		}
+		if msg == nil {
+			msg = []byte{}
+		}
+		return typ, msg, nil
+	}
+}
+
+func (c *Conn) maxMessageSize() int64 {
+	if c.MaxMessageSize <= 0 {
+		return DefaultMaxMessageSize
+	}
+	return c.MaxMessageSize
+}
+
+func (c *Conn) readPayload(h frameHeader) ([]byte, error) {
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return nil, err
+	}
+	maskBytes(h.mask, payload)
+	return payload, nil
+}
+
+// control handles a control frame that arrived while reading a message.
+func (c *Conn) control(op opcode, payload []byte) error {
+	switch op {
+	case opPing:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// once closing, only the peer's close frame matters
+		if c.closeSent {
+			return nil
+		}
+		if err := writeFrame(c.conn, frameHeader{fin: true, op: opPong}, payload); err != nil {
+			return c.broken(err)
+		}
+	case opClose:
+		code, reason, ok := parseClose(payload)
+		if !ok {
+			return c.fail(CloseProtocolError, "invalid close frame")
+		}
+		// answer with the same code, unless the close was ours
+		if err := c.WriteClose(code, ""); err != nil && !errors.Is(err, ErrCloseSent) {
+			c.logger().Warn("error answering close frame", "err", err)
+		}
+		// the server closes the TCP connection first (RFC 6455 section 7.1.1)
+		c.closeConn()
+		return &CloseError{Code: code, Reason: reason}
+	}
+	return nil
+}
+
+// parseClose reads the status code and reason from the payload of a
+// close frame.
+func parseClose(payload []byte) (int, string, bool) {
+	if len(payload) == 0 {
+		return CloseNoStatus, "", true
+	}
+	if len(payload) < 2 {
+		return 0, "", false
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	reason := payload[2:]
+	if !validCloseCode(code) || !utf8.Valid(reason) {
+		return 0, "", false
+	}
+	return code, string(reason), true
+}
+
+// validCloseCode reports whether code may be sent in a close frame. The
+// 3000s are registered with IANA, the 4000s are for private use.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	default:
+		return code >= 3000 && code <= 4999
+	}
+}
+
+// fail closes the connection after a protocol violation by the peer.
+func (c *Conn) fail(code int, reason string) error {
+	if err := c.WriteClose(code, reason); err != nil && !errors.Is(err, ErrCloseSent) {
+		c.logger().Warn("error sending close frame", "code", code, "err", err)
+	}
+	c.closeConn()
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// broken closes a connection that failed while reading or writing.
+func (c *Conn) broken(err error) error {
+	c.closeConn()
+	return err
+}
+
+// WriteMessage sends data as a single message, compressed if that was
+// agreed and the message is long enough for it to help.
+func (c *Conn) WriteMessage(typ MessageType, data []byte) error {
+	if typ != TextMessage && typ != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", typ)
+	}
+	compressed := c.compress && len(data) >= minCompressSize
+	if compressed {
+		var err error
+		if data, err = compress(data); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	op := opcode(typ)
+	for first := true; ; first = false {
+		n := len(data)
+		if c.FragmentSize > 0 {
+			n = min(n, c.FragmentSize)
+		}
+		h := frameHeader{fin: n == len(data), rsv1: compressed && first, op: op}
+		if err := writeFrame(c.conn, h, data[:n]); err != nil {
+			return err
+		}
+		if h.fin {
+			return nil
+		}
+		data = data[n:]
+		op = opContinuation
+	}
+}
+
+// Ping sends a ping, which the peer answers with a pong. Pongs are read
+// and dropped by ReadMessage.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("websocket: ping payload longer than %d bytes", maxControlPayload)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	return writeFrame(c.conn, frameHeader{fin: true, op: opPing}, data)
+}
+
+// WriteClose starts the close handshake. Keep reading until ReadMessage
+// returns the peer's answer as a *CloseError, which also closes the
+// connection. Nothing can be written afterwards.
+func (c *Conn) WriteClose(code int, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	c.closeSent = true
+	var payload []byte
+	if code != CloseNoStatus {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		// cut to fit, without leaving half a character at the end
+		reason = strings.ToValidUTF8(reason[:min(len(reason), maxControlPayload-2)], "")
+		payload = append(payload, reason...)
+	}
+	return writeFrame(c.conn, frameHeader{fin: true, op: opClose}, payload)
+}
+
+// Close closes the connection without a close handshake.
+func (c *Conn) Close() error {
+	err := c.conn.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (c *Conn) closeConn() {
+	if err := c.Close(); err != nil {
+		c.logger().Warn("error closing connection", "err", err)
+	}
+}
+
+func (c *Conn) logger() *slog.Logger {
+	if c.Logger == nil {
+		return slog.Default()
+	}
+	return c.Logger
+}
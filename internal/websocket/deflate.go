@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strings"
+)
+
+// permessage-deflate (RFC 7692) compresses each message on its own. Both
+// sides are asked not to keep the compression context between messages,
+// so no state is carried on the Conn.
+
+// minCompressSize is the smallest message worth compressing, deflate
+// makes shorter ones bigger
+const minCompressSize = 64
+
+// deflateResponse is the Sec-WebSocket-Extensions value the server
+// accepts permessage-deflate with
+const deflateResponse = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+// deflateTail is the empty block a sync flush ends with, which is left off
+// a compressed message (RFC 7692 section 7.2.1)
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// finalBlock is an empty final block, added when decompressing so the
+// stream ends cleanly
+var finalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+var errMessageTooBig = errors.New("message too big")
+
+// acceptDeflate reports whether one of the offers in a
+// Sec-WebSocket-Extensions header is permessage-deflate with parameters
+// the server can agree to.
+func acceptDeflate(extensions string) bool {
+	for _, offer := range strings.Split(extensions, ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		ok := true
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch strings.TrimSpace(name) {
+			case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+			case "server_max_window_bits":
+				// compress/flate always compresses with a 32KB window
+				ok = ok && strings.Trim(strings.TrimSpace(value), `"`) == "15"
+			default:
+				ok = false
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+// decompress inflates a compressed message, failing with errMessageTooBig
+// once it grows past limit bytes.
+func decompress(data []byte, limit int64) ([]byte, error) {
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail), bytes.NewReader(finalBlock)))
+	defer func() { _ = fr.Close() }()
+	out, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errMessageTooBig
+	}
+	return out, nil
+}
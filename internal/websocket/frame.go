@@ -0,0 +1,138 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// opcode says what a frame carries (RFC 6455 section 5.2)
+type opcode byte
+
+const (
+	opContinuation opcode = 0x0
+	opText         opcode = 0x1
+	opBinary       opcode = 0x2
+	opClose        opcode = 0x8
+	opPing         opcode = 0x9
+	opPong         opcode = 0xa
+)
+
+// maxControlPayload is the most a close, ping or pong frame may carry
+const maxControlPayload = 125
+
+func (op opcode) control() bool {
+	return op&0x8 != 0
+}
+
+func (op opcode) known() bool {
+	switch op {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+		return true
+	}
+	return false
+}
+
+type frameHeader struct {
+	fin bool
+	// rsv1 marks the first frame of a compressed message
+	rsv1   bool
+	op     opcode
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+var (
+	errReservedBits = errors.New("reserved bits set")
+	errFrameTooLong = errors.New("frame length has its most significant bit set")
+)
+
+// readFrameHeader reads the header of the next frame, up to the start of
+// its payload.
+func readFrameHeader(r io.Reader) (frameHeader, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return frameHeader{}, err
+	}
+	h := frameHeader{
+		fin:    b[0]&0x80 != 0,
+		rsv1:   b[0]&0x40 != 0,
+		op:     opcode(b[0] & 0x0f),
+		masked: b[1]&0x80 != 0,
+	}
+	if b[0]&0x30 != 0 {
+		return h, errReservedBits
+	}
+	switch n := b[1] & 0x7f; n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return h, err
+		}
+		h.length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return h, err
+		}
+		n := binary.BigEndian.Uint64(ext[:])
+		if n>>63 != 0 {
+			return h, errFrameTooLong
+		}
+		h.length = int64(n)
+	default:
+		h.length = int64(n)
+	}
+	if h.masked {
+		if _, err := io.ReadFull(r, h.mask[:]); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// writeFrame writes a frame with payload in a single write, masking the
+// payload if h asks for it.
+func writeFrame(w io.Writer, h frameHeader, payload []byte) error {
+	buf := make([]byte, 0, 14+len(payload))
+	b0 := byte(h.op)
+	if h.fin {
+		b0 |= 0x80
+	}
+	if h.rsv1 {
+		b0 |= 0x40
+	}
+	var maskBit byte
+	if h.masked {
+		maskBit = 0x80
+	}
+	buf = append(buf, b0)
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if h.masked {
+		buf = append(buf, h.mask[:]...)
+	}
+	start := len(buf)
+	buf = append(buf, payload...)
+	if h.masked {
+		maskBytes(h.mask, buf[start:])
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// maskBytes masks or unmasks b with key, the same operation either way.
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
@@ -0,0 +1,122 @@
+// Package websocket - to upgrade requests to WebSocket connections (RFC 6455)
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+const DefaultMaxMessageSize = 1 << 20
+
+// acceptGUID is appended to the client's key to make the accept value
+// (RFC 6455 section 4.2.2)
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Upgrader turns a handshake request into a Conn.
+type Upgrader struct {
+	// Subprotocols are the ones the server speaks, most preferred first.
+	// The first of them the client offers is agreed.
+	Subprotocols []string
+	// EnableCompression agrees to permessage-deflate if the client offers it
+	EnableCompression bool
+	// CheckOrigin, when set, refuses handshakes it returns false for with
+	// 403. Browsers send the page's Origin with every handshake, so this
+	// is how other sites are kept from connecting.
+	CheckOrigin func(r *request.Request) bool
+	// MaxMessageSize is the Conn's, DefaultMaxMessageSize if not set
+	MaxMessageSize int64
+}
+
+func New() *Upgrader {
+	return &Upgrader{MaxMessageSize: DefaultMaxMessageSize}
+}
+
+// Upgrade validates the handshake in r, answers it with 101 Switching
+// Protocols and takes the connection over from the server. If the
+// handshake is refused the error response has been written, and the
+// handler should just return.
+func (u *Upgrader) Upgrade(w *response.Writer, r *request.Request) (*Conn, error) {
+	if err := u.validate(w, r); err != nil {
+		return nil, err
+	}
+	subprotocol := u.subprotocol(r)
+	compress := u.EnableCompression && acceptDeflate(r.Headers.Get("sec-websocket-extensions"))
+
+	conn, br, err := w.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("websocket: %w", err)
+	}
+	head := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(r.Headers.Get("sec-websocket-key")) + "\r\n"
+	if subprotocol != "" {
+		head += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+	if compress {
+		head += "Sec-WebSocket-Extensions: " + deflateResponse + "\r\n"
+	}
+	if _, err := io.WriteString(conn, head+"\r\n"); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return newConn(conn, br, subprotocol, compress, u.MaxMessageSize, w.Logger), nil
+}
+
+// validate checks r is a WebSocket handshake (RFC 6455 section 4.2.1),
+// writing the error response if it isn't.
+func (u *Upgrader) validate(w *response.Writer, r *request.Request) error {
+	refuse := func(code response.StatusCode, message string) error {
+		server.WriteError(w, &server.HandlerError{
+			Code:    int(code),
+			Message: response.StatusText(code),
+		}, message)
+		return fmt.Errorf("websocket: %s", message)
+	}
+	switch {
+	case r.RequestLine.Method != "GET":
+		return refuse(response.MethodNotAllowed, "A WebSocket handshake must be a GET request")
+	case r.RequestLine.HTTPVersion != "1.1":
+		return refuse(response.BadRequest, "A WebSocket handshake needs HTTP/1.1")
+	case !r.Headers.HasToken("upgrade", "websocket") || !r.Headers.HasToken("connection", "upgrade"):
+		return refuse(response.BadRequest, "Not a WebSocket handshake")
+	case r.Headers.Get("sec-websocket-version") != "13":
+		w.Headers.Set("Sec-WebSocket-Version", "13")
+		return refuse(response.UpgradeRequired, "Only WebSocket version 13 is supported")
+	}
+	if key, err := base64.StdEncoding.DecodeString(r.Headers.Get("sec-websocket-key")); err != nil || len(key) != 16 {
+		return refuse(response.BadRequest, "Invalid Sec-WebSocket-Key")
+	}
+	if u.CheckOrigin != nil && !u.CheckOrigin(r) {
+		return refuse(response.Forbidden, "Origin not allowed")
+	}
+	return nil
+}
+
+// subprotocol picks the most preferred of the subprotocols
+// the client offered.
+func (u *Upgrader) subprotocol(r *request.Request) string {
+	var offered []string
+	for _, p := range strings.Split(r.Headers.Get("sec-websocket-protocol"), ",") {
+		offered = append(offered, strings.TrimSpace(p))
+	}
+	for _, p := range u.Subprotocols {
+		if slices.Contains(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,428 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/k4rldoherty/http-from-tcp/internal/request"
+	"github.com/k4rldoherty/http-from-tcp/internal/response"
+	"github.com/k4rldoherty/http-from-tcp/internal/server"
+)
+
+// sampleKey is the key from the example in RFC 6455 section 1.3
+const sampleKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// echo upgrades the request and sends every message back, reporting the
+// error that ended the connection on done
+func echo(u *Upgrader, configure func(c *Conn), done chan<- error) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		c, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		if configure != nil {
+			configure(c)
+		}
+		for {
+			typ, msg, err := c.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			if err := c.WriteMessage(typ, msg); err != nil {
+				done <- err
+				return
+			}
+		}
+	}
+}
+
+func start(t *testing.T, handler server.Handler) string {
+	t.Helper()
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s.Listener.Addr().String()
+}
+
+// testClient is the client end of a connection, writing frames by hand
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	res  *response.Response
+}
+
+func handshake(t *testing.T, addr string, extra string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	_, err = io.WriteString(conn, "GET /live HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\n"+
+		"Connection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "+sampleKey+"\r\n"+extra+"\r\n")
+	require.NoError(t, err)
+
+	// read the head line by line, frames may follow straight after it
+	br := bufio.NewReader(conn)
+	head := ""
+	for !strings.HasSuffix(head, "\r\n\r\n") {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head += line
+	}
+	res, err := response.ResponseFromReader(strings.NewReader(head))
+	require.NoError(t, err)
+	return &testClient{t: t, conn: conn, br: br, res: res}
+}
+
+func dial(t *testing.T, addr string, extra string) *testClient {
+	t.Helper()
+	c := handshake(t, addr, extra)
+	require.Equal(t, response.StatusCode(101), c.res.StatusLine.StatusCode)
+	return c
+}
+
+func (c *testClient) send(h frameHeader, payload []byte) {
+	c.t.Helper()
+	h.masked = true
+	h.mask = [4]byte{1, 2, 3, 4}
+	require.NoError(c.t, writeFrame(c.conn, h, bytes.Clone(payload)))
+}
+
+func (c *testClient) recv() (frameHeader, []byte) {
+	c.t.Helper()
+	h, err := readFrameHeader(c.br)
+	require.NoError(c.t, err)
+	assert.False(c.t, h.masked, "server frames are never masked")
+	payload := make([]byte, h.length)
+	_, err = io.ReadFull(c.br, payload)
+	require.NoError(c.t, err)
+	return h, payload
+}
+
+// recvClose reads the close frame the server sent and its code
+func (c *testClient) recvClose() int {
+	c.t.Helper()
+	h, payload := c.recv()
+	require.Equal(c.t, opClose, h.op)
+	require.GreaterOrEqual(c.t, len(payload), 2)
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+func TestHandshake(t *testing.T) {
+	u := New()
+	u.Subprotocols = []string{"v2.dashboard", "v1.dashboard"}
+	addr := start(t, echo(u, nil, make(chan error, 1)))
+
+	c := dial(t, addr, "Sec-WebSocket-Protocol: v1.dashboard, v2.dashboard\r\n")
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", c.res.Headers.Get("sec-websocket-accept"))
+	assert.Equal(t, "v2.dashboard", c.res.Headers.Get("sec-websocket-protocol"))
+	assert.True(t, c.res.Headers.HasToken("connection", "upgrade"))
+	assert.Equal(t, "", c.res.Headers.Get("sec-websocket-extensions"))
+}
+
+func TestHandshakeRefused(t *testing.T) {
+	u := New()
+	u.CheckOrigin = func(r *request.Request) bool {
+		return r.Headers.Get("origin") == "" || r.Headers.Get("origin") == "http://localhost"
+	}
+	addr := start(t, echo(u, nil, make(chan error, 1)))
+
+	tests := map[string]struct {
+		raw  string
+		want int
+	}{
+		"post": {
+			raw:  "POST / HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + sampleKey + "\r\nContent-Length: 0\r\n\r\n",
+			want: 405,
+		},
+		"no upgrade": {
+			raw:  "GET / HTTP/1.1\r\nHost: x\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + sampleKey + "\r\n\r\n",
+			want: 400,
+		},
+		"old version": {
+			raw:  "GET / HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 8\r\nSec-WebSocket-Key: " + sampleKey + "\r\n\r\n",
+			want: 426,
+		},
+		"short key": {
+			raw:  "GET / HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: c2hvcnQ=\r\n\r\n",
+			want: 400,
+		},
+		"foreign origin": {
+			raw:  "GET / HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + sampleKey + "\r\nOrigin: http://evil.example\r\n\r\n",
+			want: 403,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+			_, err = io.WriteString(conn, tt.raw)
+			require.NoError(t, err)
+			res, err := response.ResponseFromReader(conn)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, int(res.StatusLine.StatusCode))
+			if tt.want == 426 {
+				assert.Equal(t, "13", res.Headers.Get("sec-websocket-version"))
+			}
+		})
+	}
+}
+
+func TestEcho(t *testing.T) {
+	addr := start(t, echo(New(), nil, make(chan error, 1)))
+	c := dial(t, addr, "")
+
+	c.send(frameHeader{fin: true, op: opText}, []byte("hello"))
+	h, payload := c.recv()
+	assert.Equal(t, opText, h.op)
+	assert.True(t, h.fin)
+	assert.Equal(t, "hello", string(payload))
+
+	long := bytes.Repeat([]byte{0xff}, 70000)
+	c.send(frameHeader{fin: true, op: opBinary}, long)
+	h, payload = c.recv()
+	assert.Equal(t, opBinary, h.op)
+	assert.Equal(t, long, payload)
+}
+
+func TestFragmentsWithPingBetween(t *testing.T) {
+	addr := start(t, echo(New(), nil, make(chan error, 1)))
+	c := dial(t, addr, "")
+
+	c.send(frameHeader{op: opText}, []byte("frag"))
+	c.send(frameHeader{fin: true, op: opPing}, []byte("are you there"))
+	c.send(frameHeader{op: opContinuation}, []byte("ment"))
+	c.send(frameHeader{fin: true, op: opContinuation}, []byte("ed"))
+
+	h, payload := c.recv()
+	assert.Equal(t, opPong, h.op)
+	assert.Equal(t, "are you there", string(payload))
+	h, payload = c.recv()
+	assert.Equal(t, opText, h.op)
+	assert.Equal(t, "fragmented", string(payload))
+}
+
+func TestWriteFragmentSize(t *testing.T) {
+	addr := start(t, echo(New(), func(c *Conn) { c.FragmentSize = 4 }, make(chan error, 1)))
+	c := dial(t, addr, "")
+	c.send(frameHeader{fin: true, op: opText}, []byte("0123456789"))
+
+	var got []string
+	for {
+		h, payload := c.recv()
+		got = append(got, string(payload))
+		if h.fin {
+			break
+		}
+	}
+	assert.Equal(t, []string{"0123", "4567", "89"}, got)
+}
+
+func TestCloseHandshake(t *testing.T) {
+	done := make(chan error, 1)
+	addr := start(t, echo(New(), nil, done))
+	c := dial(t, addr, "")
+
+	c.send(frameHeader{fin: true, op: opClose}, append(binary.BigEndian.AppendUint16(nil, CloseGoingAway), "bye"...))
+	assert.Equal(t, CloseGoingAway, c.recvClose())
+	var closeErr *CloseError
+	require.ErrorAs(t, <-done, &closeErr)
+	assert.Equal(t, &CloseError{Code: CloseGoingAway, Reason: "bye"}, closeErr)
+
+	// the server closes the connection after answering
+	_, err := c.br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServerInitiatedClose(t *testing.T) {
+	done := make(chan error, 1)
+	addr := start(t, func(w *response.Writer, r *request.Request) {
+		c, err := New().Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		if err := c.WriteClose(CloseNormal, "done"); err != nil {
+			done <- err
+			return
+		}
+		assert.ErrorIs(t, c.WriteMessage(TextMessage, []byte("late")), ErrCloseSent)
+		_, _, err = c.ReadMessage()
+		done <- err
+	})
+	c := dial(t, addr, "")
+	assert.Equal(t, CloseNormal, c.recvClose())
+	c.send(frameHeader{fin: true, op: opClose}, binary.BigEndian.AppendUint16(nil, CloseNormal))
+
+	var closeErr *CloseError
+	require.ErrorAs(t, <-done, &closeErr)
+	assert.Equal(t, CloseNormal, closeErr.Code)
+}
+
+func TestProtocolViolations(t *testing.T) {
+	tooBig := New()
+	tooBig.MaxMessageSize = 8
+
+	tests := map[string]struct {
+		upgrader *Upgrader
+		send     func(c *testClient)
+		want     int
+	}{
+		"unmasked frame": {
+			send: func(c *testClient) {
+				require.NoError(t, writeFrame(c.conn, frameHeader{fin: true, op: opText}, []byte("hi")))
+			},
+			want: CloseProtocolError,
+		},
+		"invalid utf-8": {
+			send: func(c *testClient) { c.send(frameHeader{fin: true, op: opText}, []byte{0xc3, 0x28}) },
+			want: CloseInvalidPayload,
+		},
+		"invalid utf-8 across fragments": {
+			send: func(c *testClient) {
+				c.send(frameHeader{op: opText}, []byte{0xc3})
+				c.send(frameHeader{fin: true, op: opContinuation}, []byte{0x28})
+			},
+			want: CloseInvalidPayload,
+		},
+		"unknown opcode": {
+			send: func(c *testClient) { c.send(frameHeader{fin: true, op: 0x3}, nil) },
+			want: CloseProtocolError,
+		},
+		"fragmented ping": {
+			send: func(c *testClient) { c.send(frameHeader{op: opPing}, nil) },
+			want: CloseProtocolError,
+		},
+		"continuation without message": {
+			send: func(c *testClient) { c.send(frameHeader{fin: true, op: opContinuation}, []byte("x")) },
+			want: CloseProtocolError,
+		},
+		"new message inside fragmented one": {
+			send: func(c *testClient) {
+				c.send(frameHeader{op: opText}, []byte("a"))
+				c.send(frameHeader{fin: true, op: opText}, []byte("b"))
+			},
+			want: CloseProtocolError,
+		},
+		"compressed without negotiation": {
+			send: func(c *testClient) { c.send(frameHeader{fin: true, rsv1: true, op: opText}, []byte("x")) },
+			want: CloseProtocolError,
+		},
+		"invalid close code": {
+			send: func(c *testClient) {
+				c.send(frameHeader{fin: true, op: opClose}, binary.BigEndian.AppendUint16(nil, 1005))
+			},
+			want: CloseProtocolError,
+		},
+		"message too big": {
+			upgrader: tooBig,
+			send:     func(c *testClient) { c.send(frameHeader{fin: true, op: opBinary}, []byte("0123456789")) },
+			want:     CloseMessageTooBig,
+		},
+		"frame longer than the default limit": {
+			upgrader: &Upgrader{},
+			send: func(c *testClient) {
+				// just the header, claiming 2^62 bytes follow
+				frame := binary.BigEndian.AppendUint64([]byte{0x82, 0xff}, 1<<62)
+				_, err := c.conn.Write(append(frame, 1, 2, 3, 4))
+				require.NoError(t, err)
+			},
+			want: CloseMessageTooBig,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			u := tt.upgrader
+			if u == nil {
+				u = New()
+			}
+			done := make(chan error, 1)
+			c := dial(t, start(t, echo(u, nil, done)), "")
+			tt.send(c)
+			assert.Equal(t, tt.want, c.recvClose())
+			var closeErr *CloseError
+			require.ErrorAs(t, <-done, &closeErr)
+			assert.Equal(t, tt.want, closeErr.Code)
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	u := New()
+	u.EnableCompression = true
+	addr := start(t, echo(u, nil, make(chan error, 1)))
+	c := dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	assert.Equal(t, deflateResponse, c.res.Headers.Get("sec-websocket-extensions"))
+
+	msg := strings.Repeat("compress me please ", 20)
+	compressed, err := compress([]byte(msg))
+	require.NoError(t, err)
+	c.send(frameHeader{fin: true, rsv1: true, op: opText}, compressed)
+	h, payload := c.recv()
+	assert.True(t, h.rsv1)
+	assert.Less(t, len(payload), len(msg))
+	out, err := decompress(payload, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(out))
+
+	// short messages aren't worth compressing
+	c.send(frameHeader{fin: true, op: opText}, []byte("short"))
+	h, payload = c.recv()
+	assert.False(t, h.rsv1)
+	assert.Equal(t, "short", string(payload))
+}
+
+func TestCompressionBomb(t *testing.T) {
+	u := New()
+	u.EnableCompression = true
+	u.MaxMessageSize = 4096
+	done := make(chan error, 1)
+	c := dial(t, start(t, echo(u, nil, done)), "Sec-WebSocket-Extensions: permessage-deflate\r\n")
+
+	compressed, err := compress(make([]byte, 1<<20))
+	require.NoError(t, err)
+	require.Less(t, len(compressed), 4096)
+	c.send(frameHeader{fin: true, rsv1: true, op: opBinary}, compressed)
+	assert.Equal(t, CloseMessageTooBig, c.recvClose())
+}
+
+func TestAcceptDeflate(t *testing.T) {
+	assert.True(t, acceptDeflate("permessage-deflate"))
+	assert.True(t, acceptDeflate("x-webkit-deflate-frame, permessage-deflate; server_max_window_bits=15"))
+	assert.True(t, acceptDeflate("permessage-deflate; server_max_window_bits=10, permessage-deflate"))
+	assert.False(t, acceptDeflate("permessage-deflate; server_max_window_bits=10"))
+	assert.False(t, acceptDeflate("permessage-deflate; unknown_param"))
+	assert.False(t, acceptDeflate(""))
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		payload := bytes.Repeat([]byte("a"), n)
+		var buf bytes.Buffer
+		sent := frameHeader{fin: true, op: opBinary, masked: true, mask: [4]byte{9, 8, 7, 6}}
+		require.NoError(t, writeFrame(&buf, sent, payload))
+
+		h, err := readFrameHeader(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, int64(n), h.length)
+		assert.Equal(t, sent.mask, h.mask)
+		got := buf.Bytes()
+		maskBytes(h.mask, got)
+		assert.Equal(t, payload, got)
+	}
+
+	_, err := readFrameHeader(bytes.NewReader([]byte{0x82, 0x7f, 0x80, 0, 0, 0, 0, 0, 0, 0}))
+	assert.True(t, errors.Is(err, errFrameTooLong))
+	_, err = readFrameHeader(bytes.NewReader([]byte{0xa2, 0x00}))
+	assert.True(t, errors.Is(err, errReservedBits))
+}